@@ -0,0 +1,513 @@
+package phalanx
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+	"golang.org/x/xerrors"
+	"google.golang.org/protobuf/proto"
+)
+
+// checkpointer is the state machine of a raft node
+// which streams checkpoints of its state instead of snapshot data
+type checkpointer interface {
+	// waitApplied waits until the entries up to the index are durably applied
+	waitApplied(ctx context.Context, index uint64) error
+	// saveCheckpoint adds a checkpoint of the applied entries to the checkpoint chain
+	// and returns the bytes written
+	saveCheckpoint() (int64, error)
+	// writeCheckpoint writes a checkpoint which includes the entries up to the index
+	writeCheckpoint(index uint64, w io.Writer) error
+}
+
+// checkpoint header is the applied index and term of the checkpoint,
+// and the index of the previous file of the chain, or zero for a base.
+// The header is followed by the members at the index and the content.
+const checkpointHeaderSize = 8 + 8 + 8
+
+// checkpointDirName is the directory of the checkpoint chain in the snapshot directory
+const checkpointDirName = "checkpoints"
+
+// maxCheckpointDeltas is the number of deltas after which a new base is written
+var maxCheckpointDeltas = 16
+
+// maxDirtyKeys is the number of changed keys after which a new base is written
+var maxDirtyKeys = 1 << 16
+
+// deltaBatchSize is the number of entries of a delta written in a batch
+const deltaBatchSize = 256
+
+// recordingBatch records the keys of the region changed by the batch
+type recordingBatch struct {
+	Batch
+	region string
+	keys   map[string]struct{}
+	size   int // size of the keys and values
+}
+
+func newRecordingBatch(batch Batch, region string) *recordingBatch {
+	return &recordingBatch{
+		Batch:  batch,
+		region: region,
+		keys:   make(map[string]struct{}),
+	}
+}
+
+func (b *recordingBatch) Put(region string, key, value []byte) {
+	if region == b.region {
+		b.keys[string(key)] = struct{}{}
+	}
+	b.size += len(key) + len(value)
+	b.Batch.Put(region, key, value)
+}
+
+func (b *recordingBatch) Delete(region string, key []byte) {
+	if region == b.region {
+		b.keys[string(key)] = struct{}{}
+	}
+	b.size += len(key)
+	b.Batch.Delete(region, key)
+}
+
+func (b *recordingBatch) Reset() {
+	b.keys = make(map[string]struct{})
+	b.size = 0
+	b.Batch.Reset()
+}
+
+// recordChanges records the keys changed since the last checkpoint.
+// It must be called with dirtyMu held.
+func (db *phananxDB) recordChanges(keys map[string]struct{}) {
+	if db.checkpoints == nil || db.needBase {
+		return
+	}
+	for key := range keys {
+		db.dirtyKeys[key] = struct{}{}
+	}
+	if len(db.dirtyKeys) > maxDirtyKeys {
+		db.needBase = true
+		db.dirtyKeys = make(map[string]struct{})
+	}
+}
+
+// resetCheckpoints discards the checkpoint chain
+// because the region is replaced
+func (db *phananxDB) resetCheckpoints() {
+	if db.checkpoints == nil {
+		return
+	}
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+	db.checkpoints.clear()
+	db.dirtyMu.Lock()
+	defer db.dirtyMu.Unlock()
+	db.needBase = true
+	db.dirtyKeys = make(map[string]struct{})
+}
+
+// saveCheckpoint adds a checkpoint of the applied entries to the chain.
+// It writes a delta of the keys changed since the last checkpoint,
+// or a new base which compacts the chain
+// when the deltas are many or no smaller than the base.
+func (db *phananxDB) saveCheckpoint() (int64, error) {
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+
+	// the changed keys are consistent with the snapshot
+	db.dirtyMu.Lock()
+	snapshot, err := db.stableStore.GetSnapshot()
+	if err != nil {
+		db.dirtyMu.Unlock()
+		return 0, err
+	}
+	keys, needBase := db.dirtyKeys, db.needBase
+	db.dirtyKeys, db.needBase = make(map[string]struct{}), false
+	db.dirtyMu.Unlock()
+	defer snapshot.Release()
+
+	index, term, err := readAppliedIndex(snapshot, db.regionName)
+	if err != nil {
+		return 0, err
+	}
+	// the members are persisted with the applied index
+	members, err := readMembers(snapshot, db.regionName)
+	if err != nil {
+		return 0, err
+	}
+	lastIndex := db.checkpoints.lastIndex()
+	if index == lastIndex && !needBase {
+		return 0, nil
+	}
+
+	baseSize, deltas, deltaSize := db.checkpoints.stat()
+	base := needBase || lastIndex == 0 ||
+		deltas >= maxCheckpointDeltas || deltaSize >= baseSize
+
+	var parent uint64
+	if !base {
+		parent = lastIndex
+	}
+	size, err := db.checkpoints.add(index, !base, func(w io.Writer) error {
+		if err := writeCheckpointHeader(w, index, term, parent); err != nil {
+			return err
+		}
+		if err := writeCheckpointMembers(w, members); err != nil {
+			return err
+		}
+		if base {
+			return db.stableStore.WriteCheckpoint(snapshot, db.regionName, w)
+		}
+		return writeDelta(w, snapshot, db.regionName, keys)
+	})
+	if err != nil {
+		// the changed keys are lost
+		db.dirtyMu.Lock()
+		db.needBase = true
+		db.dirtyMu.Unlock()
+		return 0, err
+	}
+	return size, nil
+}
+
+// writeCheckpoint writes the checkpoint chain of the region.
+// The chain is the number of the files followed by
+// the size and the content of each file, the base first.
+func (db *phananxDB) writeCheckpoint(index uint64, w io.Writer) error {
+	if err := db.waitApplied(context.Background(), index); err != nil {
+		return err
+	}
+	// bring the chain up to the applied entries
+	if _, err := db.saveCheckpoint(); err != nil {
+		return err
+	}
+
+	files, infos, err := db.checkpoints.open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if len(files) == 0 {
+		return xerrors.New("phalanx: no checkpoint")
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(files))); err != nil {
+		return err
+	}
+	for i, f := range files {
+		if err := binary.Write(w, binary.BigEndian, uint64(infos[i].size)); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, f, infos[i].size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFromCheckpoint restores the region from the checkpoint chain
+// and records its applied index with the members of the last checkpoint.
+// It returns the index and the members, which are nil if the checkpoint has none.
+// The chain is verified before the region is changed,
+// so a corrupted or missing file fails without restoring a part of the chain.
+func (db *phananxDB) restoreFromCheckpoint(r io.ReadSeeker) (uint64, []Member, error) {
+	if err := verifyCheckpoint(r); err != nil {
+		return 0, nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return 0, nil, xerrors.Errorf("phalanx: fail to read checkpoint: %w", err)
+	}
+
+	var index, term uint64
+	var members []Member
+	for i := uint32(0); i < count; i++ {
+		var size uint64
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return 0, nil, xerrors.Errorf("phalanx: fail to read checkpoint: %w", err)
+		}
+		file := io.LimitReader(r, int64(size))
+
+		var err error
+		index, term, _, err = readCheckpointHeader(file)
+		if err != nil {
+			return 0, nil, err
+		}
+		var membersSize int64
+		members, membersSize, err = readCheckpointMembers(file)
+		if err != nil {
+			return 0, nil, err
+		}
+		content := io.LimitReader(file, int64(size)-checkpointHeaderSize-membersSize-checkpointTrailerSize)
+		if i == 0 {
+			err = db.stableStore.RestoreFromCheckpoint(db.regionName, content)
+		} else {
+			err = db.applyDelta(content)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		// skip the rest and the trailer
+		if _, err := io.Copy(ioutil.Discard, file); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// syncing the applied index makes the restored region durable
+	batch := db.stableStore.CreateBatch()
+	putAppliedIndex(batch, db.regionName, index, term)
+	if members != nil {
+		if err := putMembers(batch, db.regionName, members); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := db.stableStore.WriteSync(batch); err != nil {
+		return 0, nil, err
+	}
+	return index, members, nil
+}
+
+// verifyCheckpoint verifies the CRC of each file of the checkpoint chain
+// and that each delta follows the previous file
+func verifyCheckpoint(r io.Reader) error {
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return xerrors.Errorf("phalanx: fail to read checkpoint: %w", err)
+	}
+	if count == 0 {
+		return xerrors.New("phalanx: empty checkpoint")
+	}
+
+	var prev uint64
+	for i := uint32(0); i < count; i++ {
+		var size uint64
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return xerrors.Errorf("phalanx: fail to read checkpoint: %w", err)
+		}
+		if size < checkpointHeaderSize+checkpointTrailerSize {
+			return xerrors.Errorf("phalanx: checkpoint file %d is too short: %w", i, ErrCheckpointCorrupted)
+		}
+		crc := crc32.New(crcTable)
+		content := io.TeeReader(io.LimitReader(r, int64(size)-checkpointTrailerSize), crc)
+		index, _, parent, err := readCheckpointHeader(content)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, content); err != nil {
+			return xerrors.Errorf("phalanx: fail to read checkpoint: %w", err)
+		}
+		var sum uint32
+		if err := binary.Read(r, binary.BigEndian, &sum); err != nil {
+			return xerrors.Errorf("phalanx: fail to read checkpoint: %w", err)
+		}
+		if sum != crc.Sum32() {
+			return xerrors.Errorf("phalanx: CRC mismatch of checkpoint file %d: %w", i, ErrCheckpointCorrupted)
+		}
+		if i > 0 && parent != prev {
+			return xerrors.Errorf("phalanx: checkpoint delta %d does not follow %d: %w",
+				index, prev, ErrCheckpointCorrupted)
+		}
+		prev = index
+	}
+	return nil
+}
+
+func writeCheckpointHeader(w io.Writer, index, term, parent uint64) error {
+	header := make([]byte, checkpointHeaderSize)
+	binary.BigEndian.PutUint64(header[:8], index)
+	binary.BigEndian.PutUint64(header[8:16], term)
+	binary.BigEndian.PutUint64(header[16:], parent)
+	_, err := w.Write(header)
+	return err
+}
+
+func readCheckpointHeader(r io.Reader) (uint64, uint64, uint64, error) {
+	header := make([]byte, checkpointHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, 0, xerrors.Errorf("phalanx: fail to read checkpoint header: %w", err)
+	}
+	return binary.BigEndian.Uint64(header[:8]),
+		binary.BigEndian.Uint64(header[8:16]),
+		binary.BigEndian.Uint64(header[16:]), nil
+}
+
+// writeCheckpointMembers writes the size-prefixed members persisted with the index of the checkpoint,
+// so that the restored region does not miss the conf changes after the raft snapshot
+func writeCheckpointMembers(w io.Writer, members []Member) error {
+	var data []byte
+	if members != nil {
+		var err error
+		if data, err = marshalMembers(members); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readCheckpointMembers returns the members of the checkpoint, or nil if it has none,
+// and the size of them in the checkpoint
+func readCheckpointMembers(r io.Reader) ([]Member, int64, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, 0, xerrors.Errorf("phalanx: fail to read checkpoint members: %w", err)
+	}
+	if size == 0 {
+		return nil, 4, nil
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, xerrors.Errorf("phalanx: fail to read checkpoint members: %w", err)
+	}
+	members, err := unmarshalMembers(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return members, 4 + int64(size), nil
+}
+
+// writeDelta writes the keys in the snapshot as length-prefixed CheckpointEntry
+func writeDelta(w io.Writer, snapshot Snapshot, region string, keys map[string]struct{}) error {
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	bw := bufio.NewWriter(w)
+	size := make([]byte, binary.MaxVarintLen64)
+	for _, key := range sorted {
+		entry := &phalanxpb.CheckpointEntry{Key: []byte(key)}
+		value, err := snapshot.Get(region, []byte(key))
+		if err == ErrKeyNotFound {
+			entry.Deleted = true
+		} else if err != nil {
+			return err
+		} else {
+			entry.Value = value
+		}
+		data, err := proto.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		n := binary.PutUvarint(size, uint64(len(data)))
+		if _, err := bw.Write(size[:n]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(data); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// applyDelta applies the entries of a delta to the region
+func (db *phananxDB) applyDelta(r io.Reader) error {
+	br := bufio.NewReader(r)
+	batch := db.stableStore.CreateBatch()
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return xerrors.Errorf("phalanx: fail to read delta: %w", err)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return xerrors.Errorf("phalanx: fail to read delta: %w", err)
+		}
+		var entry phalanxpb.CheckpointEntry
+		if err := proto.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		if entry.Deleted {
+			batch.Delete(db.regionName, entry.Key)
+		} else {
+			batch.Put(db.regionName, entry.Key, entry.Value)
+		}
+		if batch.Len() >= deltaBatchSize {
+			if err := db.stableStore.Write(batch); err != nil {
+				return err
+			}
+			batch = db.stableStore.CreateBatch()
+		}
+	}
+	return db.stableStore.Write(batch)
+}
+
+// loadSnapshot restores the region to the raft snapshot.
+// It returns the index which the region is restored to
+// and the members persisted with the index, which are nil if they are not restored.
+func (db *phananxDB) loadSnapshot(snapshot *raftpb.Snapshot) (uint64, []Member, error) {
+	members, data, err := decodeSnapshotData(snapshot.Data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// the checkpoint streamed by the leader carries the members of its own index,
+	// which may be newer than the snapshot
+	path, err := db.snapshotter.DBFilePath(snapshot.Metadata.Index)
+	if err == nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer f.Close()
+		db.resetCheckpoints()
+		index, members, err := db.restoreFromCheckpoint(f)
+		if err != nil {
+			return 0, nil, err
+		}
+		return index, members, os.Remove(path)
+	} else if err != snap.ErrNoDBSnapshot {
+		return 0, nil, err
+	}
+
+	if len(data) == 0 {
+		// the snapshot is created locally and the stable store has its state and members
+		return snapshot.Metadata.Index, nil, nil
+	}
+
+	// the checkpoint embedded in the snapshot
+	db.resetCheckpoints()
+	if err := db.recoverFromSnapshot(data); err != nil {
+		return 0, nil, err
+	}
+	batch := db.stableStore.CreateBatch()
+	putAppliedIndex(batch, db.regionName, snapshot.Metadata.Index, snapshot.Metadata.Term)
+	if members != nil {
+		if err := putMembers(batch, db.regionName, members); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := db.stableStore.WriteSync(batch); err != nil {
+		return 0, nil, err
+	}
+	return snapshot.Metadata.Index, members, nil
+}
+
+// removeCheckpointFile removes the streamed checkpoint which is not used
+func (db *phananxDB) removeCheckpointFile(index uint64) {
+	if path, err := db.snapshotter.DBFilePath(index); err == nil {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,233 @@
+package phalanx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"golang.org/x/xerrors"
+)
+
+const (
+	baseCheckpointExt  = ".base"
+	deltaCheckpointExt = ".delta"
+)
+
+// checkpointTrailerSize is the CRC of the content of a checkpoint file
+const checkpointTrailerSize = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checkpointFile is a file of the checkpoint chain
+type checkpointFile struct {
+	index uint64
+	delta bool
+	size  int64
+}
+
+func (f checkpointFile) name() string {
+	if f.delta {
+		return fmt.Sprintf("%016x%s", f.index, deltaCheckpointExt)
+	}
+	return fmt.Sprintf("%016x%s", f.index, baseCheckpointExt)
+}
+
+// checkpointChain is a base checkpoint and the deltas on top of it.
+// Restoring the base and the deltas in order reproduces the region
+// at the index of the last file.
+type checkpointChain struct {
+	mu    sync.Mutex
+	dir   string
+	files []checkpointFile // the base first and the deltas in the order of the index
+}
+
+// openCheckpointChain loads the chain in dir.
+// The directory is created when a checkpoint is added.
+func openCheckpointChain(dir string) (*checkpointChain, error) {
+	c := &checkpointChain{dir: dir}
+	if !fileutil.Exist(dir) {
+		return c, nil
+	}
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("phalanx: fail to read checkpoint dir: %w", err)
+	}
+
+	var files []checkpointFile
+	for _, name := range names {
+		var f checkpointFile
+		ext := filepath.Ext(name)
+		switch ext {
+		case baseCheckpointExt:
+		case deltaCheckpointExt:
+			f.delta = true
+		default:
+			// a checkpoint which failed to be written
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, ext), "%016x", &f.index); err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		f.size = info.Size()
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].index < files[j].index
+	})
+
+	// the chain starts at the last base
+	for i := len(files) - 1; i >= 0; i-- {
+		if !files[i].delta {
+			c.files = files[i:]
+			c.removeFiles(files[:i])
+			break
+		}
+	}
+
+	// the chain ends before a delta which does not follow the previous file
+	for i := 1; i < len(c.files); i++ {
+		_, _, parent, err := c.readHeader(c.files[i])
+		if err != nil || parent != c.files[i-1].index {
+			c.removeFiles(c.files[i:])
+			c.files = c.files[:i]
+			break
+		}
+	}
+	return c, nil
+}
+
+// readHeader reads the header of the file of the chain
+func (c *checkpointChain) readHeader(file checkpointFile) (uint64, uint64, uint64, error) {
+	f, err := os.Open(filepath.Join(c.dir, file.name()))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	return readCheckpointHeader(f)
+}
+
+// lastIndex returns the index of the last checkpoint or zero if the chain is empty
+func (c *checkpointChain) lastIndex() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.files) == 0 {
+		return 0
+	}
+	return c.files[len(c.files)-1].index
+}
+
+// stat returns the size of the base and the number and the total size of the deltas
+func (c *checkpointChain) stat() (baseSize int64, deltas int, deltaSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.files {
+		if f.delta {
+			deltas++
+			deltaSize += f.size
+		} else {
+			baseSize = f.size
+		}
+	}
+	return baseSize, deltas, deltaSize
+}
+
+// add writes a checkpoint at the index to the chain and returns the size of the file.
+// A base replaces the whole chain.
+// The header written by write links a delta to the last file of the chain.
+func (c *checkpointChain) add(index uint64, delta bool, write func(w io.Writer) error) (int64, error) {
+	if err := fileutil.TouchDirAll(c.dir); err != nil {
+		return 0, xerrors.Errorf("phalanx: fail to create checkpoint dir: %w", err)
+	}
+	f, err := ioutil.TempFile(c.dir, "tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	// the CRC of the content is appended to detect a corrupted file on restore
+	crc := crc32.New(crcTable)
+	if err := write(io.MultiWriter(f, crc)); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := binary.Write(f, binary.BigEndian, crc.Sum32()); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := fileutil.Fsync(f); err != nil {
+		f.Close()
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	file := checkpointFile{index: index, delta: delta, size: size}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if delta && len(c.files) == 0 {
+		return 0, xerrors.New("phalanx: delta checkpoint without base")
+	}
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, file.name())); err != nil {
+		return 0, err
+	}
+	if delta {
+		c.files = append(c.files, file)
+		return size, nil
+	}
+	c.removeFiles(c.files)
+	c.files = []checkpointFile{file}
+	return size, nil
+}
+
+// clear removes all the checkpoints
+func (c *checkpointChain) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeFiles(c.files)
+	c.files = nil
+}
+
+// open opens the files of the chain.
+// The opened files are readable even if the chain is replaced.
+func (c *checkpointChain) open() ([]*os.File, []checkpointFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	opened := make([]*os.File, 0, len(c.files))
+	for _, file := range c.files {
+		f, err := os.Open(filepath.Join(c.dir, file.name()))
+		if err != nil {
+			for _, o := range opened {
+				o.Close()
+			}
+			return nil, nil, err
+		}
+		opened = append(opened, f)
+	}
+	return opened, append([]checkpointFile{}, c.files...), nil
+}
+
+func (c *checkpointChain) removeFiles(files []checkpointFile) {
+	for _, f := range files {
+		os.Remove(filepath.Join(c.dir, f.name()))
+	}
+}
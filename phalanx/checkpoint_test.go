@@ -0,0 +1,240 @@
+package phalanx_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getumen/doctrine/phalanx"
+	_ "github.com/getumen/doctrine/phalanx/stablestore/leveldb"
+)
+
+const region = "region-a"
+
+var members = []phalanx.Member{
+	{ID: 1, URLs: []string{"http://127.0.0.1:10001"}},
+	{ID: 2, URLs: []string{"http://127.0.0.1:10002"}, IsLearner: true},
+}
+
+func newCheckpointDB(t *testing.T) (phalanx.StableStore, *phalanx.CheckpointTestDB, string) {
+	tempDir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	stableStore, err := phalanx.NewStableStore("leveldb", filepath.Join(tempDir, "stableStore"))
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	t.Cleanup(func() { stableStore.Close() })
+	dir := filepath.Join(tempDir, "checkpoints")
+	db, err := phalanx.NewCheckpointTestDB(stableStore, region, dir)
+	if err != nil {
+		t.Fatalf("fail to create db: %+v", err)
+	}
+	return stableStore, db, dir
+}
+
+// readRegion returns all key-values of the region
+func readRegion(t *testing.T, stableStore phalanx.StableStore) map[string]string {
+	snapshot, err := stableStore.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+	iter, err := snapshot.NewIterator(region, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Release()
+	kvs := make(map[string]string)
+	for iter.Next() {
+		kvs[string(iter.Key())] = string(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return kvs
+}
+
+// checkpointFiles returns the extensions of the files of the chain
+func checkpointFiles(t *testing.T, dir string) []string {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exts []string
+	for _, info := range names {
+		exts = append(exts, filepath.Ext(info.Name()))
+	}
+	return exts
+}
+
+// applyChanges applies a base of 100 keys and then three deltas with deletes
+func applyChanges(t *testing.T, db *phalanx.CheckpointTestDB) {
+	changes := []func(batch phalanx.Batch){
+		func(batch phalanx.Batch) {
+			for i := 0; i < 100; i++ {
+				batch.Put(region, []byte(fmt.Sprintf("key-%03d", i)), bytes.Repeat([]byte{'v'}, 100))
+			}
+		},
+		func(batch phalanx.Batch) {
+			batch.Put(region, []byte("key-new"), []byte("new"))
+			batch.Delete(region, []byte("key-000"))
+		},
+		func(batch phalanx.Batch) {
+			batch.Put(region, []byte("key-001"), []byte("changed"))
+			batch.Delete(region, []byte("key-new"))
+			// a conf change after the base
+			if err := phalanx.PutMembers(batch, region, members); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func(batch phalanx.Batch) {
+			batch.Put(region, []byte("key-000"), []byte("again"))
+			batch.Delete(region, []byte("key-099"))
+		},
+	}
+	for i, change := range changes {
+		if err := db.Apply(uint64(i+1), change); err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+		if err := db.SaveCheckpoint(); err != nil {
+			t.Fatalf("fail to save checkpoint: %+v", err)
+		}
+	}
+}
+
+func TestCheckpointChainRestore(t *testing.T) {
+	defer phalanx.SetMaxCheckpointDeltas(3)()
+
+	source, db, dir := newCheckpointDB(t)
+	applyChanges(t, db)
+	if exts := checkpointFiles(t, dir); fmt.Sprint(exts) != "[.base .delta .delta .delta]" {
+		t.Fatalf("expect a base and 3 deltas, got %v", exts)
+	}
+
+	restore := func() {
+		var chain bytes.Buffer
+		if err := db.WriteCheckpoint(db.LastCheckpointIndex(), &chain); err != nil {
+			t.Fatalf("fail to write checkpoint: %+v", err)
+		}
+		target, restored, _ := newCheckpointDB(t)
+		index, err := restored.RestoreFromCheckpoint(bytes.NewReader(chain.Bytes()))
+		if err != nil {
+			t.Fatalf("fail to restore: %+v", err)
+		}
+		if index != db.LastCheckpointIndex() {
+			t.Fatalf("expect index %d, got %d", db.LastCheckpointIndex(), index)
+		}
+		if applied, err := phalanx.AppliedIndex(target, region); err != nil || applied != index {
+			t.Fatalf("expect applied index %d, got %d (%v)", index, applied, err)
+		}
+		expected, actual := readRegion(t, source), readRegion(t, target)
+		if fmt.Sprint(expected) != fmt.Sprint(actual) {
+			t.Fatalf("expect %v, got %v", expected, actual)
+		}
+		// the members are restored with the applied index
+		if restored, err := phalanx.PersistedMembers(target, region); err != nil || fmt.Sprint(restored) != fmt.Sprint(members) {
+			t.Fatalf("expect members %v, got %v (%v)", members, restored, err)
+		}
+	}
+	restore()
+
+	// the chain is compacted into a new base after the max deltas
+	if err := db.Apply(5, func(batch phalanx.Batch) {
+		batch.Delete(region, []byte("key-050"))
+	}); err != nil {
+		t.Fatalf("fail to apply: %+v", err)
+	}
+	if err := db.SaveCheckpoint(); err != nil {
+		t.Fatalf("fail to save checkpoint: %+v", err)
+	}
+	if exts := checkpointFiles(t, dir); fmt.Sprint(exts) != "[.base]" {
+		t.Fatalf("expect a compacted base, got %v", exts)
+	}
+	restore()
+}
+
+// splitChain returns the files of the streamed chain
+func splitChain(t *testing.T, chain []byte) [][]byte {
+	count := binary.BigEndian.Uint32(chain)
+	chain = chain[4:]
+	files := make([][]byte, count)
+	for i := range files {
+		size := binary.BigEndian.Uint64(chain)
+		files[i] = append([]byte{}, chain[8:8+size]...)
+		chain = chain[8+size:]
+	}
+	return files
+}
+
+func joinChain(files [][]byte) []byte {
+	var chain bytes.Buffer
+	binary.Write(&chain, binary.BigEndian, uint32(len(files)))
+	for _, f := range files {
+		binary.Write(&chain, binary.BigEndian, uint64(len(f)))
+		chain.Write(f)
+	}
+	return chain.Bytes()
+}
+
+func TestCheckpointChainCorrupted(t *testing.T) {
+	source, db, dir := newCheckpointDB(t)
+	applyChanges(t, db)
+	var chain bytes.Buffer
+	if err := db.WriteCheckpoint(db.LastCheckpointIndex(), &chain); err != nil {
+		t.Fatalf("fail to write checkpoint: %+v", err)
+	}
+
+	corrupted := splitChain(t, chain.Bytes())
+	corrupted[2][len(corrupted[2])/2] ^= 0xff
+	missing := splitChain(t, chain.Bytes())
+	missing = append(missing[:2], missing[3:]...)
+
+	for name, broken := range map[string][]byte{
+		"corrupted": joinChain(corrupted),
+		"missing":   joinChain(missing),
+	} {
+		t.Run(name, func(t *testing.T) {
+			target, restored, _ := newCheckpointDB(t)
+			if err := restored.Apply(1, func(batch phalanx.Batch) {
+				batch.Put(region, []byte("stale"), []byte("value"))
+			}); err != nil {
+				t.Fatalf("fail to apply: %+v", err)
+			}
+
+			if _, err := restored.RestoreFromCheckpoint(bytes.NewReader(broken)); !errors.Is(err, phalanx.ErrCheckpointCorrupted) {
+				t.Fatalf("expect %v, got %+v", phalanx.ErrCheckpointCorrupted, err)
+			}
+			// nothing of the chain is restored
+			if kvs := readRegion(t, target); fmt.Sprint(kvs) != "map[stale:value]" {
+				t.Fatalf("expect the region is not changed, got %d keys", len(kvs))
+			}
+			if applied, err := phalanx.AppliedIndex(target, region); err != nil || applied != 1 {
+				t.Fatalf("expect applied index 1, got %d (%v)", applied, err)
+			}
+		})
+	}
+
+	// the local chain ends before a missing delta
+	if err := os.Remove(filepath.Join(dir, fmt.Sprintf("%016x.delta", 3))); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := phalanx.NewCheckpointTestDB(source, region, dir)
+	if err != nil {
+		t.Fatalf("fail to reopen db: %+v", err)
+	}
+	if index := reopened.LastCheckpointIndex(); index != 2 {
+		t.Fatalf("expect the chain ends at 2, got %d", index)
+	}
+	if exts := checkpointFiles(t, dir); fmt.Sprint(exts) != "[.base .delta]" {
+		t.Fatalf("expect the deltas after the missing one are removed, got %v", exts)
+	}
+}
@@ -0,0 +1,343 @@
+package phalanx
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/pkg/types"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// clusterPath serves the cluster ID to joining members
+	clusterPath = "/phalanx/cluster"
+
+	// clusterIDHeader is the header of the cluster ID of the sender
+	clusterIDHeader = "X-Etcd-Cluster-ID"
+
+	// clusterFileName is the file of the cluster identity in the snapshot directory
+	// of a node whose raft log is kept in a LogStore
+	clusterFileName = "cluster"
+
+	// legacyClusterID is the cluster ID of the raft logs written before
+	// the cluster identity was persisted, whose member IDs are the indexes of the peers
+	legacyClusterID = 0x1000
+)
+
+// member is a member of the initial cluster
+type member struct {
+	id   uint64
+	name string
+	url  string
+}
+
+// MemberID returns the member ID derived from the name of a member.
+// A peer is given as name=URL, or as URL whose name is the URL itself,
+// so the member ID does not depend on the order of the peers.
+// A node restarting on a raft log written without the cluster identity
+// keeps the member ID of its index in the peers.
+func MemberID(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	if id := h.Sum64(); id != 0 {
+		return id
+	}
+	// raft reserves zero for no member
+	return 1
+}
+
+// parsePeers parses the peers given as name=URL or URL
+func parsePeers(peers []string) ([]member, error) {
+	members := make([]member, len(peers))
+	ids := make(map[uint64]string)
+	for i, peer := range peers {
+		name, url := peer, peer
+		if eq := strings.Index(peer, "="); eq >= 0 {
+			name, url = peer[:eq], peer[eq+1:]
+		}
+		if name == "" || url == "" {
+			return nil, xerrors.Errorf("phalanx: invalid peer %q", peer)
+		}
+		id := MemberID(name)
+		if dup, exists := ids[id]; exists {
+			return nil, xerrors.Errorf("phalanx: peers %q and %q have the same member ID", dup, name)
+		}
+		ids[id] = name
+		members[i] = member{id: id, name: name, url: url}
+	}
+	return members, nil
+}
+
+// selfMember returns the member of the index which starts from 1
+func selfMember(members []member, index int) (member, error) {
+	if index < 1 || index > len(members) {
+		return member{}, xerrors.Errorf(
+			"phalanx: member %d is not in %d peers", index, len(members))
+	}
+	return members[index-1], nil
+}
+
+// initialClusterID returns the cluster ID derived from the token and the members of the initial cluster.
+// Every bootstrapping member derives the same ID regardless of the order of the peers.
+// Independent clusters derive different IDs from their URLs,
+// and clusters bootstrapped again on the same URLs from their tokens.
+func initialClusterID(members []member, token string) uint64 {
+	peers := make([]string, len(members))
+	for i, m := range members {
+		peers[i] = m.name + "=" + m.url
+	}
+	sort.Strings(peers)
+	h := fnv.New64a()
+	h.Write([]byte(token))
+	h.Write([]byte{0})
+	for _, peer := range peers {
+		h.Write([]byte(peer))
+		h.Write([]byte{0})
+	}
+	if id := h.Sum64(); id != 0 {
+		return id
+	}
+	return 1
+}
+
+// clusterIdentity is the identity of a member persisted with its raft log
+type clusterIdentity struct {
+	memberID  uint64
+	clusterID uint64
+}
+
+func (ci clusterIdentity) marshal() []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[:8], ci.memberID)
+	binary.BigEndian.PutUint64(data[8:], ci.clusterID)
+	return data
+}
+
+func unmarshalClusterIdentity(data []byte) (clusterIdentity, error) {
+	if len(data) != 16 {
+		return clusterIdentity{}, xerrors.New("phalanx: invalid cluster identity")
+	}
+	return clusterIdentity{
+		memberID:  binary.BigEndian.Uint64(data[:8]),
+		clusterID: binary.BigEndian.Uint64(data[8:]),
+	}, nil
+}
+
+// verify checks that the persisted identity matches the configuration.
+// A zero cluster ID of the configuration matches any cluster.
+func (ci clusterIdentity) verify(memberID, clusterID uint64) error {
+	if ci.memberID != memberID {
+		return xerrors.Errorf(
+			"phalanx: persisted member %s, configured %s: %w",
+			types.ID(ci.memberID), types.ID(memberID), ErrMemberIDMismatch)
+	}
+	if clusterID != 0 && ci.clusterID != clusterID {
+		return xerrors.Errorf(
+			"phalanx: persisted cluster %s, configured %s: %w",
+			types.ID(ci.clusterID), types.ID(clusterID), ErrClusterIDMismatch)
+	}
+	return nil
+}
+
+// clusterHandler serves the cluster ID
+func clusterHandler(clusterID uint64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte(types.ID(clusterID).String()))
+	}
+}
+
+var (
+	fetchClusterIDTimeout = time.Minute
+	fetchClusterIDRetry   = 500 * time.Millisecond
+)
+
+// stopContext returns a context which is canceled when stopc is closed
+func stopContext(stopc <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// fetchClusterID asks the members except self for the cluster ID until ctx is done
+func fetchClusterID(ctx context.Context, members []member, self member, peerTLS *PeerTLSInfo, logger Logger) (uint64, error) {
+	deadline := time.Now().Add(fetchClusterIDTimeout)
+	for {
+		for _, m := range members {
+			if m.id == self.id {
+				continue
+			}
+			clusterID, err := getClusterID(ctx, m, self, peerTLS)
+			if err == nil {
+				return clusterID, nil
+			}
+			logger.Warn("failed to get cluster ID", peerField(types.ID(m.id)), errorField(err))
+		}
+		if time.Now().After(deadline) {
+			return 0, xerrors.New("phalanx: no member tells the cluster ID")
+		}
+		select {
+		case <-time.After(fetchClusterIDRetry):
+		case <-ctx.Done():
+			return 0, xerrors.Errorf("phalanx: stopped fetching the cluster ID: %w", ctx.Err())
+		}
+	}
+}
+
+func getClusterID(ctx context.Context, m member, self member, peerTLS *PeerTLSInfo) (uint64, error) {
+	client := &http.Client{Timeout: peerRequestTimeout}
+	if peerTLS != nil {
+		config, err := peerTLS.clientConfig(m.id)
+		if err != nil {
+			return 0, err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", m.url+clusterPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(serverFromHeader, types.ID(self.id).String())
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, xerrors.Errorf("phalanx: unexpected status %s", resp.Status)
+	}
+	id, err := types.IDFromString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(id), nil
+}
+
+// newClusterIdentity returns the identity of a node without raft log.
+// A bootstrapping node derives the cluster ID from the initial peers,
+// and a joining node asks the other members.
+func (rc *phalanxNode) newClusterIdentity() (clusterIdentity, error) {
+	if rc.clusterID == 0 {
+		if rc.join {
+			ctx, cancel := stopContext(rc.stoppingc)
+			clusterID, err := fetchClusterID(ctx, rc.members, rc.self, rc.peerTLS, rc.logger)
+			cancel()
+			if err != nil {
+				return clusterIdentity{}, xerrors.Errorf("phalanxNode: failed to join cluster: %w", err)
+			}
+			rc.clusterID = clusterID
+		} else {
+			rc.clusterID = initialClusterID(rc.members, rc.clusterToken)
+		}
+	}
+	return clusterIdentity{memberID: rc.self.id, clusterID: rc.clusterID}, nil
+}
+
+// checkClusterIdentity checks the identity persisted with the raft log
+// and adopts its cluster ID.
+// The raft log without the identity keeps the legacy identity.
+func (rc *phalanxNode) checkClusterIdentity(data []byte) error {
+	if len(data) == 0 {
+		return rc.useLegacyIdentity()
+	}
+	identity, err := unmarshalClusterIdentity(data)
+	if err != nil {
+		return err
+	}
+	clusterID := rc.clusterID
+	if clusterID == 0 && !rc.join {
+		clusterID = initialClusterID(rc.members, rc.clusterToken)
+	}
+	if err := identity.verify(rc.self.id, clusterID); err != nil {
+		return err
+	}
+	rc.clusterID = identity.clusterID
+	return nil
+}
+
+// loadClusterIdentity checks the identity persisted in the snapshot directory,
+// or persists a new one if the log store is empty
+func (rc *phalanxNode) loadClusterIdentity(oldlog bool) error {
+	path := filepath.Join(rc.snapdir, clusterFileName)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return rc.checkClusterIdentity(data)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if oldlog {
+		return rc.useLegacyIdentity()
+	}
+	identity, err := rc.newClusterIdentity()
+	if err != nil {
+		return err
+	}
+	return writeFileSync(path, identity.marshal())
+}
+
+// useLegacyIdentity makes the node keep the identity of the raft log
+// written before the cluster identity was persisted,
+// where the member IDs are the indexes of the peers starting from 1 and the cluster ID is legacyClusterID.
+// The identity is not persisted, so the node keeps it on every restart.
+func (rc *phalanxNode) useLegacyIdentity() error {
+	if rc.clusterID != 0 && rc.clusterID != legacyClusterID {
+		return xerrors.Errorf(
+			"phalanx: legacy cluster %s, configured %s: %w",
+			types.ID(legacyClusterID), types.ID(rc.clusterID), ErrClusterIDMismatch)
+	}
+	rc.logger.Warn("the raft log has no cluster identity, keeping the member IDs of the peer indexes",
+		Field{Key: "legacy-member-id", Value: types.ID(rc.id).String()})
+	for i := range rc.members {
+		rc.members[i].id = uint64(i + 1)
+	}
+	rc.self = rc.members[rc.id-1]
+	rc.clusterID = legacyClusterID
+	rc.membership = newMembership(rc.self, rc.members)
+	rc.setLogger(rc.baseLogger, rc.region)
+	rc.metrics.setMemberID(rc.self.id)
+	return nil
+}
+
+// writeFileSync replaces the file with the data durably
+func writeFileSync(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := fileutil.Fsync(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -4,10 +4,18 @@ import "github.com/getumen/doctrine/phalanx/phalanxpb"
 
 // CommandHandler provides command hadler
 type CommandHandler interface {
-	// Apply applies the command to the stableStorage
+	// Apply applies the command by writing to the batch.
+	// stableStorage is for reading the state before the command.
+	// Its snapshots read the writes of the commands applied before the command
+	// which are not written yet by ProposalBatching or ApplyPerReady,
+	// so they must be released before Apply returns.
+	// The batch is written with the applied index of the region,
+	// and it is discarded if Apply returns an error.
+	// The result and the error are returned to the proposer of the command.
 	Apply(
 		regioin string,
 		command *phalanxpb.Command,
+		batch Batch,
 		stableStorage StableStore,
-	)
+	) (interface{}, error)
 }
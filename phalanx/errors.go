@@ -8,6 +8,28 @@ import (
 var (
 	// ErrKeyNotFound represnts that the key is not found in the stable store
 	ErrKeyNotFound = errors.New("not found")
+	// ErrNodeStopped represents that the node is stopped
+	ErrNodeStopped = errors.New("node stopped")
+	// ErrLeaderChanged represents that the leader changed while the proposal is in flight
+	ErrLeaderChanged = errors.New("leader changed")
+	// ErrProposalTimeout represents that the proposal is not applied in time
+	ErrProposalTimeout = errors.New("proposal timed out")
+	// ErrClusterIDMismatch represents that the persisted cluster ID does not match the configuration
+	ErrClusterIDMismatch = errors.New("cluster ID mismatch")
+	// ErrMemberIDMismatch represents that the persisted member ID does not match the configuration
+	ErrMemberIDMismatch = errors.New("member ID mismatch")
+	// ErrMemberNotFound represents that the member is not in the raft group
+	ErrMemberNotFound = errors.New("member not found")
+	// ErrNoTransferee represents that no follower can take over the leadership
+	ErrNoTransferee = errors.New("no follower to transfer leadership to")
+	// ErrNotLeader represents that the operation needs the progress known only on the leader
+	ErrNotLeader = errors.New("not leader")
+	// ErrSenderMismatch represents that the raft message is sent by another member than its sender
+	ErrSenderMismatch = errors.New("sender mismatch")
+	// ErrGroupIDConflict represents that the raft group ID of the region is taken by another region
+	ErrGroupIDConflict = errors.New("raft group ID conflict")
+	// ErrCheckpointCorrupted represents that a file of a checkpoint chain is corrupted or missing
+	ErrCheckpointCorrupted = errors.New("checkpoint corrupted")
 )
 
 // ErrStableStoreDriverNotFound is T/O
@@ -30,6 +52,38 @@ func (e *ErrLogStoreDriverNotFound) Error() string {
 		e.DriverName)
 }
 
+// ErrNodeFailed represents the failure which stopped a node.
+// It matches ErrNodeStopped with errors.Is.
+type ErrNodeFailed struct {
+	Err error
+}
+
+func (e *ErrNodeFailed) Error() string {
+	return fmt.Sprintf("node failed: %v", e.Err)
+}
+
+// Unwrap returns the cause of the failure
+func (e *ErrNodeFailed) Unwrap() error {
+	return e.Err
+}
+
+// Is reports that the failed node is stopped
+func (e *ErrNodeFailed) Is(target error) bool {
+	return target == ErrNodeStopped
+}
+
+// ErrLearnerLagging represents that the learner is too far behind to be promoted
+type ErrLearnerLagging struct {
+	ID     uint64
+	Lag    uint64
+	MaxLag uint64
+}
+
+func (e *ErrLearnerLagging) Error() string {
+	return fmt.Sprintf("learner %x is %d entries behind, more than %d",
+		e.ID, e.Lag, e.MaxLag)
+}
+
 // ErrRegionAlreadyExists is T/O
 type ErrRegionAlreadyExists struct {
 	region string
@@ -47,6 +101,23 @@ func (e *ErrRegionAlreadyExists) Error() string {
 		e.region)
 }
 
+// ErrRegionReserved is T/O
+type ErrRegionReserved struct {
+	region string
+}
+
+// NewErrRegionReserved creates ErrRegionReserved
+func NewErrRegionReserved(region string) *ErrRegionReserved {
+	return &ErrRegionReserved{
+		region: region,
+	}
+}
+
+func (e *ErrRegionReserved) Error() string {
+	return fmt.Sprintf("region '%s' is reserved",
+		e.region)
+}
+
 // ErrRegionNotFound is T/O
 type ErrRegionNotFound struct {
 	region string
@@ -63,3 +134,13 @@ func (e *ErrRegionNotFound) Error() string {
 	return fmt.Sprintf("region '%s' not found",
 		e.region)
 }
+
+// ErrInvalidNodeConfig represents that a field of the node configuration is invalid
+type ErrInvalidNodeConfig struct {
+	Field  string
+	Reason string
+}
+
+func (e *ErrInvalidNodeConfig) Error() string {
+	return fmt.Sprintf("invalid node config %s: %s", e.Field, e.Reason)
+}
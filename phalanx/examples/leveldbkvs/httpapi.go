@@ -1,10 +1,11 @@
 package leveldbkvs
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
+	"time"
 
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/getumen/doctrine/phalanx"
@@ -18,9 +19,14 @@ type httpKVAPI struct {
 	confChangeC chan<- raftpb.ConfChange
 }
 
+// requestTimeout bounds a request so handlers do not pile up behind a stalled cluster
+const requestTimeout = 10 * time.Second
+
 func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	key := r.RequestURI
 	defer r.Body.Close()
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
 	switch {
 	case r.Method == "PUT":
 		v, err := ioutil.ReadAll(r.Body)
@@ -30,7 +36,7 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		h.store.Propose(&phalanxpb.Command{
+		future, err := h.store.Propose(ctx, &phalanxpb.Command{
 			Command: "PUT",
 			KeyValues: []*phalanxpb.KeyValue{
 				{
@@ -39,12 +45,22 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				},
 			},
 		})
+		if err != nil {
+			log.Printf("Failed to propose on PUT (%v)\n", err)
+			http.Error(w, "Failed on PUT", errorStatus(err))
+			return
+		}
 
-		// Optimistic-- no waiting for ack from raft. Value is not yet
-		// committed so a subsequent GET on the key may return old value
+		// wait until the value is applied
+		// so a subsequent GET on this member returns the value
+		if _, err := future.Result(ctx); err != nil {
+			log.Printf("Failed to apply on PUT (%v)\n", err)
+			http.Error(w, "Failed on PUT", errorStatus(err))
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 	case r.Method == "GET":
-		if v, err := h.store.Get([]byte(key)); err == nil {
+		if v, err := h.store.Get(ctx, []byte(key), phalanx.ReadLinearizable); err == nil {
 			w.Write([]byte(v))
 		} else {
 			http.Error(w, "Failed to GET", http.StatusNotFound)
@@ -57,37 +73,38 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		nodeID, err := strconv.ParseUint(key[1:], 0, 64)
-		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
-			http.Error(w, "Failed on POST", http.StatusBadRequest)
-			return
-		}
+		// the key is the name of the member
+		nodeID := phalanx.MemberID(key[1:])
 
 		cc := raftpb.ConfChange{
 			Type:    raftpb.ConfChangeAddNode,
 			NodeID:  nodeID,
 			Context: url,
 		}
-		h.confChangeC <- cc
+		select {
+		case h.confChangeC <- cc:
+		case <-ctx.Done():
+			http.Error(w, "Failed on "+r.Method, errorStatus(ctx.Err()))
+			return
+		}
 
-		// As above, optimistic that raft will apply the conf change
+		// Optimistic that raft will apply the conf change
 		w.WriteHeader(http.StatusNoContent)
 	case r.Method == "DELETE":
-		nodeID, err := strconv.ParseUint(key[1:], 0, 64)
-		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
-			http.Error(w, "Failed on DELETE", http.StatusBadRequest)
-			return
-		}
+		nodeID := phalanx.MemberID(key[1:])
 
 		cc := raftpb.ConfChange{
 			Type:   raftpb.ConfChangeRemoveNode,
 			NodeID: nodeID,
 		}
-		h.confChangeC <- cc
+		select {
+		case h.confChangeC <- cc:
+		case <-ctx.Done():
+			http.Error(w, "Failed on "+r.Method, errorStatus(ctx.Err()))
+			return
+		}
 
-		// As above, optimistic that raft will apply the conf change
+		// Optimistic that raft will apply the conf change
 		w.WriteHeader(http.StatusNoContent)
 	default:
 		w.Header().Set("Allow", "PUT")
@@ -97,3 +114,11 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// errorStatus returns the HTTP status code of a failed proposal
+func errorStatus(err error) int {
+	if err == phalanx.ErrProposalTimeout || err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
@@ -2,6 +2,8 @@ package leveldbkvs
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,7 +14,10 @@ import (
 	"time"
 
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal"
 	"github.com/getumen/doctrine/phalanx"
+	_ "github.com/getumen/doctrine/phalanx/logstore/stablestore"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
 	_ "github.com/getumen/doctrine/phalanx/stablestore/leveldb"
 	"golang.org/x/xerrors"
 )
@@ -21,7 +26,7 @@ const regionName = "default"
 
 type cluster struct {
 	peers        []string
-	commitC      []<-chan []byte
+	commitC      []<-chan *phalanx.Commit
 	errorC       []<-chan error
 	proposeC     []chan []byte
 	confChangeC  []chan raftpb.ConfChange
@@ -38,7 +43,7 @@ func newCluster(n int) (*cluster, error) {
 
 	clus := &cluster{
 		peers:        peers,
-		commitC:      make([]<-chan []byte, len(peers)),
+		commitC:      make([]<-chan *phalanx.Commit, len(peers)),
 		errorC:       make([]<-chan error, len(peers)),
 		proposeC:     make([]chan []byte, len(peers)),
 		confChangeC:  make([]chan raftpb.ConfChange, len(peers)),
@@ -67,7 +72,7 @@ func newCluster(n int) (*cluster, error) {
 		clus.stableStores[i].CreateRegion(regionName)
 		getSnapshot := func() ([]byte, error) { return clus.stableStores[i].CreateCheckpoint(regionName) }
 
-		clus.commitC[i], clus.errorC[i], _ = phalanx.NewNode(
+		_, clus.commitC[i], clus.errorC[i], _ = phalanx.NewNode(
 			i+1,
 			clus.peers,
 			false,
@@ -139,12 +144,16 @@ func TestProposeOnCommit(t *testing.T) {
 	donec := make(chan struct{})
 	for i := range clus.peers {
 		// feedback for "n" committed entries, then update donec
-		go func(pC chan<- []byte, cC <-chan []byte, eC <-chan error) {
+		go func(pC chan<- []byte, cC <-chan *phalanx.Commit, eC <-chan error) {
 			for n := 0; n < 100; n++ {
-				s, ok := <-cC
+				c, ok := <-cC
 				if !ok {
 					pC = nil
 				}
+				var s []byte
+				if c != nil {
+					s = c.Data
+				}
 				select {
 				case pC <- s:
 					continue
@@ -196,7 +205,12 @@ func TestCloseProposerInflight(t *testing.T) {
 	}()
 
 	// wait for one message
-	if c, ok := <-clus.commitC[0]; !bytes.Equal(c, []byte("foo")) || !ok {
+	// skip the empty entry of the leader
+	c, ok := <-clus.commitC[0]
+	for ok && c.Data == nil {
+		c, ok = <-clus.commitC[0]
+	}
+	if !ok || !bytes.Equal(c.Data, []byte("foo")) {
 		t.Fatalf("Commit failed")
 	}
 }
@@ -234,7 +248,7 @@ func TestPutAndGetKeyValue(t *testing.T) {
 	}
 	stableStore.CreateRegion(regionName)
 	getSnapshot := func() ([]byte, error) { return stableStore.CreateCheckpoint(regionName) }
-	commitC, errorC, snapshotterReady := phalanx.NewNode(
+	node, commitC, errorC, snapshotterReady := phalanx.NewNode(
 		1,
 		clusters,
 		false,
@@ -247,8 +261,8 @@ func TestPutAndGetKeyValue(t *testing.T) {
 
 	kvs := phalanx.NewDB(
 		regionName,
+		node,
 		<-snapshotterReady,
-		proposeC,
 		commitC,
 		errorC,
 		stableStore,
@@ -298,3 +312,461 @@ func TestPutAndGetKeyValue(t *testing.T) {
 		t.Fatalf("expect %s, got %s", wantValue, data)
 	}
 }
+
+func TestPutAndGetKeyValueWithLogStore(t *testing.T) {
+
+	if err := os.Mkdir("data", 0755); err != nil && !os.IsExist(err) {
+		t.Fatalf("fail to create data dir: %+v", err)
+	}
+
+	os.RemoveAll(fmt.Sprintf("data/snap-%d", 1))
+	os.RemoveAll(fmt.Sprintf("data/stableStore-%d", 1))
+
+	t.Cleanup(func() {
+		os.RemoveAll(fmt.Sprintf("data/snap-%d", 1))
+		os.RemoveAll(fmt.Sprintf("data/stableStore-%d", 1))
+	})
+
+	clusters := []string{"http://127.0.0.1:9023"}
+
+	proposeC := make(chan []byte)
+	defer close(proposeC)
+
+	confChangeC := make(chan raftpb.ConfChange)
+	defer close(confChangeC)
+
+	stableStore, err := phalanx.NewStableStore(
+		"leveldb",
+		fmt.Sprintf("data/stableStore-%d", 1),
+	)
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	stableStore.CreateRegion(regionName)
+	logStore, err := phalanx.NewLogStore("stablestore", stableStore, "raftlog")
+	if err != nil {
+		t.Fatalf("fail to create log store: %+v", err)
+	}
+	getSnapshot := func() ([]byte, error) { return stableStore.CreateCheckpoint(regionName) }
+	node, commitC, errorC, snapshotterReady := phalanx.NewNodeWithLogStore(
+		1,
+		clusters,
+		false,
+		getSnapshot,
+		proposeC,
+		confChangeC,
+		logStore,
+		fmt.Sprintf("data/snap-%d", 1),
+	)
+
+	kvs := phalanx.NewDB(
+		regionName,
+		node,
+		<-snapshotterReady,
+		commitC,
+		errorC,
+		stableStore,
+		&commandHandler{},
+	)
+
+	srv := httptest.NewServer(&httpKVAPI{
+		regionName:  regionName,
+		store:       kvs,
+		confChangeC: confChangeC,
+	})
+	defer srv.Close()
+
+	// wait server started
+	<-time.After(time.Second * 3)
+
+	wantKey, wantValue := []byte("test-key"), []byte("test-value")
+	url := fmt.Sprintf("%s/%s", srv.URL, wantKey)
+	body := bytes.NewBuffer(wantValue)
+	cli := srv.Client()
+
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for a moment for processing message, otherwise get would be failed.
+	<-time.After(time.Second)
+
+	resp, err := cli.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if !bytes.Equal(wantValue, data) {
+		t.Fatalf("expect %s, got %s", wantValue, data)
+	}
+
+	last, err := logStore.LastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == 0 {
+		t.Fatalf("raft log is not persisted in the log store")
+	}
+}
+
+func TestMembersAfterRestart(t *testing.T) {
+	const port = 9025
+	dir := fmt.Sprintf("data/members-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	stableStore, err := phalanx.NewStableStore("leveldb", dir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	stableStore.CreateRegion(regionName)
+	getSnapshot := func() ([]byte, error) { return stableStore.CreateCheckpoint(regionName) }
+
+	peers := []string{fmt.Sprintf("member-1=http://127.0.0.1:%d", port)}
+	start := func() (phalanx.Node, chan []byte, chan raftpb.ConfChange, phalanx.DB) {
+		proposeC := make(chan []byte)
+		confChangeC := make(chan raftpb.ConfChange)
+		node, commitC, errorC, snapshotterReady := phalanx.NewNode(
+			1,
+			peers,
+			false,
+			getSnapshot,
+			proposeC,
+			confChangeC,
+			dir+"/wal",
+			dir+"/snap",
+		)
+		db := phalanx.NewDB(
+			regionName,
+			node,
+			<-snapshotterReady,
+			commitC,
+			errorC,
+			stableStore,
+			&commandHandler{},
+		)
+		return node, proposeC, confChangeC, db
+	}
+
+	node, proposeC, confChangeC, db := start()
+	srv := httptest.NewServer(&httpKVAPI{
+		regionName:  regionName,
+		store:       db,
+		confChangeC: confChangeC,
+	})
+
+	// wait server started
+	<-time.After(time.Second * 3)
+
+	joinedURL := fmt.Sprintf("http://127.0.0.1:%d", port+2)
+	resp, err := srv.Client().Post(srv.URL+"/member-2", "text/plain", bytes.NewBufferString(joinedURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	hasJoined := func(members []phalanx.Member) bool {
+		for _, m := range members {
+			if m.ID == phalanx.MemberID("member-2") {
+				return len(m.URLs) == 1 && m.URLs[0] == joinedURL
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !hasJoined(node.Members()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("member-2 is not added: %+v", node.Members())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	srv.Close()
+	close(proposeC)
+	close(confChangeC)
+	// wait for the node to release WAL
+	time.Sleep(time.Second)
+
+	// the joined member is not in the static peers
+	node, proposeC, confChangeC, _ = start()
+	defer close(confChangeC)
+	defer close(proposeC)
+	if members := node.Members(); len(members) != 2 || !hasJoined(members) {
+		t.Fatalf("expect member-1 and member-2, got %+v", members)
+	}
+}
+
+func TestPromoteLearner(t *testing.T) {
+	const port = 9040
+	dir := fmt.Sprintf("data/learner-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	peers := []string{
+		fmt.Sprintf("member-1=http://127.0.0.1:%d", port),
+		fmt.Sprintf("member-2=http://127.0.0.1:%d", port+1),
+	}
+	start := func(i int, join bool) (phalanx.Node, chan raftpb.ConfChange) {
+		memberDir := fmt.Sprintf("%s/member-%d", dir, i)
+		stableStore, err := phalanx.NewStableStore("leveldb", memberDir+"/stableStore")
+		if err != nil {
+			t.Fatalf("fail to create stable store: %+v", err)
+		}
+		t.Cleanup(func() { stableStore.Close() })
+		stableStore.CreateRegion(regionName)
+		getSnapshot := func() ([]byte, error) { return stableStore.CreateCheckpoint(regionName) }
+
+		proposeC := make(chan []byte)
+		confChangeC := make(chan raftpb.ConfChange)
+		t.Cleanup(func() {
+			close(proposeC)
+			close(confChangeC)
+		})
+		node, commitC, errorC, snapshotterReady := phalanx.NewNode(
+			i,
+			peers[:i],
+			join,
+			getSnapshot,
+			proposeC,
+			confChangeC,
+			memberDir+"/wal",
+			memberDir+"/snap",
+		)
+		phalanx.NewDB(
+			regionName,
+			node,
+			<-snapshotterReady,
+			commitC,
+			errorC,
+			stableStore,
+			&commandHandler{},
+		)
+		return node, confChangeC
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	waitFor := func(cond func() bool, msg string) {
+		for !cond() {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: %+v", msg, ctx.Err())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	leader, confChangeC := start(1, false)
+	waitFor(func() bool {
+		st := leader.Status()
+		return st.Raft.Lead == st.Raft.ID
+	}, "no leader")
+
+	learnerID := phalanx.MemberID("member-2")
+	confChangeC <- raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddLearnerNode,
+		NodeID:  learnerID,
+		Context: []byte(fmt.Sprintf("http://127.0.0.1:%d", port+1)),
+	}
+	isLearner := func() bool {
+		for _, m := range leader.Members() {
+			if m.ID == learnerID {
+				return m.IsLearner
+			}
+		}
+		return false
+	}
+	waitFor(isLearner, "member-2 is not added as a learner")
+
+	// the learner has not replicated the log yet
+	var lagging *phalanx.ErrLearnerLagging
+	if err := leader.Promote(ctx, learnerID, 0); !errors.As(err, &lagging) {
+		t.Fatalf("expected ErrLearnerLagging, got %+v", err)
+	}
+
+	learner, _ := start(2, true)
+	waitFor(func() bool {
+		for _, peer := range leader.Status().Peers {
+			if peer.ID == learnerID {
+				return peer.IsLearner && peer.Lag == 0
+			}
+		}
+		return false
+	}, "learner does not catch up")
+	if err := learner.Promote(ctx, learnerID, 0); err != phalanx.ErrNotLeader {
+		t.Fatalf("expected %v, got %+v", phalanx.ErrNotLeader, err)
+	}
+
+	if err := leader.Promote(ctx, learnerID, 0); err != nil {
+		t.Fatalf("fail to promote: %+v", err)
+	}
+	if isLearner() {
+		t.Fatalf("member-2 is not promoted: %+v", leader.Members())
+	}
+}
+
+func TestNodeReportsStartFailure(t *testing.T) {
+	const dir = "data/failure"
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	stableStore, err := phalanx.NewStableStore("leveldb", dir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	stableStore.CreateRegion(regionName)
+	getSnapshot := func() ([]byte, error) { return stableStore.CreateCheckpoint(regionName) }
+
+	proposeC := make(chan []byte)
+	defer close(proposeC)
+	confChangeC := make(chan raftpb.ConfChange)
+	defer close(confChangeC)
+
+	// this member is not in the peers
+	node, commitC, errorC, snapshotterReady := phalanx.NewNode(
+		2,
+		[]string{"member-1=http://127.0.0.1:9044"},
+		false,
+		getSnapshot,
+		proposeC,
+		confChangeC,
+		dir+"/wal",
+		dir+"/snap",
+	)
+	db := phalanx.NewDB(
+		regionName,
+		node,
+		<-snapshotterReady,
+		commitC,
+		errorC,
+		stableStore,
+		&commandHandler{},
+	)
+
+	var failed *phalanx.ErrNodeFailed
+	if err := node.Err(); !errors.As(err, &failed) || !errors.Is(err, phalanx.ErrNodeStopped) {
+		t.Fatalf("expected ErrNodeFailed, got %+v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.Propose(ctx, &phalanxpb.Command{Command: "PUT"}); !errors.Is(err, phalanx.ErrNodeStopped) {
+		t.Fatalf("expected ErrNodeStopped, got %+v", err)
+	}
+}
+
+func TestNodeRestartsOnLegacyWAL(t *testing.T) {
+	const dir = "data/legacy"
+	const url = "http://127.0.0.1:10253"
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// the WAL written without the cluster identity, whose member IDs are the peer indexes
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	w, err := wal.Create(dir+"/wal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 1, Context: []byte(url)}
+	ccData, err := cc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Term: 1, Index: 1, Type: raftpb.EntryConfChange, Data: ccData}}
+	if err := w.Save(raftpb.HardState{Term: 1, Vote: 1, Commit: 1}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	stableStore, err := phalanx.NewStableStore("leveldb", dir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	stableStore.CreateRegion(regionName)
+	getSnapshot := func() ([]byte, error) { return stableStore.CreateCheckpoint(regionName) }
+
+	proposeC := make(chan []byte)
+	defer close(proposeC)
+	confChangeC := make(chan raftpb.ConfChange)
+	defer close(confChangeC)
+
+	node, commitC, errorC, snapshotterReady := phalanx.NewNode(
+		1,
+		[]string{"member-1=" + url},
+		false,
+		getSnapshot,
+		proposeC,
+		confChangeC,
+		dir+"/wal",
+		dir+"/snap",
+	)
+	db := phalanx.NewDB(
+		regionName,
+		node,
+		<-snapshotterReady,
+		commitC,
+		errorC,
+		stableStore,
+		&commandHandler{},
+	)
+
+	// the node keeps the member ID of the log
+	if id := node.ID(); id != 1 {
+		t.Fatalf("expect the legacy member ID 1, got %x", id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	future, err := db.Propose(ctx, putCommand([]byte("key"), []byte("value")))
+	if err != nil {
+		t.Fatalf("fail to propose: %+v", err)
+	}
+	if _, err := future.Result(ctx); err != nil {
+		t.Fatalf("fail to apply: %+v", err)
+	}
+}
+
+func TestStopInterruptsJoin(t *testing.T) {
+	const dir = "data/join"
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	proposeC := make(chan []byte)
+	defer close(proposeC)
+	confChangeC := make(chan raftpb.ConfChange)
+	defer close(confChangeC)
+
+	// no member tells the cluster ID to the joining node
+	node, _, _, snapshotterReady := phalanx.NewNode(
+		2,
+		[]string{"member-1=http://127.0.0.1:10254", "member-2=http://127.0.0.1:10255"},
+		true,
+		func() ([]byte, error) { return nil, nil },
+		proposeC,
+		confChangeC,
+		dir+"/wal",
+		dir+"/snap",
+	)
+	<-snapshotterReady
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := node.Stop(ctx); err != nil {
+		t.Fatalf("expect the node stops while joining, got %+v", err)
+	}
+}
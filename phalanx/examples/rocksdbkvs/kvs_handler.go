@@ -1,7 +1,7 @@
 package rocksdbkvs
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/getumen/doctrine/phalanx"
 	"github.com/getumen/doctrine/phalanx/phalanxpb"
@@ -12,11 +12,11 @@ type commandHandler struct{}
 func (c *commandHandler) Apply(
 	regionName string,
 	command *phalanxpb.Command,
+	batch phalanx.Batch,
 	stableStorage phalanx.StableStore,
-) {
+) (interface{}, error) {
 	switch command.Command {
 	case "PUT":
-		batch := stableStorage.CreateBatch()
 		for i := range command.KeyValues {
 			batch.Put(
 				regionName,
@@ -24,8 +24,8 @@ func (c *commandHandler) Apply(
 				command.KeyValues[i].Value,
 			)
 		}
-		stableStorage.Write(batch)
+		return nil, nil
 	default:
-		log.Fatalf("undefined command %s", command.Command)
+		return nil, fmt.Errorf("undefined command %s", command.Command)
 	}
 }
@@ -0,0 +1,1060 @@
+package rocksdbkvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getumen/doctrine/phalanx"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+)
+
+func newHosts(t *testing.T, n int, basePort int, regions []string) []map[string]phalanx.DB {
+	_, dbs := startHosts(t, n, basePort, regions)
+	return dbs
+}
+
+func startHosts(t *testing.T, n int, basePort int, regions []string) ([]*phalanx.Host, []map[string]phalanx.DB) {
+	if err := os.Mkdir("data", 0755); err != nil && !os.IsExist(err) {
+		t.Fatalf("fail to create data dir: %+v", err)
+	}
+
+	peers := make([]string, n)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("http://127.0.0.1:%d", basePort+i)
+	}
+
+	hosts := make([]*phalanx.Host, n)
+	dbs := make([]map[string]phalanx.DB, n)
+	for i := range hosts {
+		hostDir := fmt.Sprintf("data/host-%d", basePort+i)
+		os.RemoveAll(hostDir)
+		t.Cleanup(func() { os.RemoveAll(hostDir) })
+
+		stableStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+		if err != nil {
+			t.Fatalf("fail to create stable store: %+v", err)
+		}
+		t.Cleanup(func() { stableStore.Close() })
+
+		hosts[i] = phalanx.NewHost(
+			i+1,
+			peers,
+			false,
+			hostDir,
+			"stablestore",
+			stableStore,
+			&commandHandler{},
+		)
+		if err := hosts[i].Start(); err != nil {
+			t.Fatalf("fail to start host: %+v", err)
+		}
+		t.Cleanup(hosts[i].Stop)
+
+		dbs[i] = make(map[string]phalanx.DB)
+		for _, region := range regions {
+			dbs[i][region], err = hosts[i].AddRegion(region)
+			if err != nil {
+				t.Fatalf("fail to add region: %+v", err)
+			}
+		}
+	}
+	return hosts, dbs
+}
+
+func putCommand(key, value []byte) *phalanxpb.Command {
+	return &phalanxpb.Command{
+		Command: "PUT",
+		KeyValues: []*phalanxpb.KeyValue{
+			{
+				Key:   key,
+				Value: value,
+			},
+		},
+	}
+}
+
+func TestHostReplicatesRegionsIndependently(t *testing.T) {
+	regions := []string{"region-a", "region-b"}
+	dbs := newHosts(t, 3, 10110, regions)
+
+	for _, region := range regions {
+		go dbs[0][region].Propose(context.Background(), putCommand([]byte("key"), []byte(region)))
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for i := range dbs {
+		for _, region := range regions {
+			for {
+				v, err := dbs[i][region].Get(context.Background(), []byte("key"), phalanx.ReadStale)
+				if err == nil {
+					if !bytes.Equal(v, []byte(region)) {
+						t.Fatalf("expect %s, got %s", region, v)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("host %d region %s is not replicated: %+v", i+1, region, err)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestConsistentReadOnAllMembers(t *testing.T) {
+	const region = "region-a"
+	dbs := newHosts(t, 3, 10115, []string{region})
+
+	go dbs[0][region].Propose(context.Background(), putCommand([]byte("key"), []byte("value")))
+
+	// wait until the proposing member applies the write
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := dbs[0][region].Get(context.Background(), []byte("key"), phalanx.ReadStale); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the write is not applied")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// every member observes the write without retrying
+	for _, consistency := range []phalanx.ReadConsistency{
+		phalanx.ReadLinearizable,
+		phalanx.ReadLeaseBased,
+	} {
+		for i := range dbs {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			v, err := dbs[i][region].Get(ctx, []byte("key"), consistency)
+			cancel()
+			if err != nil {
+				t.Fatalf("host %d fails to read by %s: %+v", i+1, consistency, err)
+			}
+			if !bytes.Equal(v, []byte("value")) {
+				t.Fatalf("host %d: expect value by %s, got %s", i+1, consistency, v)
+			}
+		}
+	}
+}
+
+func TestProposeReturnsFutureResolvedOnApply(t *testing.T) {
+	const region = "region-a"
+	dbs := newHosts(t, 3, 10130, []string{region})
+
+	for i := range dbs {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		future, err := dbs[i][region].Propose(ctx, putCommand(key, []byte("value")))
+		if err != nil {
+			cancel()
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		_, err = future.Result(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("host %d fails to apply: %+v", i+1, err)
+		}
+
+		// the proposing member reads its write
+		v, err := dbs[i][region].Get(context.Background(), key, phalanx.ReadStale)
+		if err != nil {
+			t.Fatalf("host %d fails to read: %+v", i+1, err)
+		}
+		if !bytes.Equal(v, []byte("value")) {
+			t.Fatalf("host %d: expect value, got %s", i+1, v)
+		}
+	}
+
+	// the command handler fails on an unknown command
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	future, err := dbs[0][region].Propose(ctx, &phalanxpb.Command{Command: "UNKNOWN"})
+	if err != nil {
+		t.Fatalf("fail to propose: %+v", err)
+	}
+	if _, err := future.Result(ctx); err == nil {
+		t.Fatalf("expect an error of the command handler")
+	}
+}
+
+func TestProposeFailsAfterDeadline(t *testing.T) {
+	const region = "region-a"
+	dbs := newHosts(t, 3, 10150, []string{region})
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	future, err := dbs[0][region].Propose(ctx, putCommand([]byte("key"), []byte("value")))
+	if err == nil {
+		// raft accepted the proposal before the deadline is observed
+		_, err = future.Result(context.Background())
+	}
+	if err != phalanx.ErrProposalTimeout {
+		t.Fatalf("expect ErrProposalTimeout, got %+v", err)
+	}
+}
+
+// countingHandler counts the applied commands
+type countingHandler struct {
+	commandHandler
+	applied int32
+}
+
+func (c *countingHandler) Apply(
+	regionName string,
+	command *phalanxpb.Command,
+	batch phalanx.Batch,
+	stableStorage phalanx.StableStore,
+) (interface{}, error) {
+	atomic.AddInt32(&c.applied, 1)
+	return c.commandHandler.Apply(regionName, command, batch, stableStorage)
+}
+
+func TestRestartSkipsAppliedEntries(t *testing.T) {
+	const region = "region-a"
+	peers := []string{"http://127.0.0.1:10161"}
+	hostDir := "data/restart-10161"
+	os.RemoveAll(hostDir)
+	defer os.RemoveAll(hostDir)
+
+	stableStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+
+	handler := &countingHandler{}
+	propose := func(db phalanx.DB, key []byte) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		future, err := db.Propose(ctx, putCommand(key, []byte("value")))
+		if err != nil {
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		if _, err := future.Result(ctx); err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+	}
+
+	host := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, handler)
+	if err := host.Start(); err != nil {
+		t.Fatalf("fail to start host: %+v", err)
+	}
+	db, err := host.AddRegion(region)
+	if err != nil {
+		t.Fatalf("fail to add region: %+v", err)
+	}
+	propose(db, []byte("key-1"))
+	host.Stop()
+	// wait for the raft group to release WAL
+	time.Sleep(time.Second)
+
+	unstarted := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, handler)
+	for _, reserved := range []string{phalanx.SystemRegion, "raftlog-" + region} {
+		var errReserved *phalanx.ErrRegionReserved
+		if _, err := unstarted.AddRegion(reserved); !errors.As(err, &errReserved) {
+			t.Fatalf("expect region %s is reserved, got %v", reserved, err)
+		}
+	}
+	// the host which is not started is stopped without blocking
+	unstarted.Stop()
+
+	host = phalanx.NewHost(1, peers, false, hostDir, "", stableStore, handler)
+	if err := host.Start(); err != nil {
+		t.Fatalf("fail to restart host: %+v", err)
+	}
+	defer host.Stop()
+	db, err = host.AddRegion(region)
+	if err != nil {
+		t.Fatalf("fail to add region: %+v", err)
+	}
+	propose(db, []byte("key-2"))
+
+	// the entry of key-1 in WAL is not applied again
+	if applied := atomic.LoadInt32(&handler.applied); applied != 2 {
+		t.Fatalf("expect 2 applied commands, got %d", applied)
+	}
+	for _, key := range [][]byte{[]byte("key-1"), []byte("key-2")} {
+		if _, err := db.Get(context.Background(), key, phalanx.ReadStale); err != nil {
+			t.Fatalf("fail to read %s: %+v", key, err)
+		}
+	}
+}
+
+func TestRestartRefusesAnotherCluster(t *testing.T) {
+	url := "http://127.0.0.1:10163"
+	hostDir := "data/cluster-10163"
+	os.RemoveAll(hostDir)
+	defer os.RemoveAll(hostDir)
+
+	stableStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+
+	token := "cluster-a"
+	start := func(peers ...string) error {
+		host := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, &commandHandler{})
+		host.SetClusterToken(token)
+		if err := host.Start(); err != nil {
+			return err
+		}
+		host.Stop()
+		return nil
+	}
+
+	if err := start("member-1=" + url); err != nil {
+		t.Fatalf("fail to start host: %+v", err)
+	}
+	// the peers of another cluster
+	err = start("member-1="+url, "member-2=http://127.0.0.1:10165")
+	if !errors.Is(err, phalanx.ErrClusterIDMismatch) {
+		t.Fatalf("expect cluster ID mismatch, got %+v", err)
+	}
+	// a cluster bootstrapped again on the same peers
+	token = "cluster-b"
+	err = start("member-1=" + url)
+	if !errors.Is(err, phalanx.ErrClusterIDMismatch) {
+		t.Fatalf("expect cluster ID mismatch, got %+v", err)
+	}
+	token = "cluster-a"
+	// another member on the same data
+	err = start("member-2=" + url)
+	if !errors.Is(err, phalanx.ErrMemberIDMismatch) {
+		t.Fatalf("expect member ID mismatch, got %+v", err)
+	}
+	if err := start("member-1=" + url); err != nil {
+		t.Fatalf("fail to restart host: %+v", err)
+	}
+}
+
+func TestHostServesStatus(t *testing.T) {
+	const region = "region-a"
+	const basePort = 10185
+	dbs := newHosts(t, 3, basePort, []string{region})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	future, err := dbs[0][region].Propose(ctx, putCommand([]byte("key"), []byte("value")))
+	if err != nil {
+		t.Fatalf("fail to propose: %+v", err)
+	}
+	if _, err := future.Result(ctx); err != nil {
+		t.Fatalf("fail to apply: %+v", err)
+	}
+
+	type status struct {
+		Raft struct {
+			ID        string `json:"id"`
+			Lead      string `json:"lead"`
+			RaftState string `json:"raftState"`
+			Commit    uint64 `json:"commit"`
+		} `json:"raft"`
+		AppliedIndex uint64 `json:"appliedIndex"`
+		Peers        []struct {
+			ID          string    `json:"id"`
+			ActiveSince time.Time `json:"activeSince"`
+			Lag         uint64    `json:"lag"`
+		} `json:"peers"`
+	}
+	getStatus := func(i int) status {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/debug/phalanx/status", basePort+i))
+		if err != nil {
+			t.Fatalf("fail to get status: %+v", err)
+		}
+		defer resp.Body.Close()
+		var statuses map[string]status
+		if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+			t.Fatalf("fail to decode status: %+v", err)
+		}
+		st, exists := statuses[region]
+		if !exists {
+			t.Fatalf("status of %s not found in %+v", region, statuses)
+		}
+		return st
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var leaders []status
+		lead := getStatus(0).Raft.Lead
+		agreed := true
+		for i := range dbs {
+			st := getStatus(i)
+			agreed = agreed && st.Raft.Lead == lead
+			if st.Raft.RaftState == "StateLeader" {
+				leaders = append(leaders, st)
+			}
+		}
+		if agreed && len(leaders) == 1 && leaders[0].Raft.ID == lead {
+			// the followers have all the committed entries
+			caughtUp := len(leaders[0].Peers) == 2
+			for _, peer := range leaders[0].Peers {
+				caughtUp = caughtUp && peer.Lag == 0 && !peer.ActiveSince.IsZero()
+			}
+			if caughtUp && leaders[0].AppliedIndex > 0 {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected status: %+v", leaders)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestTransferLeadershipAndDrain(t *testing.T) {
+	const region = "region-a"
+	hosts, dbs := startHosts(t, 3, 10195, []string{region})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	propose := func(db phalanx.DB, key string) {
+		future, err := db.Propose(ctx, putCommand([]byte(key), []byte("value")))
+		if err != nil {
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		if _, err := future.Result(ctx); err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+	}
+	propose(dbs[0][region], "key-1")
+
+	leader := func() int {
+		for {
+			for i, host := range hosts {
+				st := host.Status()[region]
+				if st.Raft.Lead == st.Raft.ID {
+					return i
+				}
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("no leader: %+v", ctx.Err())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	from := leader()
+	to := (from + 1) % len(hosts)
+	target := hosts[to].Status()[region].Raft.ID
+	// the transfer is requested on a follower
+	other := (from + 2) % len(hosts)
+	if err := hosts[other].TransferLeadership(ctx, region, target); err != nil {
+		t.Fatalf("fail to transfer leadership: %+v", err)
+	}
+	if i := leader(); i != to {
+		t.Fatalf("expected leader %d, got %d", to, i)
+	}
+	if err := hosts[other].TransferLeadership(ctx, region, 1); !errors.Is(err, phalanx.ErrMemberNotFound) {
+		t.Fatalf("expected %v, got %+v", phalanx.ErrMemberNotFound, err)
+	}
+
+	if err := hosts[to].Drain(ctx); err != nil {
+		t.Fatalf("fail to drain: %+v", err)
+	}
+	if st := hosts[to].Status()[region]; st.Raft.Lead == st.Raft.ID {
+		t.Fatalf("leadership is not moved: %+v", st.Raft)
+	}
+	// the new leader serves proposals
+	propose(dbs[to][region], "key-2")
+}
+
+func TestFailedRegionDoesNotStopHost(t *testing.T) {
+	const port = 10201
+	hosts, dbs := startHosts(t, 1, port, []string{"region-a"})
+
+	// the snapshot directory of the region cannot be created
+	regionDir := fmt.Sprintf("data/host-%d/region-b", port)
+	if err := os.MkdirAll(regionDir, 0750); err != nil {
+		t.Fatalf("fail to create region dir: %+v", err)
+	}
+	if err := ioutil.WriteFile(regionDir+"/snap", nil, 0600); err != nil {
+		t.Fatalf("fail to create file: %+v", err)
+	}
+	if _, err := hosts[0].AddRegion("region-b"); err == nil {
+		t.Fatalf("expected failure of region-b")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	future, err := dbs[0]["region-a"].Propose(ctx, putCommand([]byte("key"), []byte("value")))
+	if err != nil {
+		t.Fatalf("fail to propose: %+v", err)
+	}
+	if _, err := future.Result(ctx); err != nil {
+		t.Fatalf("fail to apply: %+v", err)
+	}
+}
+
+func TestProposalBatchingAcksEachCommand(t *testing.T) {
+	const region = "region-a"
+	peers := []string{"http://127.0.0.1:10221"}
+	hostDir := "data/batching-10221"
+	os.RemoveAll(hostDir)
+	defer os.RemoveAll(hostDir)
+
+	stableStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+
+	host := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, &commandHandler{})
+	host.SetProposalBatching(phalanx.ProposalBatching{MaxDelay: 50 * time.Millisecond})
+	if err := host.Start(); err != nil {
+		t.Fatalf("fail to start host: %+v", err)
+	}
+	defer host.Stop()
+	db, err := host.AddRegion(region)
+	if err != nil {
+		t.Fatalf("fail to add region: %+v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for host.Status()[region].Raft.Lead == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	before := host.Status()[region].AppliedIndex
+
+	const n = 20
+	futures := make([]*phalanx.Future, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			command := putCommand([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+			if i == n/2 {
+				command.Command = "UNKNOWN"
+			}
+			var err error
+			futures[i], err = db.Propose(ctx, command)
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("fail to propose: %+v", err)
+		}
+	}
+	for i, future := range futures {
+		_, err := future.Result(ctx)
+		if i == n/2 {
+			if err == nil {
+				t.Fatalf("expect the unknown command to fail")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("fail to apply key-%d: %+v", i, err)
+		}
+		if _, err := db.Get(ctx, []byte(fmt.Sprintf("key-%d", i)), phalanx.ReadStale); err != nil {
+			t.Fatalf("fail to read key-%d: %+v", i, err)
+		}
+	}
+	if _, err := db.Get(ctx, []byte(fmt.Sprintf("key-%d", n/2)), phalanx.ReadStale); err != phalanx.ErrKeyNotFound {
+		t.Fatalf("expect the failed command is discarded, got %+v", err)
+	}
+
+	// the commands are packed into fewer entries
+	if entries := host.Status()[region].AppliedIndex - before; entries >= n {
+		t.Fatalf("expect fewer than %d entries, got %d", n, entries)
+	}
+}
+
+// countingStore counts the batches written to the StableStore
+type countingStore struct {
+	phalanx.StableStore
+	writes int32
+}
+
+func (s *countingStore) Write(batch phalanx.Batch) error {
+	atomic.AddInt32(&s.writes, 1)
+	return s.StableStore.Write(batch)
+}
+
+func (s *countingStore) WriteSync(batch phalanx.Batch) error {
+	atomic.AddInt32(&s.writes, 1)
+	return s.StableStore.WriteSync(batch)
+}
+
+func TestApplyPerReadyWritesOnceAndSurvivesRestart(t *testing.T) {
+	const region = "region-a"
+	peers := []string{"http://127.0.0.1:10223"}
+	hostDir := "data/apply-10223"
+	os.RemoveAll(hostDir)
+	defer os.RemoveAll(hostDir)
+
+	rocksdbStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer rocksdbStore.Close()
+	stableStore := &countingStore{StableStore: rocksdbStore}
+	handler := &countingHandler{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	start := func() (*phalanx.Host, phalanx.DB) {
+		host := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, handler)
+		host.SetApplyMode(phalanx.ApplyPerReady)
+		if err := host.Start(); err != nil {
+			t.Fatalf("fail to start host: %+v", err)
+		}
+		db, err := host.AddRegion(region)
+		if err != nil {
+			t.Fatalf("fail to add region: %+v", err)
+		}
+		for host.Status()[region].Raft.Lead == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return host, db
+	}
+
+	host, db := start()
+	writes := atomic.LoadInt32(&stableStore.writes)
+	before := host.Status()[region].AppliedIndex
+
+	const n = 20
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			future, err := db.Propose(ctx, putCommand([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+			if err == nil {
+				_, err = future.Result(ctx)
+			}
+			results <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+	}
+	entries := host.Status()[region].AppliedIndex - before
+	if written := atomic.LoadInt32(&stableStore.writes) - writes; uint64(written) >= entries {
+		t.Fatalf("expect fewer writes than %d entries, got %d", entries, written)
+	}
+	host.Stop()
+	// wait for the raft group to release WAL
+	time.Sleep(time.Second)
+
+	// the entries written with the applied index are not applied again
+	host, db = start()
+	defer host.Stop()
+	for i := 0; i < n; i++ {
+		if _, err := db.Get(ctx, []byte(fmt.Sprintf("key-%d", i)), phalanx.ReadStale); err != nil {
+			t.Fatalf("fail to read key-%d: %+v", i, err)
+		}
+	}
+	if applied := atomic.LoadInt32(&handler.applied); applied != n {
+		t.Fatalf("expect %d applied commands, got %d", n, applied)
+	}
+}
+
+func TestHostRefusesOversizedFrame(t *testing.T) {
+	const basePort = 10240
+	newHosts(t, 1, basePort, nil)
+	url := fmt.Sprintf("http://127.0.0.1:%d", basePort)
+
+	resp, err := http.Get(url + "/phalanx/cluster")
+	if err != nil {
+		t.Fatalf("fail to get cluster ID: %+v", err)
+	}
+	clusterID, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("fail to read cluster ID: %+v", err)
+	}
+
+	// the frame header of group 1 claims a 4GB message
+	header := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}
+	req, err := http.NewRequest("POST", url+"/multiraft", bytes.NewReader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Etcd-Cluster-ID", string(clusterID))
+	req.Header.Set("X-Server-From", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("fail to post frame: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// incrementHandler increments the counter of the region read from the StableStore
+type incrementHandler struct {
+	applied int32
+}
+
+var counterKey = []byte("counter")
+
+func (h *incrementHandler) Apply(
+	regionName string,
+	command *phalanxpb.Command,
+	batch phalanx.Batch,
+	stableStorage phalanx.StableStore,
+) (interface{}, error) {
+	atomic.AddInt32(&h.applied, 1)
+	snapshot, err := stableStorage.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+	var counter uint64
+	if value, err := snapshot.Get(regionName, counterKey); err == nil {
+		counter = binary.BigEndian.Uint64(value)
+	} else if err != phalanx.ErrKeyNotFound {
+		return nil, err
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, counter+1)
+	batch.Put(regionName, counterKey, value)
+	return counter + 1, nil
+}
+
+var errCrashed = errors.New("crashed")
+
+// crashingStore fails the n-th synced write after it is armed
+// as if the process crashed before or after the write lands
+type crashingStore struct {
+	phalanx.StableStore
+	writes  int32
+	crashAt int32 // zero until armed
+	landed  bool  // the crashed write lands
+}
+
+func (s *crashingStore) WriteSync(batch phalanx.Batch) error {
+	if atomic.AddInt32(&s.writes, 1) != atomic.LoadInt32(&s.crashAt) {
+		return s.StableStore.WriteSync(batch)
+	}
+	if s.landed {
+		if err := s.StableStore.WriteSync(batch); err != nil {
+			return err
+		}
+	}
+	return errCrashed
+}
+
+func TestRestartAfterCrashAtApplyWrite(t *testing.T) {
+	const region = "region-a"
+	for i, landed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("landed=%v", landed), func(t *testing.T) {
+			peers := []string{fmt.Sprintf("http://127.0.0.1:%d", 10241+i)}
+			hostDir := fmt.Sprintf("data/crash-%d", 10241+i)
+			os.RemoveAll(hostDir)
+			defer os.RemoveAll(hostDir)
+
+			rocksdbStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+			if err != nil {
+				t.Fatalf("fail to create stable store: %+v", err)
+			}
+			defer rocksdbStore.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			start := func(stableStore phalanx.StableStore, handler phalanx.CommandHandler) (*phalanx.Host, phalanx.DB) {
+				host := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, handler)
+				if err := host.Start(); err != nil {
+					t.Fatalf("fail to start host: %+v", err)
+				}
+				db, err := host.AddRegion(region)
+				if err != nil {
+					t.Fatalf("fail to add region: %+v", err)
+				}
+				for host.Status()[region].Raft.Lead == 0 {
+					time.Sleep(100 * time.Millisecond)
+				}
+				return host, db
+			}
+			increment := func(db phalanx.DB) (uint64, error) {
+				future, err := db.Propose(ctx, &phalanxpb.Command{Command: "INCR"})
+				if err != nil {
+					return 0, err
+				}
+				result, err := future.Result(ctx)
+				if err != nil {
+					return 0, err
+				}
+				return result.(uint64), nil
+			}
+
+			// the node is killed at the write of the third increment
+			crashing := &crashingStore{StableStore: rocksdbStore, landed: landed}
+			host, db := start(crashing, &incrementHandler{})
+			atomic.StoreInt32(&crashing.writes, 0)
+			atomic.StoreInt32(&crashing.crashAt, 3)
+			for i := 1; i <= 2; i++ {
+				if _, err := increment(db); err != nil {
+					t.Fatalf("fail to increment: %+v", err)
+				}
+			}
+			if _, err := increment(db); err == nil {
+				t.Fatalf("expect the node crashes")
+			}
+			host.Stop()
+			// wait for the raft group to release WAL
+			time.Sleep(time.Second)
+
+			// the committed increments are applied exactly once
+			handler := &incrementHandler{}
+			host, db = start(rocksdbStore, handler)
+			defer host.Stop()
+			counter, err := increment(db)
+			if err != nil {
+				t.Fatalf("fail to increment: %+v", err)
+			}
+			if counter != 4 {
+				t.Fatalf("expect counter 4, got %d", counter)
+			}
+			expected := int32(1)
+			if !landed {
+				// the crashed increment is applied again
+				expected = 2
+			}
+			if applied := atomic.LoadInt32(&handler.applied); applied != expected {
+				t.Fatalf("expect %d applied commands after restart, got %d", expected, applied)
+			}
+		})
+	}
+}
+
+// stallingStore holds the synced write after it is armed until it is released,
+// and then fails it as if the process crashed before the write
+type stallingStore struct {
+	phalanx.StableStore
+	armed   int32
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (s *stallingStore) WriteSync(batch phalanx.Batch) error {
+	if !atomic.CompareAndSwapInt32(&s.armed, 1, 0) {
+		return s.StableStore.WriteSync(batch)
+	}
+	close(s.stalled)
+	<-s.release
+	return errCrashed
+}
+
+func TestApplyPerReadyReadsEarlierEntries(t *testing.T) {
+	const region = "region-a"
+	peers := []string{"http://127.0.0.1:10252"}
+	hostDir := "data/apply-10252"
+	os.RemoveAll(hostDir)
+	defer os.RemoveAll(hostDir)
+
+	rocksdbStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer rocksdbStore.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := func(stableStore phalanx.StableStore, handler phalanx.CommandHandler) (*phalanx.Host, phalanx.DB) {
+		host := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, handler)
+		host.SetApplyMode(phalanx.ApplyPerReady)
+		if err := host.Start(); err != nil {
+			t.Fatalf("fail to start host: %+v", err)
+		}
+		db, err := host.AddRegion(region)
+		if err != nil {
+			t.Fatalf("fail to add region: %+v", err)
+		}
+		for host.Status()[region].Raft.Lead == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return host, db
+	}
+	// increment proposes n increments at once and returns their results
+	increment := func(db phalanx.DB, n int) chan interface{} {
+		results := make(chan interface{}, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				future, err := db.Propose(ctx, &phalanxpb.Command{Command: "INCR"})
+				if err != nil {
+					results <- err
+					return
+				}
+				result, err := future.Result(ctx)
+				if err != nil {
+					results <- err
+					return
+				}
+				results <- result
+			}()
+		}
+		return results
+	}
+
+	// the increments committed in a Ready read the increments before them
+	stalling := &stallingStore{
+		StableStore: rocksdbStore,
+		stalled:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	host, db := start(stalling, &incrementHandler{})
+	const n = 20
+	results := increment(db, n)
+	seen := make(map[interface{}]bool)
+	for i := 0; i < n; i++ {
+		result := <-results
+		if err, ok := result.(error); ok {
+			t.Fatalf("fail to increment: %+v", err)
+		}
+		seen[result] = true
+	}
+	for i := uint64(1); i <= n; i++ {
+		if !seen[i] {
+			t.Fatalf("expect the results 1 to %d, got %v", n, seen)
+		}
+	}
+
+	// the node crashes after more increments are committed without being written
+	const unwritten = 5
+	applied := host.Status()[region].AppliedIndex
+	atomic.StoreInt32(&stalling.armed, 1)
+	increment(db, unwritten)
+	<-stalling.stalled
+	for host.Status()[region].Raft.Commit < applied+unwritten {
+		if ctx.Err() != nil {
+			t.Fatalf("expect %d increments are committed", unwritten)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	close(stalling.release)
+	host.Stop()
+	// wait for the raft group to release WAL
+	time.Sleep(time.Second)
+
+	// the replayed increments read the increments before them as well
+	handler := &incrementHandler{}
+	host, db = start(rocksdbStore, handler)
+	defer host.Stop()
+	result := <-increment(db, 1)
+	if result != uint64(n+unwritten+1) {
+		t.Fatalf("expect counter %d, got %v", n+unwritten+1, result)
+	}
+	if applied := atomic.LoadInt32(&handler.applied); applied != unwritten+1 {
+		t.Fatalf("expect %d applied commands after restart, got %d", unwritten+1, applied)
+	}
+}
+
+// startBatchingHost starts a host of one member whose region packs the proposals
+// made within the delay into one entry
+func startBatchingHost(t *testing.T, port int, handler phalanx.CommandHandler, delay time.Duration) phalanx.DB {
+	const region = "region-a"
+	hostDir := fmt.Sprintf("data/batching-%d", port)
+	os.RemoveAll(hostDir)
+	t.Cleanup(func() { os.RemoveAll(hostDir) })
+
+	stableStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	t.Cleanup(func() { stableStore.Close() })
+
+	peers := []string{fmt.Sprintf("http://127.0.0.1:%d", port)}
+	host := phalanx.NewHost(1, peers, false, hostDir, "", stableStore, handler)
+	host.SetProposalBatching(phalanx.ProposalBatching{MaxDelay: delay})
+	if err := host.Start(); err != nil {
+		t.Fatalf("fail to start host: %+v", err)
+	}
+	t.Cleanup(host.Stop)
+	db, err := host.AddRegion(region)
+	if err != nil {
+		t.Fatalf("fail to add region: %+v", err)
+	}
+	for host.Status()[region].Raft.Lead == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return db
+}
+
+func TestProposalBatchingDropsCancelledProposal(t *testing.T) {
+	db := startBatchingHost(t, 10245, &commandHandler{}, 500*time.Millisecond)
+
+	cancelled, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := db.Propose(cancelled, putCommand([]byte("cancelled"), []byte("value")))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	future, err := db.Propose(ctx, putCommand([]byte("key"), []byte("value")))
+	if err != nil {
+		t.Fatalf("fail to propose: %+v", err)
+	}
+	if _, err := future.Result(ctx); err != nil {
+		t.Fatalf("fail to apply: %+v", err)
+	}
+	if err := <-errs; !errors.Is(err, phalanx.ErrProposalTimeout) {
+		t.Fatalf("expect %v, got %+v", phalanx.ErrProposalTimeout, err)
+	}
+	// the proposal given up by its proposer is not packed into the entry
+	if _, err := db.Get(ctx, []byte("cancelled"), phalanx.ReadStale); err != phalanx.ErrKeyNotFound {
+		t.Fatalf("expect the cancelled proposal is dropped, got %+v", err)
+	}
+}
+
+func TestProposalBatchingIncrementsInOrder(t *testing.T) {
+	db := startBatchingHost(t, 10246, &incrementHandler{}, 300*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	const n = 3
+	futures := make(chan *phalanx.Future, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			future, err := db.Propose(ctx, &phalanxpb.Command{Command: "INCREMENT"})
+			if err != nil {
+				t.Errorf("fail to propose: %+v", err)
+			}
+			futures <- future
+		}()
+	}
+	// each command packed into the entry reads the increments packed before it
+	seen := make(map[uint64]bool)
+	for i := 0; i < n; i++ {
+		future := <-futures
+		if future == nil {
+			t.FailNow()
+		}
+		result, err := future.Result(ctx)
+		if err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+		seen[result.(uint64)] = true
+	}
+	for i := uint64(1); i <= n; i++ {
+		if !seen[i] {
+			t.Fatalf("expect the results 1 to %d, got %v", n, seen)
+		}
+	}
+	value, err := db.Get(ctx, counterKey, phalanx.ReadStale)
+	if err != nil {
+		t.Fatalf("fail to read the counter: %+v", err)
+	}
+	if counter := binary.BigEndian.Uint64(value); counter != n {
+		t.Fatalf("expect counter %d, got %d", n, counter)
+	}
+}
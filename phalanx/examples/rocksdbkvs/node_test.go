@@ -0,0 +1,676 @@
+package rocksdbkvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/wal"
+	"github.com/getumen/doctrine/phalanx"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNodeConfigValidation(t *testing.T) {
+	valid := phalanx.NodeConfig{
+		ID:      1,
+		Peers:   []string{"http://127.0.0.1:10215"},
+		WALDir:  "data/config/wal",
+		SnapDir: "data/config/snap",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expect valid config, got %+v", err)
+	}
+
+	tests := []struct {
+		field  string
+		modify func(cfg *phalanx.NodeConfig)
+	}{
+		{"Peers", func(cfg *phalanx.NodeConfig) { cfg.Peers = nil }},
+		{"Peers", func(cfg *phalanx.NodeConfig) { cfg.Peers = []string{"member-1="} }},
+		{"ID", func(cfg *phalanx.NodeConfig) { cfg.ID = 2 }},
+		{"WALDir", func(cfg *phalanx.NodeConfig) { cfg.WALDir = "" }},
+		{"SnapDir", func(cfg *phalanx.NodeConfig) { cfg.SnapDir = "" }},
+		{"TickInterval", func(cfg *phalanx.NodeConfig) { cfg.TickInterval = -time.Second }},
+		{"HeartbeatTick", func(cfg *phalanx.NodeConfig) { cfg.HeartbeatTick = -1 }},
+		{"ElectionTick", func(cfg *phalanx.NodeConfig) { cfg.HeartbeatTick = 10 }},
+		{"ElectionTick", func(cfg *phalanx.NodeConfig) { cfg.ElectionTick, cfg.HeartbeatTick = 3, 3 }},
+		{"MaxInflightMsgs", func(cfg *phalanx.NodeConfig) { cfg.MaxInflightMsgs = -1 }},
+		{"ApplyQueueSize", func(cfg *phalanx.NodeConfig) { cfg.ApplyQueueSize = -1 }},
+		{"MaxSnapshots", func(cfg *phalanx.NodeConfig) { cfg.MaxSnapshots = -1 }},
+		{"PurgeInterval", func(cfg *phalanx.NodeConfig) { cfg.PurgeInterval = -time.Second }},
+		{"SnapshotCatchUpEntries", func(cfg *phalanx.NodeConfig) {
+			cfg.SnapshotCount, cfg.SnapshotCatchUpEntries = 5, 10
+		}},
+	}
+	for _, tt := range tests {
+		cfg := valid
+		tt.modify(&cfg)
+		var invalid *phalanx.ErrInvalidNodeConfig
+		_, _, _, err := phalanx.NewNodeFromConfig(cfg)
+		if !errors.As(err, &invalid) || invalid.Field != tt.field {
+			t.Errorf("expect invalid %s, got %+v", tt.field, err)
+		}
+	}
+}
+
+func TestNodeLifecycleAndSnapshotCatchUp(t *testing.T) {
+	const port = 10215
+	dir := fmt.Sprintf("data/lifecycle-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	peers := make([]string, 3)
+	stableStores := make([]phalanx.StableStore, len(peers))
+	for i := range peers {
+		peers[i] = fmt.Sprintf("http://127.0.0.1:%d", port+i)
+		var err error
+		stableStores[i], err = phalanx.NewStableStore("rocksdb", fmt.Sprintf("%s/stableStore-%d", dir, i+1))
+		if err != nil {
+			t.Fatalf("fail to create stable store: %+v", err)
+		}
+		stableStore := stableStores[i]
+		t.Cleanup(func() { stableStore.Close() })
+		stableStore.CreateRegion(regionName)
+	}
+
+	start := func(i int) (phalanx.Node, phalanx.DB) {
+		node, commitC, errorC, err := phalanx.NewNodeFromConfig(phalanx.NodeConfig{
+			ID:                     i + 1,
+			Peers:                  peers,
+			WALDir:                 fmt.Sprintf("%s/wal-%d", dir, i+1),
+			SnapDir:                fmt.Sprintf("%s/snap-%d", dir, i+1),
+			TickInterval:           50 * time.Millisecond,
+			SnapshotCount:          5,
+			SnapshotCatchUpEntries: 2,
+		})
+		if err != nil {
+			t.Fatalf("fail to create node: %+v", err)
+		}
+		if err := node.Start(); err != nil {
+			t.Fatalf("fail to start node: %+v", err)
+		}
+		t.Cleanup(func() { node.Stop(context.Background()) })
+		db := phalanx.NewDB(regionName, node, nil, commitC, errorC, stableStores[i], &commandHandler{})
+		return node, db
+	}
+
+	nodes := make([]phalanx.Node, len(peers))
+	dbs := make([]phalanx.DB, len(peers))
+	for i := range peers {
+		nodes[i], dbs[i] = start(i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	waitFor := func(cond func() bool, msg string) {
+		for !cond() {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: %+v", msg, ctx.Err())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	put := func(db phalanx.DB, key, value []byte) {
+		future, err := db.Propose(ctx, putCommand(key, value))
+		if err != nil {
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		if _, err := future.Result(ctx); err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+	}
+
+	var leader int
+	waitFor(func() bool {
+		for i, node := range nodes {
+			if st := node.Status(); st.Raft.Lead == st.Raft.ID {
+				leader = i
+				return true
+			}
+		}
+		return false
+	}, "no leader")
+	for i := 0; i < 10; i++ {
+		put(dbs[leader], []byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+	}
+
+	// stop a follower
+	follower := (leader + 1) % len(nodes)
+	if err := nodes[follower].Stop(ctx); err != nil {
+		t.Fatalf("fail to stop node: %+v", err)
+	}
+	select {
+	case <-nodes[follower].Done():
+	default:
+		t.Fatalf("node is not done after Stop")
+	}
+	if err := nodes[follower].Err(); err != nil {
+		t.Fatalf("expect no error after Stop, got %+v", err)
+	}
+	if err := nodes[follower].Propose(ctx, []byte("data")); !errors.Is(err, phalanx.ErrNodeStopped) {
+		t.Fatalf("expect ErrNodeStopped, got %+v", err)
+	}
+	if err := nodes[follower].Start(); err == nil {
+		t.Fatalf("expect the stopped node not to start again")
+	}
+	stoppedIndex := nodes[follower].Status().AppliedIndex
+
+	// the leader compacts the entries which the follower does not have
+	for i := 10; i < 30; i++ {
+		put(dbs[leader], []byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+	}
+	waitFor(func() bool {
+		return nodes[leader].Status().SnapshotIndex > stoppedIndex+2
+	}, "leader does not compact the log")
+
+	// the restarted follower catches up by the snapshot of the leader
+	nodes[follower], dbs[follower] = start(follower)
+	waitFor(func() bool {
+		return nodes[follower].Status().SnapshotIndex > stoppedIndex
+	}, "follower does not receive the snapshot")
+	value, err := dbs[follower].Get(ctx, []byte("key-29"), phalanx.ReadLinearizable)
+	if err != nil {
+		t.Fatalf("fail to read on the restarted follower: %+v", err)
+	}
+	if !bytes.Equal(value, []byte("value")) {
+		t.Fatalf("expect value, got %s", value)
+	}
+}
+
+// blockingHandler applies commands after unblock is closed
+type blockingHandler struct {
+	commandHandler
+	unblock chan struct{}
+}
+
+func (h *blockingHandler) Apply(
+	regionName string,
+	command *phalanxpb.Command,
+	batch phalanx.Batch,
+	stableStorage phalanx.StableStore,
+) (interface{}, error) {
+	<-h.unblock
+	return h.commandHandler.Apply(regionName, command, batch, stableStorage)
+}
+
+func TestApplyQueueBackpressure(t *testing.T) {
+	const port = 10225
+	dir := fmt.Sprintf("data/apply-queue-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	stableStore, err := phalanx.NewStableStore("rocksdb", dir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	stableStore.CreateRegion(regionName)
+
+	node, commitC, errorC, err := phalanx.NewNodeFromConfig(phalanx.NodeConfig{
+		ID:             1,
+		Peers:          []string{fmt.Sprintf("http://127.0.0.1:%d", port)},
+		WALDir:         dir + "/wal",
+		SnapDir:        dir + "/snap",
+		ApplyQueueSize: 1,
+	})
+	if err != nil {
+		t.Fatalf("fail to create node: %+v", err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatalf("fail to start node: %+v", err)
+	}
+	defer node.Stop(context.Background())
+	handler := &blockingHandler{unblock: make(chan struct{})}
+	db := phalanx.NewDB(regionName, node, nil, commitC, errorC, stableStore, handler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for node.Status().Raft.Lead == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// raft accepts the proposals while the handler blocks the apply path
+	var futures []*phalanx.Future
+	for {
+		key := []byte(fmt.Sprintf("key-%d", len(futures)))
+		future, err := db.Propose(ctx, putCommand(key, []byte("value")))
+		if err != nil {
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		futures = append(futures, future)
+
+		queue := node.Status().ApplyQueue
+		if queue.Waits > 0 && queue.Length == queue.Capacity {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("raft loop does not wait for the apply queue: %+v", queue)
+		}
+		// each proposal is committed in its own raft Ready
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	close(handler.unblock)
+	for i, future := range futures {
+		if _, err := future.Result(ctx); err != nil {
+			t.Fatalf("fail to apply key-%d: %+v", i, err)
+		}
+	}
+	if queue := node.Status().ApplyQueue; queue.Blocked <= 0 {
+		t.Fatalf("expect the time blocked by the apply queue, got %+v", queue)
+	}
+}
+
+func TestSnapshotInBackground(t *testing.T) {
+	const port = 10227
+	dir := fmt.Sprintf("data/snapshot-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("fail to create dir: %+v", err)
+	}
+
+	const region = "region-a"
+	stableStore, err := phalanx.NewStableStore("rocksdb", dir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	put := func(region, key string) {
+		batch := stableStore.CreateBatch()
+		batch.Put(region, []byte(key), []byte("value"))
+		if err := stableStore.Write(batch); err != nil {
+			t.Fatalf("fail to write: %+v", err)
+		}
+	}
+	for _, r := range []string{region, "restored"} {
+		if err := stableStore.CreateRegion(r); err != nil {
+			t.Fatalf("fail to create region: %+v", err)
+		}
+	}
+	put(region, "captured")
+
+	var calls int32
+	var data []byte
+	release := make(chan struct{})
+	capture := phalanx.CaptureRegion(stableStore, region)
+	node, commitC, _, err := phalanx.NewNodeFromConfig(phalanx.NodeConfig{
+		ID:      1,
+		Peers:   []string{fmt.Sprintf("http://127.0.0.1:%d", port)},
+		WALDir:  dir + "/wal",
+		SnapDir: dir + "/snap",
+		CaptureSnapshot: func() (func() ([]byte, error), error) {
+			atomic.AddInt32(&calls, 1)
+			serialize, err := capture()
+			if err != nil {
+				return nil, err
+			}
+			return func() ([]byte, error) {
+				<-release
+				data, err = serialize()
+				return data, err
+			}, nil
+		},
+		SnapshotCount:          2,
+		SnapshotCatchUpEntries: 1,
+	})
+	if err != nil {
+		t.Fatalf("fail to create node: %+v", err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatalf("fail to start node: %+v", err)
+	}
+	defer node.Stop(context.Background())
+	go func() {
+		for range commitC {
+		}
+	}()
+	// the node stops after the snapshot is created
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	waitFor := func(cond func() bool, msg string) {
+		for !cond() {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: %+v", msg, ctx.Err())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	propose := func(n int) uint64 {
+		for i := 0; i < n; i++ {
+			if err := node.Propose(ctx, []byte(fmt.Sprintf("data-%d", i))); err != nil {
+				t.Fatalf("fail to propose: %+v", err)
+			}
+		}
+		return node.Status().Raft.Commit
+	}
+
+	waitFor(func() bool { return node.Status().Raft.Lead != 0 }, "no leader")
+	// the entries are applied while the snapshot is being created
+	commit := propose(10)
+	waitFor(func() bool { return node.Status().AppliedIndex >= commit }, "entries are not applied")
+	commit = propose(10)
+	waitFor(func() bool { return node.Status().AppliedIndex >= commit }, "entries are not applied")
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Fatalf("expect one snapshot in progress, got %d", c)
+	}
+	if index := node.Status().SnapshotIndex; index != 0 {
+		t.Fatalf("expect the snapshot is not registered yet, got %d", index)
+	}
+
+	// the state written after the capture is not in the snapshot
+	put(region, "late")
+	releaseOnce.Do(func() { close(release) })
+	waitFor(func() bool { return node.Status().SnapshotIndex > 0 }, "snapshot is not registered")
+	if err := stableStore.RestoreToCheckpoint("restored", data); err != nil {
+		t.Fatalf("fail to restore snapshot: %+v", err)
+	}
+	restored, err := stableStore.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Release()
+	if _, err := restored.Get("restored", []byte("captured")); err != nil {
+		t.Fatalf("expect the captured state, got %+v", err)
+	}
+	if _, err := restored.Get("restored", []byte("late")); err != phalanx.ErrKeyNotFound {
+		t.Fatalf("expect the state after the capture is not in the snapshot, got %+v", err)
+	}
+}
+
+func TestSnapshotAndWALRetention(t *testing.T) {
+	const port = 10229
+	dir := fmt.Sprintf("data/retention-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("fail to create dir: %+v", err)
+	}
+	// small segments make the WAL cut files while the entries are proposed
+	segmentSize := wal.SegmentSizeBytes
+	wal.SegmentSizeBytes = 16 * 1024
+	defer func() { wal.SegmentSizeBytes = segmentSize }()
+
+	cfg := phalanx.NodeConfig{
+		ID:                     1,
+		Peers:                  []string{fmt.Sprintf("http://127.0.0.1:%d", port)},
+		WALDir:                 dir + "/wal",
+		SnapDir:                dir + "/snap",
+		GetSnapshot:            func() ([]byte, error) { return []byte("state"), nil },
+		SnapshotCount:          5,
+		SnapshotCatchUpEntries: 1,
+		MaxSnapshots:           2,
+		PurgeInterval:          50 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	waitFor := func(cond func() bool, msg string) {
+		for !cond() {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: %+v", msg, ctx.Err())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	startNode := func() phalanx.Node {
+		node, commitC, _, err := phalanx.NewNodeFromConfig(cfg)
+		if err != nil {
+			t.Fatalf("fail to create node: %+v", err)
+		}
+		if err := node.Start(); err != nil {
+			t.Fatalf("fail to start node: %+v", err)
+		}
+		go func() {
+			for range commitC {
+			}
+		}()
+		waitFor(func() bool { return node.Status().Raft.Lead != 0 }, "no leader")
+		return node
+	}
+	files := func(subdir, suffix string) []string {
+		names, err := filepath.Glob(filepath.Join(dir, subdir, "*"+suffix))
+		if err != nil {
+			t.Fatalf("fail to list files: %+v", err)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	node := startNode()
+	value := bytes.Repeat([]byte("v"), 1024)
+	// each entry is applied before the next one, so that snapshots are taken along the way
+	var commit uint64
+	for i := 0; i < 100; i++ {
+		if err := node.Propose(ctx, value); err != nil {
+			node.Stop(context.Background())
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		commit = node.Status().Raft.Commit
+		waitFor(func() bool { return node.Status().AppliedIndex >= commit }, "entries are not applied")
+	}
+	waitFor(func() bool { return len(files("snap", ".snap")) == 2 }, "snapshots are not purged")
+	waitFor(func() bool {
+		// the first WAL file is purged after a snapshot is taken past its end
+		wals := files("wal", ".wal")
+		return len(wals) > 0 && !strings.HasSuffix(wals[0], "0000000000000000-0000000000000000.wal")
+	}, "WAL files are not purged")
+	if err := node.Stop(ctx); err != nil {
+		t.Fatalf("fail to stop node: %+v", err)
+	}
+
+	// the node restarts from the retained snapshot and WAL files
+	node = startNode()
+	defer node.Stop(context.Background())
+	waitFor(func() bool { return node.Status().AppliedIndex >= commit }, "entries are not replayed")
+}
+
+func TestMetrics(t *testing.T) {
+	const port = 10231
+	dir := fmt.Sprintf("data/metrics-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	stableStore, err := phalanx.NewStableStore("rocksdb", dir+"/stableStore")
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	stableStore.CreateRegion(regionName)
+
+	metrics := phalanx.NewMetrics()
+	node, commitC, errorC, err := phalanx.NewNodeFromConfig(phalanx.NodeConfig{
+		ID:                     1,
+		Peers:                  []string{fmt.Sprintf("http://127.0.0.1:%d", port)},
+		WALDir:                 dir + "/wal",
+		SnapDir:                dir + "/snap",
+		SnapshotCount:          5,
+		SnapshotCatchUpEntries: 1,
+		Metrics:                metrics,
+		Region:                 regionName,
+	})
+	if err != nil {
+		t.Fatalf("fail to create node: %+v", err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatalf("fail to start node: %+v", err)
+	}
+	defer node.Stop(context.Background())
+	db := phalanx.NewDB(regionName, node, nil, commitC, errorC, stableStore, &commandHandler{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	waitFor := func(cond func() bool, msg string) {
+		for !cond() {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: %+v", msg, ctx.Err())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	waitFor(func() bool { return node.Status().Raft.Lead != 0 }, "no leader")
+	const n = 10
+	for i := 0; i < n; i++ {
+		future, err := db.Propose(ctx, putCommand([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+		if err != nil {
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		if _, err := future.Result(ctx); err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+	}
+	waitFor(func() bool { return node.Status().SnapshotIndex > 0 }, "no snapshot")
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("fail to gather metrics: %+v", err)
+	}
+	// the value of a counter or a gauge, or the sample count of a histogram
+	values := make(map[string]float64)
+	var snapshotBytes float64
+	nodeID := fmt.Sprintf("%x", node.ID())
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["region"] != regionName || labels["node_id"] != nodeID {
+				t.Errorf("expect the labels of the node, got %v", labels)
+			}
+			name := family.GetName()
+			if result, ok := labels["result"]; ok {
+				name += "/" + result
+			}
+			switch {
+			case m.Counter != nil:
+				values[name] = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				values[name] = m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				values[name] = float64(m.GetHistogram().GetSampleCount())
+			}
+			if name == "phalanx_snapshot_size_bytes" {
+				snapshotBytes = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+
+	status := node.Status()
+	tests := []struct {
+		name string
+		min  float64
+	}{
+		{"phalanx_proposals_total/applied", n},
+		{"phalanx_proposal_commit_duration_seconds", n},
+		{"phalanx_proposal_apply_duration_seconds", n},
+		{"phalanx_leader_changes_total", 1},
+		{"phalanx_term", float64(status.Raft.Term)},
+		{"phalanx_commit_index", n},
+		{"phalanx_applied_index", n},
+		{"phalanx_snapshot_index", 1},
+		{"phalanx_snapshot_duration_seconds", 1},
+		{"phalanx_snapshot_size_bytes", 1},
+		{"phalanx_wal_save_duration_seconds", n},
+		{"phalanx_stablestore_batch_write_bytes", n},
+		{"phalanx_stablestore_batch_write_duration_seconds", n},
+	}
+	for _, tt := range tests {
+		if v, ok := values[tt.name]; !ok || v < tt.min {
+			t.Errorf("expect %s >= %v, got %v", tt.name, tt.min, v)
+		}
+	}
+	// the checkpoint of the keys is reported instead of the member list in the snapshot
+	if snapshotBytes < float64(n*len("key-0value")) {
+		t.Errorf("expect the size of the checkpoint, got %v", snapshotBytes)
+	}
+}
+
+func TestStructuredLogger(t *testing.T) {
+	const port = 10233
+	dir := fmt.Sprintf("data/logger-%d", port)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	core, logs := observer.New(zap.DebugLevel)
+	logger := phalanx.NewZapLogger(zap.New(core))
+
+	stableStore, err := phalanx.NewStableStoreWithLogger("rocksdb", dir+"/stableStore", logger)
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	stableStore.CreateRegion(regionName)
+	if n := logs.FilterMessage("created region").FilterField(zap.String("region", regionName)).Len(); n != 1 {
+		t.Fatalf("expect the stable store logs the region, got %d lines", n)
+	}
+
+	node, commitC, errorC, err := phalanx.NewNodeFromConfig(phalanx.NodeConfig{
+		ID:                     1,
+		Peers:                  []string{fmt.Sprintf("http://127.0.0.1:%d", port)},
+		WALDir:                 dir + "/wal",
+		SnapDir:                dir + "/snap",
+		SnapshotCount:          5,
+		SnapshotCatchUpEntries: 1,
+		Logger:                 logger,
+		Region:                 regionName,
+	})
+	if err != nil {
+		t.Fatalf("fail to create node: %+v", err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatalf("fail to start node: %+v", err)
+	}
+	defer node.Stop(context.Background())
+	db := phalanx.NewDB(regionName, node, nil, commitC, errorC, stableStore, &commandHandler{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		future, err := db.Propose(ctx, putCommand([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+		if err != nil {
+			t.Fatalf("fail to propose: %+v", err)
+		}
+		if _, err := future.Result(ctx); err != nil {
+			t.Fatalf("fail to apply: %+v", err)
+		}
+	}
+	for node.Status().SnapshotIndex == 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("no snapshot: %+v", ctx.Err())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the log lines of the node and etcd raft carry the member ID and the region
+	nodeID := zap.String("node-id", fmt.Sprintf("%x", node.ID()))
+	region := zap.String("region", regionName)
+	if n := logs.FilterMessageSnippet("became leader").FilterField(nodeID).FilterField(region).Len(); n == 0 {
+		t.Errorf("expect raft logs with the node fields, got %v", logs.All())
+	}
+	snapshots := logs.FilterMessage("compacted log").FilterField(nodeID).FilterField(region).All()
+	if len(snapshots) == 0 {
+		t.Fatalf("expect snapshot logs with the node fields, got %v", logs.All())
+	}
+	if _, ok := snapshots[0].ContextMap()["index"]; !ok {
+		t.Errorf("expect the index field, got %v", snapshots[0].ContextMap())
+	}
+}
@@ -0,0 +1,460 @@
+package rocksdbkvs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/getumen/doctrine/phalanx"
+)
+
+// testCA issues certificates of members
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	dir    string
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	dir, err := ioutil.TempDir("", "phalanx-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "phalanx test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, dir: dir, serial: 1}
+}
+
+// issue writes the certificate of the identity and its key to the files of the name
+func (ca *testCA) issue(t *testing.T, name, identity string) (phalanx.PeerTLSInfo, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: identity},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := phalanx.PeerTLSInfo{
+		CertFile:      filepath.Join(ca.dir, name+".pem"),
+		KeyFile:       filepath.Join(ca.dir, name+"-key.pem"),
+		TrustedCAFile: filepath.Join(ca.dir, "ca.pem"),
+	}
+	writePEM(t, info.KeyFile, "EC PRIVATE KEY", keyDER)
+	writePEM(t, info.CertFile, "CERTIFICATE", der)
+	return info, cert
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peerClient returns a client which presents the certificate of the member
+func peerClient(t *testing.T, ca *testCA, info *phalanx.PeerTLSInfo) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if info != nil {
+		cert, err := tls.LoadX509KeyPair(info.CertFile, info.KeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config},
+		Timeout:   5 * time.Second,
+	}
+}
+
+// memberIdentity returns the default identity of the member in its certificate
+func memberIdentity(i int) string {
+	return fmt.Sprintf("%x", phalanx.MemberID(fmt.Sprintf("member-%d", i)))
+}
+
+func TestHostWithMutualTLS(t *testing.T) {
+	const region = "region-a"
+	const basePort = 10175
+	if err := os.Mkdir("data", 0755); err != nil && !os.IsExist(err) {
+		t.Fatalf("fail to create data dir: %+v", err)
+	}
+
+	ca := newTestCA(t)
+	peers := make([]string, 3)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("member-%d=https://127.0.0.1:%d", i+1, basePort+i)
+	}
+
+	infos := make([]phalanx.PeerTLSInfo, len(peers))
+	dbs := make([]phalanx.DB, len(peers))
+	for i := range peers {
+		infos[i], _ = ca.issue(t, fmt.Sprintf("member-%d", i+1), memberIdentity(i+1))
+
+		hostDir := fmt.Sprintf("data/host-%d", basePort+i)
+		os.RemoveAll(hostDir)
+		t.Cleanup(func() { os.RemoveAll(hostDir) })
+
+		stableStore, err := phalanx.NewStableStore("rocksdb", hostDir+"/stableStore")
+		if err != nil {
+			t.Fatalf("fail to create stable store: %+v", err)
+		}
+		t.Cleanup(func() { stableStore.Close() })
+
+		host := phalanx.NewHostWithTLS(
+			i+1, peers, false, hostDir, "stablestore", stableStore, &commandHandler{}, infos[i])
+		if err := host.Start(); err != nil {
+			t.Fatalf("fail to start host: %+v", err)
+		}
+		t.Cleanup(host.Stop)
+
+		dbs[i], err = host.AddRegion(region)
+		if err != nil {
+			t.Fatalf("fail to add region: %+v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	future, err := dbs[0].Propose(ctx, putCommand([]byte("key"), []byte("value")))
+	if err != nil {
+		t.Fatalf("fail to propose: %+v", err)
+	}
+	if _, err := future.Result(ctx); err != nil {
+		t.Fatalf("fail to apply: %+v", err)
+	}
+	for i := range dbs {
+		v, err := dbs[i].Get(ctx, []byte("key"), phalanx.ReadLinearizable)
+		if err != nil {
+			t.Fatalf("fail to read on host %d: %+v", i+1, err)
+		}
+		if !bytes.Equal(v, []byte("value")) {
+			t.Fatalf("expect value, got %s", v)
+		}
+	}
+
+	url := fmt.Sprintf("https://127.0.0.1:%d", basePort)
+	client := peerClient(t, ca, &infos[2])
+	req, err := http.NewRequest("GET", url+"/phalanx/cluster", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Server-From", memberIdentity(3))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("fail to get cluster ID: %+v", err)
+	}
+	clusterID, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("fail to get cluster ID: %s %+v", resp.Status, err)
+	}
+
+	post := func(client *http.Client, from, cluster string) (int, error) {
+		req, err := http.NewRequest("POST", url+"/multiraft", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Server-From", from)
+		req.Header.Set("X-Etcd-Cluster-ID", cluster)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// the certificate of member 3 is accepted only from member 3
+	if status, err := post(client, memberIdentity(3), string(clusterID)); err != nil || status != http.StatusNoContent {
+		t.Fatalf("expect %d, got %d %+v", http.StatusNoContent, status, err)
+	}
+	if status, err := post(client, memberIdentity(2), string(clusterID)); err != nil || status != http.StatusForbidden {
+		t.Fatalf("expect %d, got %d %+v", http.StatusForbidden, status, err)
+	}
+	// a member of another cluster is rejected
+	if status, err := post(client, memberIdentity(3), "1"); err != nil || status != http.StatusPreconditionFailed {
+		t.Fatalf("expect %d, got %d %+v", http.StatusPreconditionFailed, status, err)
+	}
+	// a client without certificate fails to handshake
+	if _, err := post(peerClient(t, ca, nil), memberIdentity(3), string(clusterID)); err == nil {
+		t.Fatal("expect handshake failure without client certificate")
+	}
+
+	// the renewed certificate is served without restart
+	_, renewed := ca.issue(t, "member-1", memberIdentity(1))
+	resp, err = peerClient(t, ca, &infos[2]).Get(url + "/multiraft")
+	if err != nil {
+		t.Fatalf("fail to connect: %+v", err)
+	}
+	resp.Body.Close()
+	served := resp.TLS.PeerCertificates[0]
+	if served.SerialNumber.Cmp(renewed.SerialNumber) != 0 {
+		t.Fatalf("expect serial %s, got %s", renewed.SerialNumber, served.SerialNumber)
+	}
+}
+
+func TestNodeWithMutualTLSRejectsImpersonation(t *testing.T) {
+	const basePort = 10239
+	dir := fmt.Sprintf("data/tls-node-%d", basePort)
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("fail to create data dir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	info, _ := ca.issue(t, "member-1", memberIdentity(1))
+	impostor, _ := ca.issue(t, "member-3", memberIdentity(3))
+
+	proposeC := make(chan []byte)
+	defer close(proposeC)
+	confChangeC := make(chan raftpb.ConfChange)
+	defer close(confChangeC)
+
+	url := fmt.Sprintf("https://127.0.0.1:%d", basePort)
+	node, commitC, _, snapshotterReady := phalanx.NewNodeWithTLS(
+		1,
+		[]string{"member-1=" + url},
+		false,
+		func() ([]byte, error) { return nil, nil },
+		proposeC,
+		confChangeC,
+		dir+"/wal",
+		dir+"/snap",
+		info,
+	)
+	<-snapshotterReady
+	go func() {
+		for range commitC {
+		}
+	}()
+	defer node.Stop(context.Background())
+
+	client := peerClient(t, ca, &impostor)
+	var clusterID string
+	for i := 0; ; i++ {
+		req, err := http.NewRequest("GET", url+"/phalanx/cluster", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Server-From", memberIdentity(3))
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			clusterID = string(b)
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if i >= 50 {
+			t.Fatalf("fail to get cluster ID: %+v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	do := func(method, path, from string, body []byte) int {
+		req, err := http.NewRequest(method, url+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != "" {
+			req.Header.Set("X-Server-From", from)
+		}
+		req.Header.Set("X-Etcd-Cluster-ID", clusterID)
+		req.Header.Set("X-Server-Version", "3.3.22")
+		req.Header.Set("X-Min-Cluster-Version", "3.0.0")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("fail to %s %s: %+v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	message := func(from string, context []byte) []byte {
+		id, err := types.IDFromString(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := raftpb.Message{Type: raftpb.MsgHeartbeatResp, From: uint64(id), To: node.ID(), Context: context}
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	snapshotMessage := func(from string) []byte {
+		b := message(from, nil)
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(len(b)))
+		return append(size, b...)
+	}
+
+	// rafthttp takes the member of a stream from the path
+	if status := do("GET", "/raft/stream/message/"+memberIdentity(2), "", nil); status != http.StatusForbidden {
+		t.Fatalf("expect %d, got %d", http.StatusForbidden, status)
+	}
+	if status := do("GET", "/raft/stream/msgappv2/"+memberIdentity(2), memberIdentity(3), nil); status != http.StatusForbidden {
+		t.Fatalf("expect %d, got %d", http.StatusForbidden, status)
+	}
+	// the message must be sent by the member of the certificate
+	if status := do("POST", "/raft", memberIdentity(3), message(memberIdentity(2), nil)); status != http.StatusForbidden {
+		t.Fatalf("expect %d, got %d", http.StatusForbidden, status)
+	}
+	if status := do("POST", "/raft/snapshot", memberIdentity(3), snapshotMessage(memberIdentity(2))); status != http.StatusForbidden {
+		t.Fatalf("expect %d, got %d", http.StatusForbidden, status)
+	}
+	if status := do("POST", "/raft", memberIdentity(3), message(memberIdentity(3), nil)); status != http.StatusNoContent {
+		t.Fatalf("expect %d, got %d", http.StatusNoContent, status)
+	}
+	// a message larger than the read buffer of rafthttp is not cut off
+	large := message(memberIdentity(3), make([]byte, 128*1024))
+	if status := do("POST", "/raft", memberIdentity(3), large); status != http.StatusNoContent {
+		t.Fatalf("expect %d, got %d", http.StatusNoContent, status)
+	}
+}
+
+func TestNodeWithMutualTLSVerifiesPeer(t *testing.T) {
+	const basePort = 10249
+	dir := fmt.Sprintf("data/tls-node-%d", basePort)
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("fail to create data dir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	info, _ := ca.issue(t, "member-1", memberIdentity(1))
+	peer, _ := ca.issue(t, "member-2", memberIdentity(2))
+	impostor, _ := ca.issue(t, "member-3", memberIdentity(3))
+	load := func(info phalanx.PeerTLSInfo) *tls.Certificate {
+		cert, err := tls.LoadX509KeyPair(info.CertFile, info.KeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &cert
+	}
+
+	// member 2 serves the certificate of member 3 until it is switched
+	var served atomic.Value
+	served.Store(load(impostor))
+	var requests int32
+	ln, err := tls.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", basePort+1), &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return served.Load().(*tls.Certificate), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("fail to listen: %+v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "not a member", http.StatusNotFound)
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	proposeC := make(chan []byte)
+	defer close(proposeC)
+	confChangeC := make(chan raftpb.ConfChange)
+	defer close(confChangeC)
+
+	node, commitC, _, snapshotterReady := phalanx.NewNodeWithTLS(
+		1,
+		[]string{
+			fmt.Sprintf("member-1=https://127.0.0.1:%d", basePort),
+			fmt.Sprintf("member-2=https://127.0.0.1:%d", basePort+1),
+		},
+		false,
+		func() ([]byte, error) { return nil, nil },
+		proposeC,
+		confChangeC,
+		dir+"/wal",
+		dir+"/snap",
+		info,
+	)
+	<-snapshotterReady
+	go func() {
+		for range commitC {
+		}
+	}()
+	defer node.Stop(context.Background())
+
+	// the node does not send requests to a member with the certificate of another member
+	time.Sleep(2 * time.Second)
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("expect no request to the impostor, got %d", n)
+	}
+
+	served.Store(load(peer))
+	for i := 0; atomic.LoadInt32(&requests) == 0; i++ {
+		if i >= 100 {
+			t.Fatal("expect requests to the member")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
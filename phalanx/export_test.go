@@ -0,0 +1,185 @@
+package phalanx
+
+import (
+	"io"
+	"time"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/pkg/wait"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+)
+
+// CheckpointTestDB exposes the checkpoint chain of a region to the tests
+type CheckpointTestDB struct {
+	db *phananxDB
+}
+
+// NewCheckpointTestDB creates a DB of the region which keeps its checkpoint chain in dir
+func NewCheckpointTestDB(stableStore StableStore, region, dir string) (*CheckpointTestDB, error) {
+	if err := createSystemRegion(stableStore); err != nil {
+		return nil, err
+	}
+	if !stableStore.HasRegion(region) {
+		if err := stableStore.CreateRegion(region); err != nil {
+			return nil, err
+		}
+	}
+	checkpoints, err := openCheckpointChain(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &CheckpointTestDB{db: &phananxDB{
+		regionName:  region,
+		stableStore: stableStore,
+		logger:      NewNopLogger(),
+		wait:        wait.New(),
+		stopc:       make(chan struct{}),
+		appliedC:    make(chan struct{}),
+		checkpoints: checkpoints,
+		dirtyKeys:   make(map[string]struct{}),
+		needBase:    true,
+	}}, nil
+}
+
+// Apply writes the changes of the entry at the index as the apply loop does
+func (c *CheckpointTestDB) Apply(index uint64, write func(batch Batch)) error {
+	c.db.pending = &pendingApply{
+		batch: newRecordingBatch(c.db.stableStore.CreateBatch(), c.db.regionName),
+		dirty: true,
+		index: index,
+		term:  1,
+	}
+	write(c.db.pending.batch)
+	return c.db.writePending()
+}
+
+// SaveCheckpoint adds a checkpoint of the applied entries to the chain
+func (c *CheckpointTestDB) SaveCheckpoint() error {
+	_, err := c.db.saveCheckpoint()
+	return err
+}
+
+// WriteCheckpoint writes the chain including the entries up to the index
+func (c *CheckpointTestDB) WriteCheckpoint(index uint64, w io.Writer) error {
+	return c.db.writeCheckpoint(index, w)
+}
+
+// RestoreFromCheckpoint restores the region from the chain and returns its index
+func (c *CheckpointTestDB) RestoreFromCheckpoint(r io.ReadSeeker) (uint64, error) {
+	index, _, err := c.db.restoreFromCheckpoint(r)
+	return index, err
+}
+
+// LastCheckpointIndex returns the index of the last checkpoint of the chain
+func (c *CheckpointTestDB) LastCheckpointIndex() uint64 {
+	return c.db.checkpoints.lastIndex()
+}
+
+// AppliedIndex returns the applied index of the region persisted in the StableStore
+func AppliedIndex(stableStore StableStore, region string) (uint64, error) {
+	index, _, err := loadAppliedIndex(stableStore, region)
+	return index, err
+}
+
+// PutMembers writes the members of the region to the batch as a conf change does
+func PutMembers(batch Batch, region string, members []Member) error {
+	return putMembers(batch, region, members)
+}
+
+// PersistedMembers returns the members of the region persisted in the StableStore
+func PersistedMembers(stableStore StableStore, region string) ([]Member, error) {
+	snapshot, err := stableStore.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+	return readMembers(snapshot, region)
+}
+
+// SetMaxCheckpointDeltas sets the number of deltas after which a new base is written
+// and returns the function which restores it
+func SetMaxCheckpointDeltas(n int) func() {
+	old := maxCheckpointDeltas
+	maxCheckpointDeltas = n
+	return func() { maxCheckpointDeltas = old }
+}
+
+// NewPendingTestStore returns the StableStore read by CommandHandler.Apply
+// when the writes to the batch are pending
+func NewPendingTestStore(stableStore StableStore, write func(batch Batch)) StableStore {
+	var batch bufferedBatch
+	write(&batch)
+	writes := make(pendingWrites)
+	writes.add(batch.ops)
+	return &pendingStore{StableStore: stableStore, writes: writes}
+}
+
+// SetGroupID replaces how the raft group ID is derived from the region name
+// and returns the function which restores it
+func SetGroupID(f func(region string) uint64) func() {
+	old := groupID
+	groupID = f
+	return func() { groupID = old }
+}
+
+// MultiTestTransport is a multiraft transport whose groups ignore the results of the sends
+type MultiTestTransport struct {
+	transport *multiTransport
+}
+
+// NewMultiTestTransport creates a multiraft transport of the member
+func NewMultiTestTransport(id uint64) *MultiTestTransport {
+	return &MultiTestTransport{transport: newMultiTransport(types.ID(id), types.ID(1), nil, NewNopLogger())}
+}
+
+// AddGroup registers the raft group which sends to the peer
+func (t *MultiTestTransport) AddGroup(groupID, peer uint64, url string) error {
+	if err := t.transport.addGroup(groupID, &phalanxNode{node: nopReportNode{}}); err != nil {
+		return err
+	}
+	t.transport.addPeer(groupID, types.ID(peer), []string{url})
+	return nil
+}
+
+// Send sends the messages of the raft group
+func (t *MultiTestTransport) Send(groupID uint64, msgs ...raftpb.Message) {
+	t.transport.send(groupID, msgs)
+}
+
+// Stop stops the transport
+func (t *MultiTestTransport) Stop() {
+	t.transport.Stop()
+}
+
+// nopReportNode ignores the results of the sends
+type nopReportNode struct {
+	raft.Node
+}
+
+func (nopReportNode) ReportUnreachable(id uint64) {}
+
+func (nopReportNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {}
+
+// AckedRequestIDs applies the proposals on the member
+// and returns the request IDs acknowledged to the proposers waiting on it
+func AckedRequestIDs(stableStore StableStore, region string, memberID uint64, handler CommandHandler, proposals ...*phalanxpb.Proposal) []uint64 {
+	db := &phananxDB{
+		regionName:    region,
+		stableStore:   stableStore,
+		commandHander: handler,
+		memberID:      memberID,
+		logger:        NewNopLogger(),
+	}
+	p := &pendingApply{
+		batch:  newRecordingBatch(stableStore.CreateBatch(), region),
+		writes: make(pendingWrites),
+	}
+	db.apply(p, proposals, time.Now())
+	ids := make([]uint64, len(p.acks))
+	for i, ack := range p.acks {
+		ids[i] = ack.id
+	}
+	return ids
+}
@@ -0,0 +1,51 @@
+package phalanx
+
+import (
+	"context"
+	"time"
+)
+
+// Future is the handle of a proposed command.
+// It is resolved when the command is applied to the local StableStore,
+// or when the proposal fails.
+type Future struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{
+		done: make(chan struct{}),
+	}
+}
+
+// Done returns a channel which is closed when the future is resolved
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result waits until the future is resolved and
+// returns the result of CommandHandler.Apply.
+// ErrLeaderChanged, ErrProposalTimeout and ErrNodeStopped
+// do not tell whether the command is applied or not.
+func (f *Future) Result(ctx context.Context) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *Future) resolve(result *applyResult) {
+	f.result, f.err = result.result, result.err
+	close(f.done)
+}
+
+// applyResult is the result of applying a command
+type applyResult struct {
+	result    interface{}
+	err       error
+	committed time.Time // when the DB received the committed entry, or zero if the proposal failed
+}
@@ -0,0 +1,83 @@
+package phalanx
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+)
+
+// leaderPollTime is the interval to check whether the leadership is transferred
+var leaderPollTime = 100 * time.Millisecond
+
+// transferLeadershipRetryTime is the interval to request the transfer again.
+// The leader aborts a transfer which does not finish in an election timeout.
+var transferLeadershipRetryTime = 2 * time.Second
+
+// TransferLeadership transfers the leadership to the member
+// and waits until this member knows the member as the leader
+func (rc *phalanxNode) TransferLeadership(ctx context.Context, target uint64) error {
+	if err := rc.waitStarted(ctx); err != nil {
+		return err
+	}
+	if !rc.membership.contains(target) {
+		return ErrMemberNotFound
+	}
+
+	poll := time.NewTicker(leaderPollTime)
+	defer poll.Stop()
+
+	var lead uint64
+	var requested time.Time
+	for {
+		status := rc.node.Status()
+		if status.Lead == target {
+			return nil
+		}
+		// the transfer is requested again when the leader changes to another member
+		if status.Lead != raft.None &&
+			(status.Lead != lead || time.Since(requested) >= transferLeadershipRetryTime) {
+			lead, requested = status.Lead, time.Now()
+			// a follower forwards the request to the leader
+			rc.node.TransferLeadership(ctx, lead, target)
+		}
+		select {
+		case <-poll.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rc.donec:
+			return ErrNodeStopped
+		}
+	}
+}
+
+// Drain transfers the leadership to the most up-to-date follower
+// if this member is the leader, and waits until it takes effect
+func (rc *phalanxNode) Drain(ctx context.Context) error {
+	if err := rc.waitStarted(ctx); err != nil {
+		return err
+	}
+	status := rc.node.Status()
+	if status.RaftState != raft.StateLeader {
+		return nil
+	}
+	target, ok := rc.transferee(status)
+	if !ok {
+		return ErrNoTransferee
+	}
+	return rc.TransferLeadership(ctx, target)
+}
+
+// transferee returns the reachable voter with the longest log except the leader
+func (rc *phalanxNode) transferee(status raft.Status) (uint64, bool) {
+	var target, match uint64
+	for id, pr := range status.Progress {
+		if id == status.ID || pr.IsLearner || !pr.RecentActive || rc.activeSince(id).IsZero() {
+			continue
+		}
+		if target == raft.None || pr.Match > match || (pr.Match == match && id < target) {
+			target, match = id, pr.Match
+		}
+	}
+	return target, target != raft.None
+}
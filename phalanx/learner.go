@@ -0,0 +1,66 @@
+package phalanx
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// Promote promotes the learner to a voter once it is within maxLag entries of the commit index
+func (rc *phalanxNode) Promote(ctx context.Context, id uint64, maxLag uint64) error {
+	if err := rc.waitStarted(ctx); err != nil {
+		return err
+	}
+	status := rc.node.Status()
+	if status.RaftState != raft.StateLeader {
+		return ErrNotLeader
+	}
+	pr, exists := status.Progress[id]
+	if !exists {
+		return ErrMemberNotFound
+	}
+	if !pr.IsLearner {
+		// the member is already a voter
+		return nil
+	}
+	if lag := progressLag(status, pr); lag > maxLag {
+		return &ErrLearnerLagging{ID: id, Lag: lag, MaxLag: maxLag}
+	}
+
+	leaderChangedC := rc.LeaderChangedNotify()
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: id}
+	if err := rc.node.ProposeConfChange(ctx, cc); err != nil {
+		if err == raft.ErrStopped {
+			return ErrNodeStopped
+		}
+		return err
+	}
+
+	poll := time.NewTicker(leaderPollTime)
+	defer poll.Stop()
+	for {
+		if pr, exists := rc.node.Status().Progress[id]; exists && !pr.IsLearner {
+			return nil
+		}
+		select {
+		case <-poll.C:
+		case <-leaderChangedC:
+			return ErrLeaderChanged
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rc.donec:
+			return ErrNodeStopped
+		}
+	}
+}
+
+// progressLag returns the number of committed entries the member does not have.
+// The progress of the members is known only on the leader.
+func progressLag(status raft.Status, pr raft.Progress) uint64 {
+	if pr.Match >= status.Commit {
+		return 0
+	}
+	return status.Commit - pr.Match
+}
@@ -0,0 +1,179 @@
+package phalanx
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft"
+	"go.uber.org/zap"
+)
+
+// Logger is a structured logger of phalanx.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	// With returns a logger which adds the fields to every log line
+	With(fields ...Field) Logger
+}
+
+// Field is a key-value pair of a log line
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// the fields of the log lines
+func nodeIDField(id uint64) Field   { return Field{Key: "node-id", Value: types.ID(id).String()} }
+func regionField(r string) Field    { return Field{Key: "region", Value: r} }
+func termField(term uint64) Field   { return Field{Key: "term", Value: term} }
+func indexField(i uint64) Field     { return Field{Key: "index", Value: i} }
+func errorField(err error) Field    { return Field{Key: "error", Value: err} }
+func peerField(id types.ID) Field   { return Field{Key: "peer", Value: id.String()} }
+func fileField(name string) Field   { return Field{Key: "file", Value: name} }
+func remoteField(addr string) Field { return Field{Key: "remote", Value: addr} }
+
+// defaultLogger is the logger of the hosts, the nodes and the stable stores without a logger
+var defaultLogger = NewStdLogger()
+
+// NewStdLogger creates a logger which writes the log lines except debug ones with the standard logger
+func NewStdLogger() Logger {
+	return &stdLogger{}
+}
+
+// stdLogger formats the fields as key=value after the message
+type stdLogger struct {
+	fields []Field
+}
+
+func (l *stdLogger) Debug(msg string, fields ...Field) {}
+
+func (l *stdLogger) Info(msg string, fields ...Field) {
+	l.print("INFO", msg, fields)
+}
+
+func (l *stdLogger) Warn(msg string, fields ...Field) {
+	l.print("WARN", msg, fields)
+}
+
+func (l *stdLogger) Error(msg string, fields ...Field) {
+	l.print("ERROR", msg, fields)
+}
+
+func (l *stdLogger) With(fields ...Field) Logger {
+	return &stdLogger{fields: appendFields(l.fields, fields)}
+}
+
+func (l *stdLogger) print(level, msg string, fields []Field) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for _, f := range appendFields(l.fields, fields) {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	log.Print(b.String())
+}
+
+// appendFields returns a new slice, so that the loggers sharing fields do not race
+func appendFields(fields, more []Field) []Field {
+	all := make([]Field, 0, len(fields)+len(more))
+	return append(append(all, fields...), more...)
+}
+
+// NewNopLogger creates a logger which discards all log lines
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields ...Field) {}
+func (nopLogger) Info(msg string, fields ...Field)  {}
+func (nopLogger) Warn(msg string, fields ...Field)  {}
+func (nopLogger) Error(msg string, fields ...Field) {}
+func (l nopLogger) With(fields ...Field) Logger     { return l }
+
+// NewZapLogger creates a logger which writes to the zap logger
+func NewZapLogger(logger *zap.Logger) Logger {
+	return &zapLogger{logger: logger}
+}
+
+type zapLogger struct {
+	logger *zap.Logger
+}
+
+func (l *zapLogger) Debug(msg string, fields ...Field) {
+	l.logger.Debug(msg, zapFields(fields)...)
+}
+
+func (l *zapLogger) Info(msg string, fields ...Field) {
+	l.logger.Info(msg, zapFields(fields)...)
+}
+
+func (l *zapLogger) Warn(msg string, fields ...Field) {
+	l.logger.Warn(msg, zapFields(fields)...)
+}
+
+func (l *zapLogger) Error(msg string, fields ...Field) {
+	l.logger.Error(msg, zapFields(fields)...)
+}
+
+func (l *zapLogger) With(fields ...Field) Logger {
+	return &zapLogger{logger: l.logger.With(zapFields(fields)...)}
+}
+
+func zapFields(fields []Field) []zap.Field {
+	zfs := make([]zap.Field, len(fields))
+	for i, f := range fields {
+		zfs[i] = zap.Any(f.Key, f.Value)
+	}
+	return zfs
+}
+
+// raftLogger writes the log of etcd raft to the logger
+type raftLogger struct {
+	logger Logger
+}
+
+func (l *raftLogger) Debug(v ...interface{}) { l.logger.Debug(fmt.Sprint(v...)) }
+func (l *raftLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, v...))
+}
+func (l *raftLogger) Info(v ...interface{}) { l.logger.Info(fmt.Sprint(v...)) }
+func (l *raftLogger) Infof(format string, v ...interface{}) {
+	l.logger.Info(fmt.Sprintf(format, v...))
+}
+func (l *raftLogger) Warning(v ...interface{}) { l.logger.Warn(fmt.Sprint(v...)) }
+func (l *raftLogger) Warningf(format string, v ...interface{}) {
+	l.logger.Warn(fmt.Sprintf(format, v...))
+}
+func (l *raftLogger) Error(v ...interface{}) { l.logger.Error(fmt.Sprint(v...)) }
+func (l *raftLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, v...))
+}
+
+// raft stops on the broken invariants, so fatal panics as well as panic
+// to run the deferred functions which flush and close the stores
+func (l *raftLogger) Fatal(v ...interface{}) {
+	l.Panic(v...)
+}
+func (l *raftLogger) Fatalf(format string, v ...interface{}) {
+	l.Panicf(format, v...)
+}
+func (l *raftLogger) Panic(v ...interface{}) {
+	msg := fmt.Sprint(v...)
+	l.logger.Error(msg)
+	panic(msg)
+}
+func (l *raftLogger) Panicf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.logger.Error(msg)
+	panic(msg)
+}
+
+var _ raft.Logger = (*raftLogger)(nil)
@@ -0,0 +1,24 @@
+package phalanx
+
+import (
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// LogStore is a persistent storage of the raft log.
+// raft reads the log through the embedded raft.Storage,
+// so implementations must be safe for concurrent use.
+type LogStore interface {
+	raft.Storage
+	// Save persists the hard state, entries and snapshot of a raft Ready
+	// and makes them visible through raft.Storage
+	// If the snapshot is not empty, it replaces the log before the entries are appended.
+	Save(st raftpb.HardState, ents []raftpb.Entry, snap raftpb.Snapshot) error
+	// CreateSnapshot makes and persists a snapshot at index i
+	// which can be retrieved with Snapshot()
+	CreateSnapshot(i uint64, cs *raftpb.ConfState, data []byte) (raftpb.Snapshot, error)
+	// Compact discards all log entries prior to compactIndex
+	Compact(compactIndex uint64) error
+	// Close closes the LogStore
+	Close() error
+}
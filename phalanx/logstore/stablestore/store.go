@@ -0,0 +1,426 @@
+package stablestore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/getumen/doctrine/phalanx"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+var (
+	hardStateKey = []byte("hardstate")
+	snapshotKey  = []byte("snapshot")
+	truncatedKey = []byte("truncated")
+	entryPrefix  = []byte("entry/")
+)
+
+// store is a LogStore which keeps the raft log in a region of StableStore.
+// Only the indices and the snapshot metadata are kept in memory.
+type store struct {
+	sync.RWMutex
+	stableStore phalanx.StableStore
+	region      string
+
+	hardState    raftpb.HardState
+	snapshotMeta raftpb.SnapshotMetadata
+	// the index and term of the entry before the first entry
+	truncatedIndex uint64
+	truncatedTerm  uint64
+	lastIndex      uint64
+}
+
+type storeDriver struct {
+}
+
+// New creates log store implemented by StableStore
+func (d *storeDriver) New(
+	stableStore phalanx.StableStore,
+	region string,
+) (phalanx.LogStore, error) {
+	if !stableStore.HasRegion(region) {
+		if err := stableStore.CreateRegion(region); err != nil {
+			return nil, xerrors.Errorf(
+				"stablestore log store: fail to create region(%s): %w",
+				region, err)
+		}
+	}
+	s := &store{
+		stableStore: stableStore,
+		region:      region,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func init() {
+	phalanx.RegisterLogStore("stablestore", &storeDriver{})
+}
+
+func (s *store) load() error {
+	snap, err := s.stableStore.GetSnapshot()
+	if err != nil {
+		return xerrors.Errorf(
+			"stablestore log store: fail to get snapshot: %w",
+			err)
+	}
+	defer snap.Release()
+
+	if v, err := snap.Get(s.region, hardStateKey); err == nil {
+		if err := s.hardState.Unmarshal(v); err != nil {
+			return xerrors.Errorf(
+				"stablestore log store: fail to unmarshal hard state: %w",
+				err)
+		}
+	} else if err != phalanx.ErrKeyNotFound {
+		return err
+	}
+
+	if v, err := snap.Get(s.region, snapshotKey); err == nil {
+		var snapshot raftpb.Snapshot
+		if err := snapshot.Unmarshal(v); err != nil {
+			return xerrors.Errorf(
+				"stablestore log store: fail to unmarshal snapshot: %w",
+				err)
+		}
+		s.snapshotMeta = snapshot.Metadata
+	} else if err != phalanx.ErrKeyNotFound {
+		return err
+	}
+
+	s.truncatedIndex = s.snapshotMeta.Index
+	s.truncatedTerm = s.snapshotMeta.Term
+	if v, err := snap.Get(s.region, truncatedKey); err == nil {
+		if len(v) != 16 {
+			return errors.Errorf(
+				"stablestore log store: invalid truncated state length %d",
+				len(v))
+		}
+		s.truncatedIndex = binary.BigEndian.Uint64(v[:8])
+		s.truncatedTerm = binary.BigEndian.Uint64(v[8:])
+	} else if err != phalanx.ErrKeyNotFound {
+		return err
+	}
+
+	s.lastIndex = s.truncatedIndex
+	iter, err := snap.NewIterator(s.region, phalanx.BytesPrefixRange(entryPrefix))
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	if iter.Last() && bytes.HasPrefix(iter.Key(), entryPrefix) {
+		s.lastIndex = entryIndex(iter.Key())
+	}
+	return iter.Error()
+}
+
+// InitialState returns the saved HardState and ConfState information.
+func (s *store) InitialState() (raftpb.HardState, raftpb.ConfState, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.hardState, s.snapshotMeta.ConfState, nil
+}
+
+// Entries returns a slice of log entries in the range [lo,hi).
+func (s *store) Entries(lo, hi, maxSize uint64) ([]raftpb.Entry, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if lo <= s.truncatedIndex {
+		return nil, raft.ErrCompacted
+	}
+	if hi > s.lastIndex+1 {
+		return nil, errors.Errorf(
+			"stablestore log store: entries' hi(%d) is out of bound lastindex(%d)",
+			hi, s.lastIndex)
+	}
+
+	snap, err := s.stableStore.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	var size uint64
+	ents := make([]raftpb.Entry, 0, hi-lo)
+	for i := lo; i < hi; i++ {
+		ent, err := s.entry(snap, i)
+		if err != nil {
+			return nil, err
+		}
+		size += uint64(ent.Size())
+		// returns at least one entry
+		if len(ents) > 0 && size > maxSize {
+			break
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// Term returns the term of entry i
+func (s *store) Term(i uint64) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.term(i)
+}
+
+func (s *store) term(i uint64) (uint64, error) {
+	if i < s.truncatedIndex {
+		return 0, raft.ErrCompacted
+	}
+	if i == s.truncatedIndex {
+		return s.truncatedTerm, nil
+	}
+	if i > s.lastIndex {
+		return 0, raft.ErrUnavailable
+	}
+	snap, err := s.stableStore.GetSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	ent, err := s.entry(snap, i)
+	if err != nil {
+		return 0, err
+	}
+	return ent.Term, nil
+}
+
+// LastIndex returns the index of the last entry in the log.
+func (s *store) LastIndex() (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.lastIndex, nil
+}
+
+// FirstIndex returns the index of the first log entry
+func (s *store) FirstIndex() (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.truncatedIndex + 1, nil
+}
+
+// Snapshot returns the most recent snapshot.
+func (s *store) Snapshot() (raftpb.Snapshot, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var snapshot raftpb.Snapshot
+	snap, err := s.stableStore.GetSnapshot()
+	if err != nil {
+		return snapshot, err
+	}
+	defer snap.Release()
+	v, err := snap.Get(s.region, snapshotKey)
+	if err == phalanx.ErrKeyNotFound {
+		return snapshot, nil
+	} else if err != nil {
+		return snapshot, err
+	}
+	err = snapshot.Unmarshal(v)
+	return snapshot, err
+}
+
+// Save persists the hard state, entries and snapshot of a raft Ready.
+// They are synced to the disk before Save returns,
+// because raft sends the messages of the Ready only after they are durable.
+func (s *store) Save(
+	st raftpb.HardState,
+	ents []raftpb.Entry,
+	snapshot raftpb.Snapshot,
+) error {
+	s.Lock()
+	defer s.Unlock()
+
+	batch := s.stableStore.CreateBatch()
+
+	if !raft.IsEmptyHardState(st) {
+		v, err := st.Marshal()
+		if err != nil {
+			return err
+		}
+		batch.Put(s.region, hardStateKey, v)
+	}
+
+	lastIndex := s.lastIndex
+	truncatedIndex, truncatedTerm := s.truncatedIndex, s.truncatedTerm
+	if !raft.IsEmptySnap(snapshot) {
+		if snapshot.Metadata.Index <= s.snapshotMeta.Index {
+			return raft.ErrSnapOutOfDate
+		}
+		v, err := snapshot.Marshal()
+		if err != nil {
+			return err
+		}
+		batch.Put(s.region, snapshotKey, v)
+		// the snapshot replaces the whole log
+		for i := truncatedIndex + 1; i <= lastIndex; i++ {
+			batch.Delete(s.region, entryKey(i))
+		}
+		truncatedIndex = snapshot.Metadata.Index
+		truncatedTerm = snapshot.Metadata.Term
+		lastIndex = truncatedIndex
+		batch.Put(s.region, truncatedKey, encodeTruncated(truncatedIndex, truncatedTerm))
+	}
+
+	// shortcut if there is no new entry.
+	for len(ents) > 0 && ents[0].Index <= truncatedIndex {
+		ents = ents[1:]
+	}
+	if len(ents) > 0 {
+		if ents[0].Index > lastIndex+1 {
+			return errors.Errorf(
+				"stablestore log store: missing log entry [last: %d, append at: %d]",
+				lastIndex, ents[0].Index)
+		}
+		newLastIndex := ents[len(ents)-1].Index
+		// truncate conflicting entries
+		for i := newLastIndex + 1; i <= lastIndex; i++ {
+			batch.Delete(s.region, entryKey(i))
+		}
+		for i := range ents {
+			v, err := ents[i].Marshal()
+			if err != nil {
+				return err
+			}
+			batch.Put(s.region, entryKey(ents[i].Index), v)
+		}
+		lastIndex = newLastIndex
+	}
+
+	if err := s.stableStore.WriteSync(batch); err != nil {
+		return xerrors.Errorf(
+			"stablestore log store: fail to write region(%s): %w",
+			s.region, err)
+	}
+
+	if !raft.IsEmptyHardState(st) {
+		s.hardState = st
+	}
+	if !raft.IsEmptySnap(snapshot) {
+		s.snapshotMeta = snapshot.Metadata
+	}
+	s.truncatedIndex, s.truncatedTerm = truncatedIndex, truncatedTerm
+	s.lastIndex = lastIndex
+	return nil
+}
+
+// CreateSnapshot makes and persists a snapshot at index i
+func (s *store) CreateSnapshot(
+	i uint64,
+	cs *raftpb.ConfState,
+	data []byte,
+) (raftpb.Snapshot, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if i <= s.snapshotMeta.Index {
+		return raftpb.Snapshot{}, raft.ErrSnapOutOfDate
+	}
+	if i > s.lastIndex {
+		return raftpb.Snapshot{}, errors.Errorf(
+			"stablestore log store: snapshot %d is out of bound lastindex(%d)",
+			i, s.lastIndex)
+	}
+	term, err := s.term(i)
+	if err != nil {
+		return raftpb.Snapshot{}, err
+	}
+
+	snapshot := raftpb.Snapshot{
+		Data: data,
+		Metadata: raftpb.SnapshotMetadata{
+			Index: i,
+			Term:  term,
+		},
+	}
+	if cs != nil {
+		snapshot.Metadata.ConfState = *cs
+	}
+	v, err := snapshot.Marshal()
+	if err != nil {
+		return raftpb.Snapshot{}, err
+	}
+	batch := s.stableStore.CreateBatch()
+	batch.Put(s.region, snapshotKey, v)
+	if err := s.stableStore.WriteSync(batch); err != nil {
+		return raftpb.Snapshot{}, xerrors.Errorf(
+			"stablestore log store: fail to write region(%s): %w",
+			s.region, err)
+	}
+	s.snapshotMeta = snapshot.Metadata
+	return snapshot, nil
+}
+
+// Compact discards all log entries prior to compactIndex
+func (s *store) Compact(compactIndex uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if compactIndex <= s.truncatedIndex {
+		return raft.ErrCompacted
+	}
+	if compactIndex > s.lastIndex {
+		return errors.Errorf(
+			"stablestore log store: compact %d is out of bound lastindex(%d)",
+			compactIndex, s.lastIndex)
+	}
+	term, err := s.term(compactIndex)
+	if err != nil {
+		return err
+	}
+
+	batch := s.stableStore.CreateBatch()
+	for i := s.truncatedIndex + 1; i <= compactIndex; i++ {
+		batch.Delete(s.region, entryKey(i))
+	}
+	batch.Put(s.region, truncatedKey, encodeTruncated(compactIndex, term))
+	if err := s.stableStore.WriteSync(batch); err != nil {
+		return xerrors.Errorf(
+			"stablestore log store: fail to write region(%s): %w",
+			s.region, err)
+	}
+	s.truncatedIndex, s.truncatedTerm = compactIndex, term
+	return nil
+}
+
+// Close closes the log store
+// The underlying StableStore is owned by the caller and is not closed.
+func (s *store) Close() error {
+	return nil
+}
+
+func (s *store) entry(snap phalanx.Snapshot, i uint64) (raftpb.Entry, error) {
+	var ent raftpb.Entry
+	v, err := snap.Get(s.region, entryKey(i))
+	if err == phalanx.ErrKeyNotFound {
+		return ent, raft.ErrUnavailable
+	} else if err != nil {
+		return ent, err
+	}
+	err = ent.Unmarshal(v)
+	return ent, err
+}
+
+func entryKey(index uint64) []byte {
+	key := make([]byte, len(entryPrefix)+8)
+	copy(key, entryPrefix)
+	binary.BigEndian.PutUint64(key[len(entryPrefix):], index)
+	return key
+}
+
+func entryIndex(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(entryPrefix):])
+}
+
+func encodeTruncated(index, term uint64) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[:8], index)
+	binary.BigEndian.PutUint64(v[8:], term)
+	return v
+}
@@ -0,0 +1,240 @@
+package stablestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/getumen/doctrine/phalanx"
+	_ "github.com/getumen/doctrine/phalanx/stablestore/leveldb"
+)
+
+const region = "raftlog"
+
+func newStableStore(t *testing.T) phalanx.StableStore {
+	tempDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	stableStore, err := phalanx.NewStableStore("leveldb", tempDir)
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	t.Cleanup(func() { stableStore.Close() })
+	return stableStore
+}
+
+func TestStore_SaveAndReopen(t *testing.T) {
+	stableStore := newStableStore(t)
+
+	target, err := phalanx.NewLogStore("stablestore", stableStore, region)
+	if err != nil {
+		t.Fatalf("fail to create log store: %+v", err)
+	}
+
+	hs := raftpb.HardState{Term: 2, Vote: 1, Commit: 3}
+	ents := []raftpb.Entry{
+		{Index: 1, Term: 1, Data: []byte("a")},
+		{Index: 2, Term: 1, Data: []byte("b")},
+		{Index: 3, Term: 2, Data: []byte("c")},
+	}
+	if err := target.Save(hs, ents, raftpb.Snapshot{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// overwrite conflicting entries
+	if err := target.Save(raftpb.HardState{}, []raftpb.Entry{
+		{Index: 2, Term: 2, Data: []byte("d")},
+	}, raftpb.Snapshot{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	reopened, err := phalanx.NewLogStore("stablestore", stableStore, region)
+	if err != nil {
+		t.Fatalf("fail to reopen log store: %+v", err)
+	}
+
+	st, _, err := reopened.InitialState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Term != hs.Term || st.Vote != hs.Vote || st.Commit != hs.Commit {
+		t.Fatalf("expected hard state %v, got %v", hs, st)
+	}
+	first, _ := reopened.FirstIndex()
+	last, _ := reopened.LastIndex()
+	if first != 1 || last != 2 {
+		t.Fatalf("expected log [1, 2], got [%d, %d]", first, last)
+	}
+	actual, err := reopened.Entries(1, 3, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 2 || string(actual[1].Data) != "d" || actual[1].Term != 2 {
+		t.Fatalf("unexpected entries %v", actual)
+	}
+	actual, err = reopened.Entries(1, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 1 {
+		t.Fatalf("expected one entry, got %d", len(actual))
+	}
+}
+
+func TestStore_SnapshotAndCompact(t *testing.T) {
+	stableStore := newStableStore(t)
+
+	target, err := phalanx.NewLogStore("stablestore", stableStore, region)
+	if err != nil {
+		t.Fatalf("fail to create log store: %+v", err)
+	}
+
+	ents := make([]raftpb.Entry, 0, 10)
+	for i := uint64(1); i <= 10; i++ {
+		ents = append(ents, raftpb.Entry{Index: i, Term: 1})
+	}
+	if err := target.Save(raftpb.HardState{Term: 1, Commit: 10}, ents, raftpb.Snapshot{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	cs := &raftpb.ConfState{Nodes: []uint64{1, 2, 3}}
+	if _, err := target.CreateSnapshot(8, cs, []byte("data")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := target.CreateSnapshot(7, cs, nil); err != raft.ErrSnapOutOfDate {
+		t.Fatalf("expected %v, got %v", raft.ErrSnapOutOfDate, err)
+	}
+	if err := target.Compact(5); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := target.Entries(5, 6, 1024); err != raft.ErrCompacted {
+		t.Fatalf("expected %v, got %v", raft.ErrCompacted, err)
+	}
+	if term, err := target.Term(5); err != nil || term != 1 {
+		t.Fatalf("expected term 1, got %d (%v)", term, err)
+	}
+
+	reopened, err := phalanx.NewLogStore("stablestore", stableStore, region)
+	if err != nil {
+		t.Fatalf("fail to reopen log store: %+v", err)
+	}
+	first, _ := reopened.FirstIndex()
+	last, _ := reopened.LastIndex()
+	if first != 6 || last != 10 {
+		t.Fatalf("expected log [6, 10], got [%d, %d]", first, last)
+	}
+	snap, err := reopened.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Metadata.Index != 8 || string(snap.Data) != "data" {
+		t.Fatalf("unexpected snapshot %v", snap)
+	}
+	_, actualCS, err := reopened.InitialState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actualCS.Nodes) != 3 {
+		t.Fatalf("unexpected conf state %v", actualCS)
+	}
+
+	// a snapshot from the leader replaces the whole log
+	if err := reopened.Save(raftpb.HardState{}, nil, raftpb.Snapshot{
+		Data:     []byte("leader"),
+		Metadata: raftpb.SnapshotMetadata{Index: 20, Term: 3, ConfState: *cs},
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	first, _ = reopened.FirstIndex()
+	last, _ = reopened.LastIndex()
+	if first != 21 || last != 20 {
+		t.Fatalf("expected empty log after 20, got [%d, %d]", first, last)
+	}
+	if term, err := reopened.Term(20); err != nil || term != 3 {
+		t.Fatalf("expected term 3, got %d (%v)", term, err)
+	}
+}
+
+func TestStore_RestartAfterSave(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	stableStore, err := phalanx.NewStableStore("leveldb", tempDir)
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	target, err := phalanx.NewLogStore("stablestore", stableStore, region)
+	if err != nil {
+		t.Fatalf("fail to create log store: %+v", err)
+	}
+
+	hs := raftpb.HardState{Term: 2, Vote: 2, Commit: 6}
+	ents := make([]raftpb.Entry, 0, 6)
+	for i := uint64(1); i <= 6; i++ {
+		ents = append(ents, raftpb.Entry{Index: i, Term: 2, Data: []byte{byte(i)}})
+	}
+	if err := target.Save(hs, ents, raftpb.Snapshot{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cs := &raftpb.ConfState{Nodes: []uint64{1, 2}}
+	if _, err := target.CreateSnapshot(4, cs, []byte("data")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := target.Compact(3); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stableStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart the stable store
+	stableStore, err = phalanx.NewStableStore("leveldb", tempDir)
+	if err != nil {
+		t.Fatalf("fail to reopen stable store: %+v", err)
+	}
+	defer stableStore.Close()
+	restarted, err := phalanx.NewLogStore("stablestore", stableStore, region)
+	if err != nil {
+		t.Fatalf("fail to reopen log store: %+v", err)
+	}
+
+	st, actualCS, err := restarted.InitialState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Term != hs.Term || st.Vote != hs.Vote || st.Commit != hs.Commit {
+		t.Fatalf("expected hard state %v, got %v", hs, st)
+	}
+	if len(actualCS.Nodes) != 2 {
+		t.Fatalf("unexpected conf state %v", actualCS)
+	}
+	first, _ := restarted.FirstIndex()
+	last, _ := restarted.LastIndex()
+	if first != 4 || last != 6 {
+		t.Fatalf("expected log [4, 6], got [%d, %d]", first, last)
+	}
+	actual, err := restarted.Entries(4, 7, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 3 || actual[2].Index != 6 || actual[2].Data[0] != 6 {
+		t.Fatalf("unexpected entries %v", actual)
+	}
+	snap, err := restarted.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Metadata.Index != 4 || string(snap.Data) != "data" {
+		t.Fatalf("unexpected snapshot %v", snap)
+	}
+}
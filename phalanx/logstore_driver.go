@@ -0,0 +1,36 @@
+package phalanx
+
+import "sync"
+
+// LogStoreDriver is driver of log store
+type LogStoreDriver interface {
+	// New creates a log store which keeps the raft log in the given region
+	New(stableStore StableStore, region string) (LogStore, error)
+}
+
+var (
+	logStoreDriverLock sync.RWMutex
+	logStoreDrivers    map[string]LogStoreDriver = make(map[string]LogStoreDriver)
+)
+
+// RegisterLogStore registers the given driver
+func RegisterLogStore(
+	driverName string,
+	driver LogStoreDriver) {
+	logStoreDriverLock.Lock()
+	defer logStoreDriverLock.Unlock()
+	if _, dup := logStoreDrivers[driverName]; dup {
+		panic("log store: Register called twice for driver " + driverName)
+	}
+	logStoreDrivers[driverName] = driver
+}
+
+// NewLogStore creates new log store
+func NewLogStore(name string, stableStore StableStore, region string) (LogStore, error) {
+	logStoreDriverLock.RLock()
+	defer logStoreDriverLock.RUnlock()
+	if driver, ok := logStoreDrivers[name]; ok {
+		return driver.New(stableStore, region)
+	}
+	return nil, &ErrLogStoreDriverNotFound{DriverName: name}
+}
@@ -0,0 +1,203 @@
+package phalanx
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+	"golang.org/x/xerrors"
+	"google.golang.org/protobuf/proto"
+)
+
+// Member is a member of the raft group
+type Member struct {
+	ID   uint64
+	URLs []string
+	// IsLearner is true if the member replicates the log without voting
+	IsLearner bool
+}
+
+// snapshotDataMagic marks the snapshot data which carries the membership.
+// The data of snapshots without it is the state machine data.
+var snapshotDataMagic = []byte("phalanx-snap\x01")
+
+// membership is the registry of the members and their peer URLs.
+// The transport connects to the registered members once it is started.
+// Changes are ordered by the raft index, so a registry restored from
+// a snapshot and from the system region ends at the later one.
+type membership struct {
+	mu        sync.Mutex
+	self      uint64
+	index     uint64 // raft index of the last change
+	members   map[uint64]Member
+	transport raftTransport // nil until the transport is started
+}
+
+func newMembership(self member, members []member) *membership {
+	m := &membership{
+		self:    self.id,
+		members: make(map[uint64]Member),
+	}
+	for _, mem := range members {
+		m.members[mem.id] = Member{ID: mem.id, URLs: []string{mem.url}}
+	}
+	return m
+}
+
+// start connects the transport to the registered members
+func (m *membership) start(transport raftTransport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transport = transport
+	for id, mem := range m.members {
+		if id != m.self {
+			transport.AddPeer(types.ID(id), mem.URLs)
+		}
+	}
+}
+
+// add registers the member added by the entry of the index.
+// A learner added again as a voter keeps its registered URLs if the entry has none.
+func (m *membership) add(index uint64, mem Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if index <= m.index {
+		return
+	}
+	m.index = index
+	registered, exists := m.members[mem.ID]
+	if exists && !registered.IsLearner && mem.IsLearner {
+		// raft does not demote a voter
+		return
+	}
+	if len(mem.URLs) == 0 {
+		if !exists {
+			return
+		}
+		mem.URLs = registered.URLs
+	}
+	m.addLocked(mem)
+}
+
+// remove unregisters the member removed by the entry of the index
+func (m *membership) remove(index, id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if index <= m.index {
+		return
+	}
+	m.index = index
+	m.removeLocked(id)
+}
+
+// restore replaces the registry with the members persisted at the index
+func (m *membership) restore(index uint64, members []Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if index <= m.index {
+		return
+	}
+	m.index = index
+	restored := make(map[uint64]struct{}, len(members))
+	for _, mem := range members {
+		restored[mem.ID] = struct{}{}
+		m.addLocked(mem)
+	}
+	for id := range m.members {
+		if _, exists := restored[id]; !exists && id != m.self {
+			m.removeLocked(id)
+		}
+	}
+}
+
+func (m *membership) addLocked(mem Member) {
+	m.members[mem.ID] = mem
+	if m.transport != nil && mem.ID != m.self {
+		m.transport.AddPeer(types.ID(mem.ID), mem.URLs)
+	}
+}
+
+func (m *membership) removeLocked(id uint64) {
+	delete(m.members, id)
+	if m.transport != nil && id != m.self {
+		m.transport.RemovePeer(types.ID(id))
+	}
+}
+
+// contains returns whether the member is registered
+func (m *membership) contains(id uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, exists := m.members[id]
+	return exists
+}
+
+// list returns the members in the order of their IDs
+func (m *membership) list() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		mem.URLs = append([]string{}, mem.URLs...)
+		members = append(members, mem)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+func marshalMembers(members []Member) ([]byte, error) {
+	return proto.Marshal(membersToProto(members))
+}
+
+func unmarshalMembers(data []byte) ([]Member, error) {
+	var pb phalanxpb.Membership
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return nil, xerrors.Errorf("phalanx: invalid membership: %w", err)
+	}
+	return membersFromProto(&pb), nil
+}
+
+func membersToProto(members []Member) *phalanxpb.Membership {
+	pb := &phalanxpb.Membership{}
+	for _, m := range members {
+		pb.Members = append(pb.Members, &phalanxpb.Member{Id: m.ID, Urls: m.URLs, IsLearner: m.IsLearner})
+	}
+	return pb
+}
+
+func membersFromProto(pb *phalanxpb.Membership) []Member {
+	members := make([]Member, 0, len(pb.GetMembers()))
+	for _, m := range pb.GetMembers() {
+		members = append(members, Member{ID: m.GetId(), URLs: m.GetUrls(), IsLearner: m.GetIsLearner()})
+	}
+	return members
+}
+
+// encodeSnapshotData returns the snapshot data which carries the membership
+func encodeSnapshotData(members []Member, data []byte) ([]byte, error) {
+	encoded, err := proto.Marshal(&phalanxpb.SnapshotData{
+		Membership: membersToProto(members),
+		Data:       data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, snapshotDataMagic...), encoded...), nil
+}
+
+// decodeSnapshotData returns the membership and the state machine data of the snapshot.
+// The membership is nil if the snapshot does not carry it.
+func decodeSnapshotData(data []byte) ([]Member, []byte, error) {
+	if !bytes.HasPrefix(data, snapshotDataMagic) {
+		return nil, data, nil
+	}
+	var pb phalanxpb.SnapshotData
+	if err := proto.Unmarshal(data[len(snapshotDataMagic):], &pb); err != nil {
+		return nil, nil, xerrors.Errorf("phalanx: invalid snapshot data: %w", err)
+	}
+	return membersFromProto(pb.GetMembership()), pb.GetData(), nil
+}
@@ -0,0 +1,263 @@
+package phalanx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "phalanx"
+
+// metricsLabels are the labels of all metrics of a node
+var metricsLabels = []string{"region", "node_id"}
+
+// Metrics is a prometheus collector of the nodes and the DBs reporting to it.
+// It is registered by the caller, e.g. prometheus.MustRegister(metrics).
+type Metrics struct {
+	proposals             *prometheus.CounterVec
+	proposalCommitSeconds *prometheus.HistogramVec
+	proposalApplySeconds  *prometheus.HistogramVec
+	leaderChanges         *prometheus.CounterVec
+	snapshotSeconds       *prometheus.HistogramVec
+	snapshotBytes         *prometheus.HistogramVec
+	walSaveSeconds        *prometheus.HistogramVec
+	peerSendFailures      *prometheus.CounterVec
+	batchWriteBytes       *prometheus.HistogramVec
+	batchWriteSeconds     *prometheus.HistogramVec
+
+	// the indices are read from the status of the nodes when collected
+	commitIndex      *prometheus.Desc
+	appliedIndex     *prometheus.Desc
+	snapshotIndex    *prometheus.Desc
+	term             *prometheus.Desc
+	applyQueueLength *prometheus.Desc
+
+	mu    sync.Mutex
+	nodes map[*phalanxNode][]string // label values of the running nodes
+}
+
+// NewMetrics creates new metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		proposals: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "proposals_total",
+			Help:      "The number of proposed commands by the result.",
+		}, append(metricsLabels, "result")),
+		proposalCommitSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "proposal_commit_duration_seconds",
+			Help:      "The latency from proposing a command to receiving its committed entry.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, metricsLabels),
+		proposalApplySeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "proposal_apply_duration_seconds",
+			Help:      "The latency from receiving the committed entry of a command to applying it.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, metricsLabels),
+		leaderChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "leader_changes_total",
+			Help:      "The number of leader changes seen by the node.",
+		}, metricsLabels),
+		snapshotSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "snapshot_duration_seconds",
+			Help:      "The latency of creating a snapshot.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, metricsLabels),
+		snapshotBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "snapshot_size_bytes",
+			Help:      "The size of the snapshot data or the checkpoint written for a created snapshot.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 12),
+		}, metricsLabels),
+		walSaveSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "wal_save_duration_seconds",
+			Help:      "The latency of saving a raft Ready to WAL including its fsync. Only WAL log stores report it.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, metricsLabels),
+		peerSendFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "peer_send_failures_total",
+			Help:      "The number of raft messages and snapshots failed to be sent to a peer.",
+		}, append(metricsLabels, "to")),
+		batchWriteBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stablestore_batch_write_bytes",
+			Help:      "The size of the keys and values written by the commands in a batch to the StableStore.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+		}, metricsLabels),
+		batchWriteSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stablestore_batch_write_duration_seconds",
+			Help:      "The latency of writing a batch to the StableStore.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, metricsLabels),
+
+		commitIndex: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "commit_index"),
+			"The commit index of the raft log.", metricsLabels, nil),
+		appliedIndex: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "applied_index"),
+			"The index of the last applied entry.", metricsLabels, nil),
+		snapshotIndex: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "snapshot_index"),
+			"The index of the last snapshot.", metricsLabels, nil),
+		term: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "term"),
+			"The current raft term.", metricsLabels, nil),
+		applyQueueLength: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "apply_queue_length"),
+			"The number of raft Readys waiting to be applied.", metricsLabels, nil),
+
+		nodes: make(map[*phalanxNode][]string),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.proposals,
+		m.proposalCommitSeconds,
+		m.proposalApplySeconds,
+		m.leaderChanges,
+		m.snapshotSeconds,
+		m.snapshotBytes,
+		m.walSaveSeconds,
+		m.peerSendFailures,
+		m.batchWriteBytes,
+		m.batchWriteSeconds,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+	ch <- m.commitIndex
+	ch <- m.appliedIndex
+	ch <- m.snapshotIndex
+	ch <- m.term
+	ch <- m.applyQueueLength
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+
+	m.mu.Lock()
+	nodes := make(map[*phalanxNode][]string, len(m.nodes))
+	for rc, labels := range m.nodes {
+		select {
+		case <-rc.donec:
+			// the stopped node is not reported any more
+			delete(m.nodes, rc)
+		default:
+			nodes[rc] = labels
+		}
+	}
+	m.mu.Unlock()
+
+	for rc, labels := range nodes {
+		st := rc.Status()
+		gauge := func(desc *prometheus.Desc, v uint64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v), labels...)
+		}
+		gauge(m.commitIndex, st.Raft.Commit)
+		gauge(m.appliedIndex, st.AppliedIndex)
+		gauge(m.snapshotIndex, st.SnapshotIndex)
+		gauge(m.term, st.Raft.Term)
+		gauge(m.applyQueueLength, uint64(st.ApplyQueue.Length))
+	}
+}
+
+// forNode returns the metrics of the node labeled by the region,
+// or nil if m is nil
+func (m *Metrics) forNode(rc *phalanxNode, region string) *nodeMetrics {
+	if m == nil {
+		return nil
+	}
+	labels := []string{region, types.ID(rc.self.id).String()}
+	m.mu.Lock()
+	m.nodes[rc] = labels
+	m.mu.Unlock()
+	return &nodeMetrics{Metrics: m, labels: labels}
+}
+
+// nodeMetrics reports the metrics of a node and its DB.
+// All methods do nothing on nil.
+type nodeMetrics struct {
+	*Metrics
+	labels []string
+}
+
+// setMemberID labels the metrics of the node by the member ID
+func (m *nodeMetrics) setMemberID(id uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.labels[1] = types.ID(id).String()
+}
+
+func (m *nodeMetrics) observeProposal(proposed, committed time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := "applied"
+	if err != nil {
+		result = "failed"
+	}
+	m.proposals.WithLabelValues(append(m.labels, result)...).Inc()
+	if committed.IsZero() {
+		// the proposal failed before it was committed
+		return
+	}
+	m.proposalCommitSeconds.WithLabelValues(m.labels...).Observe(committed.Sub(proposed).Seconds())
+	m.proposalApplySeconds.WithLabelValues(m.labels...).Observe(time.Since(committed).Seconds())
+}
+
+func (m *nodeMetrics) leaderChanged() {
+	if m == nil {
+		return
+	}
+	m.leaderChanges.WithLabelValues(m.labels...).Inc()
+}
+
+func (m *nodeMetrics) observeSnapshot(start time.Time, size int64) {
+	if m == nil {
+		return
+	}
+	m.snapshotSeconds.WithLabelValues(m.labels...).Observe(time.Since(start).Seconds())
+	m.snapshotBytes.WithLabelValues(m.labels...).Observe(float64(size))
+}
+
+func (m *nodeMetrics) observeWALSave(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.walSaveSeconds.WithLabelValues(m.labels...).Observe(time.Since(start).Seconds())
+}
+
+func (m *nodeMetrics) peerSendFailed(to uint64) {
+	if m == nil {
+		return
+	}
+	m.peerSendFailures.WithLabelValues(append(m.labels, types.ID(to).String())...).Inc()
+}
+
+func (m *nodeMetrics) observeBatchWrite(start time.Time, size int) {
+	if m == nil {
+		return
+	}
+	m.batchWriteSeconds.WithLabelValues(m.labels...).Observe(time.Since(start).Seconds())
+	m.batchWriteBytes.WithLabelValues(m.labels...).Observe(float64(size))
+}
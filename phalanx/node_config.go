@@ -0,0 +1,218 @@
+package phalanx
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// defaults of the raft timing and the snapshot thresholds
+const (
+	defaultTickInterval    = 100 * time.Millisecond
+	defaultElectionTick    = 10
+	defaultHeartbeatTick   = 1
+	defaultMaxSizePerMsg   = 1024 * 1024
+	defaultMaxInflightMsgs = 256
+	defaultApplyQueueSize  = 64
+)
+
+// NodeConfig is the configuration of a node created by NewNodeFromConfig.
+// Zero values of the raft timing, the snapshot thresholds, the apply queue and the file retention
+// are replaced with the defaults.
+type NodeConfig struct {
+	ID    int      // index of this member in Peers, starting from 1
+	Peers []string // raft peers given as name=URL or URL
+	Join  bool     // node is joining an existing cluster
+	// ClusterToken is mixed into the cluster ID when the node bootstraps a cluster.
+	// All bootstrapping members must use the same token,
+	// and a cluster bootstrapped again on the same peers must use another one.
+	ClusterToken string
+
+	WALDir   string   // path to WAL directory, unused if LogStore is set
+	LogStore LogStore // keeps the raft log instead of WAL if set
+	SnapDir  string   // path to snapshot directory
+
+	// GetSnapshot returns the data of a snapshot.
+	// It is called in the raft loop, so that the data is the state at the index of the snapshot.
+	// It is unused once the node is passed to NewDB, which streams checkpoints instead.
+	GetSnapshot func() ([]byte, error)
+	// CaptureSnapshot captures the state in the raft loop and returns the function
+	// which serializes the captured state in background.
+	// It is used instead of GetSnapshot if set, and CaptureRegion captures a region of a StableStore.
+	CaptureSnapshot func() (func() ([]byte, error), error)
+	// PeerTLS makes peers communicate over mutual TLS if set.
+	// The peer URLs must be https.
+	PeerTLS *PeerTLSInfo
+	// Metrics collects the metrics of the node and its DB if set.
+	// The metrics are labeled by Region and the member ID.
+	Metrics *Metrics
+	// Logger is the logger of the node and etcd raft, or the standard logger if nil.
+	// The log lines carry Region and the member ID.
+	Logger Logger
+	// Region is the label of the metrics and the log lines of the node
+	Region string
+
+	// TickInterval is the interval of a raft tick
+	TickInterval time.Duration
+	// ElectionTick is the number of ticks without a heartbeat before a follower campaigns.
+	// It must be greater than HeartbeatTick.
+	ElectionTick int
+	// HeartbeatTick is the number of ticks between heartbeats of the leader
+	HeartbeatTick int
+	// MaxSizePerMsg is the max byte size of the entries in an append message
+	MaxSizePerMsg uint64
+	// MaxInflightMsgs is the max number of append messages in flight to a follower
+	MaxInflightMsgs int
+
+	// SnapshotCount is the number of applied entries which triggers a snapshot
+	SnapshotCount uint64
+	// SnapshotCatchUpEntries is the number of entries kept in the log after a snapshot,
+	// so that a slow follower catches up without receiving the snapshot.
+	// It must not be greater than SnapshotCount.
+	SnapshotCatchUpEntries uint64
+
+	// ApplyQueueSize is the max number of raft Readys waiting to be applied.
+	// The raft loop waits for the apply path when the queue is full.
+	ApplyQueueSize int
+
+	// MaxSnapshots is the number of snapshot files kept in SnapDir.
+	// The WAL files older than the oldest kept snapshot are purged.
+	MaxSnapshots int
+	// PurgeInterval is the interval of purging the snapshot and WAL files
+	PurgeInterval time.Duration
+}
+
+// withDefaults returns the configuration whose zero values are replaced with the defaults
+func (cfg NodeConfig) withDefaults() NodeConfig {
+	if cfg.TickInterval == 0 {
+		cfg.TickInterval = defaultTickInterval
+	}
+	if cfg.ElectionTick == 0 {
+		cfg.ElectionTick = defaultElectionTick
+	}
+	if cfg.HeartbeatTick == 0 {
+		cfg.HeartbeatTick = defaultHeartbeatTick
+	}
+	if cfg.MaxSizePerMsg == 0 {
+		cfg.MaxSizePerMsg = defaultMaxSizePerMsg
+	}
+	if cfg.MaxInflightMsgs == 0 {
+		cfg.MaxInflightMsgs = defaultMaxInflightMsgs
+	}
+	if cfg.ApplyQueueSize == 0 {
+		cfg.ApplyQueueSize = defaultApplyQueueSize
+	}
+	if cfg.MaxSnapshots == 0 {
+		cfg.MaxSnapshots = defaultMaxSnapshots
+	}
+	if cfg.PurgeInterval == 0 {
+		cfg.PurgeInterval = defaultPurgeInterval
+	}
+	if cfg.SnapshotCount == 0 {
+		cfg.SnapshotCount = defaultSnapshotCount
+	}
+	if cfg.SnapshotCatchUpEntries == 0 {
+		cfg.SnapshotCatchUpEntries = snapshotCatchUpEntriesN
+		if cfg.SnapshotCatchUpEntries > cfg.SnapshotCount {
+			cfg.SnapshotCatchUpEntries = cfg.SnapshotCount
+		}
+	}
+	return cfg
+}
+
+// Validate returns ErrInvalidNodeConfig if the configuration is invalid
+func (cfg NodeConfig) Validate() error {
+	cfg = cfg.withDefaults()
+
+	members, err := parsePeers(cfg.Peers)
+	if err != nil {
+		return &ErrInvalidNodeConfig{Field: "Peers", Reason: err.Error()}
+	}
+	if len(members) == 0 {
+		return &ErrInvalidNodeConfig{Field: "Peers", Reason: "no peers"}
+	}
+	if _, err := selfMember(members, cfg.ID); err != nil {
+		return &ErrInvalidNodeConfig{Field: "ID", Reason: err.Error()}
+	}
+	if cfg.WALDir == "" && cfg.LogStore == nil {
+		return &ErrInvalidNodeConfig{Field: "WALDir", Reason: "either WALDir or LogStore is required"}
+	}
+	if cfg.SnapDir == "" {
+		return &ErrInvalidNodeConfig{Field: "SnapDir", Reason: "required"}
+	}
+	if cfg.TickInterval < 0 {
+		return &ErrInvalidNodeConfig{Field: "TickInterval", Reason: "must be positive"}
+	}
+	if cfg.HeartbeatTick < 0 {
+		return &ErrInvalidNodeConfig{Field: "HeartbeatTick", Reason: "must be positive"}
+	}
+	if cfg.ElectionTick <= cfg.HeartbeatTick {
+		return &ErrInvalidNodeConfig{Field: "ElectionTick", Reason: "must be greater than HeartbeatTick"}
+	}
+	if cfg.MaxInflightMsgs < 0 {
+		return &ErrInvalidNodeConfig{Field: "MaxInflightMsgs", Reason: "must be positive"}
+	}
+	if cfg.ApplyQueueSize < 0 {
+		return &ErrInvalidNodeConfig{Field: "ApplyQueueSize", Reason: "must be positive"}
+	}
+	if cfg.MaxSnapshots < 0 {
+		return &ErrInvalidNodeConfig{Field: "MaxSnapshots", Reason: "must be positive"}
+	}
+	if cfg.PurgeInterval < 0 {
+		return &ErrInvalidNodeConfig{Field: "PurgeInterval", Reason: "must be positive"}
+	}
+	if cfg.SnapshotCatchUpEntries > cfg.SnapshotCount {
+		return &ErrInvalidNodeConfig{Field: "SnapshotCatchUpEntries", Reason: "must not be greater than SnapshotCount"}
+	}
+	return nil
+}
+
+// NewNodeFromConfig creates new phalanx node from the validated configuration.
+// The node is started by Start and stopped by Stop.
+// Proposals are made by Propose and ProposeConfChange,
+// and the commits and the errors are passed to NewDB with a nil snapshotter.
+func NewNodeFromConfig(cfg NodeConfig) (Node, chan *Commit, chan error, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	cfg = cfg.withDefaults()
+
+	// the channels are never written, so proposals are made only through the node
+	proposeC := make(chan []byte)
+	confChangeC := make(chan raftpb.ConfChange)
+
+	walDir := cfg.WALDir
+	if cfg.LogStore != nil {
+		walDir = ""
+	}
+	rc, commitC, errorC := newPhalanxNode(
+		cfg.ID,
+		cfg.Peers,
+		cfg.Join,
+		cfg.GetSnapshot,
+		proposeC,
+		confChangeC,
+		walDir,
+		cfg.LogStore,
+		cfg.SnapDir,
+	)
+	rc.captureSnapshot = cfg.CaptureSnapshot
+	rc.peerTLS = cfg.PeerTLS
+	rc.clusterToken = cfg.ClusterToken
+	rc.metrics = cfg.Metrics.forNode(rc, cfg.Region)
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger
+	}
+	rc.setLogger(cfg.Logger, cfg.Region)
+	rc.tickInterval = cfg.TickInterval
+	rc.electionTick = cfg.ElectionTick
+	rc.heartbeatTick = cfg.HeartbeatTick
+	rc.maxSizePerMsg = cfg.MaxSizePerMsg
+	rc.maxInflightMsgs = cfg.MaxInflightMsgs
+	rc.snapCount = cfg.SnapshotCount
+	rc.snapshotCatchUpEntries = cfg.SnapshotCatchUpEntries
+	rc.applyQueueSize = cfg.ApplyQueueSize
+	rc.maxSnapshots = cfg.MaxSnapshots
+	rc.purgeInterval = cfg.PurgeInterval
+	return rc, commitC, errorC, nil
+}
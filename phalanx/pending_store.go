@@ -0,0 +1,257 @@
+package phalanx
+
+import (
+	"bytes"
+	"sort"
+)
+
+// pendingWrites are the writes of the applied commands
+// which are not written to the StableStore yet
+type pendingWrites map[string]map[string]batchOp
+
+func (w pendingWrites) add(ops []batchOp) {
+	for _, op := range ops {
+		region, ok := w[op.region]
+		if !ok {
+			region = make(map[string]batchOp)
+			w[op.region] = region
+		}
+		region[string(op.key)] = op
+	}
+}
+
+// pendingStore is the StableStore passed to CommandHandler.Apply.
+// Its snapshots read the pending writes over the StableStore,
+// so that a command reads the writes of the commands applied before it
+// regardless of how the entries are grouped into batches.
+type pendingStore struct {
+	StableStore
+	writes pendingWrites
+}
+
+func (s *pendingStore) GetSnapshot() (Snapshot, error) {
+	snapshot, err := s.StableStore.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &pendingSnapshot{Snapshot: snapshot, writes: s.writes}, nil
+}
+
+type pendingSnapshot struct {
+	Snapshot
+	writes pendingWrites
+}
+
+func (s *pendingSnapshot) Get(region string, key []byte) ([]byte, error) {
+	if op, ok := s.writes[region][string(key)]; ok {
+		if op.delete {
+			return nil, ErrKeyNotFound
+		}
+		return op.value, nil
+	}
+	return s.Snapshot.Get(region, key)
+}
+
+func (s *pendingSnapshot) MultiGet(region string, keys ...[]byte) ([][]byte, error) {
+	values, err := s.Snapshot.MultiGet(region, keys...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if op, ok := s.writes[region][string(keys[i])]; ok {
+			if op.delete {
+				values[i] = nil
+			} else {
+				values[i] = op.value
+			}
+		}
+	}
+	return values, nil
+}
+
+func (s *pendingSnapshot) Has(region string, key []byte) (bool, error) {
+	if op, ok := s.writes[region][string(key)]; ok {
+		return !op.delete, nil
+	}
+	return s.Snapshot.Has(region, key)
+}
+
+func (s *pendingSnapshot) NewIterator(region string, slice *Range) (Iterator, error) {
+	if slice == nil {
+		slice = FullScanRange()
+	}
+	base, err := s.Snapshot.NewIterator(region, slice)
+	if err != nil {
+		return nil, err
+	}
+	var ops []batchOp
+	for _, op := range s.writes[region] {
+		if slice.Start != nil && bytes.Compare(op.key, slice.Start) < 0 {
+			continue
+		}
+		if slice.End != nil && bytes.Compare(op.key, slice.End) >= 0 {
+			continue
+		}
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return bytes.Compare(ops[i].key, ops[j].key) < 0 })
+	return &pendingIterator{base: base, ops: ops}, nil
+}
+
+const (
+	iterUnpositioned = iota
+	iterForward
+	iterBackward
+)
+
+// pendingIterator merges the sorted pending writes into the iterator of the StableStore.
+// Moving forward, base and i are at the first keys after the current key,
+// and moving backward, they are at the last keys before it.
+type pendingIterator struct {
+	base   Iterator
+	baseOK bool
+	ops    []batchOp
+	i      int
+	dir    int
+
+	valid      bool
+	key, value []byte
+}
+
+func (it *pendingIterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.key
+}
+
+func (it *pendingIterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.value
+}
+
+func (it *pendingIterator) Release() {
+	it.base.Release()
+}
+
+func (it *pendingIterator) Error() error {
+	return it.base.Error()
+}
+
+func (it *pendingIterator) First() bool {
+	it.baseOK = it.base.First()
+	it.i = 0
+	it.dir = iterForward
+	return it.forward()
+}
+
+func (it *pendingIterator) Last() bool {
+	it.baseOK = it.base.Last()
+	it.i = len(it.ops) - 1
+	it.dir = iterBackward
+	return it.backward()
+}
+
+func (it *pendingIterator) Seek(key []byte) bool {
+	it.baseOK = it.base.Seek(key)
+	it.i = sort.Search(len(it.ops), func(i int) bool { return bytes.Compare(it.ops[i].key, key) >= 0 })
+	it.dir = iterForward
+	return it.forward()
+}
+
+func (it *pendingIterator) Next() bool {
+	switch {
+	case it.dir == iterForward:
+		return it.forward()
+	case it.dir == iterUnpositioned || !it.valid:
+		return it.First()
+	}
+	// move the positions after the current key
+	key := it.key
+	it.baseOK = it.base.Seek(key)
+	if it.baseOK && bytes.Equal(it.base.Key(), key) {
+		it.baseOK = it.base.Next()
+	}
+	it.i = sort.Search(len(it.ops), func(i int) bool { return bytes.Compare(it.ops[i].key, key) > 0 })
+	it.dir = iterForward
+	return it.forward()
+}
+
+func (it *pendingIterator) Prev() bool {
+	switch {
+	case it.dir == iterBackward:
+		return it.backward()
+	case it.dir == iterUnpositioned || !it.valid:
+		return it.Last()
+	}
+	// move the positions before the current key
+	key := it.key
+	if it.base.Seek(key) {
+		it.baseOK = it.base.Prev()
+	} else {
+		it.baseOK = it.base.Last()
+	}
+	it.i = sort.Search(len(it.ops), func(i int) bool { return bytes.Compare(it.ops[i].key, key) >= 0 }) - 1
+	it.dir = iterBackward
+	return it.backward()
+}
+
+// forward moves to the smaller of the next keys, where the pending write wins
+func (it *pendingIterator) forward() bool {
+	for {
+		hasOp := it.i < len(it.ops)
+		if !it.baseOK && !hasOp {
+			it.valid = false
+			return false
+		}
+		if hasOp && (!it.baseOK || bytes.Compare(it.ops[it.i].key, it.base.Key()) <= 0) {
+			op := it.ops[it.i]
+			it.i++
+			if it.baseOK && bytes.Equal(op.key, it.base.Key()) {
+				it.baseOK = it.base.Next()
+			}
+			if op.delete {
+				continue
+			}
+			it.set(op.key, op.value)
+			return true
+		}
+		// the key and the value of base are copied before base moves
+		it.set(append([]byte{}, it.base.Key()...), append([]byte{}, it.base.Value()...))
+		it.baseOK = it.base.Next()
+		return true
+	}
+}
+
+// backward moves to the larger of the previous keys, where the pending write wins
+func (it *pendingIterator) backward() bool {
+	for {
+		hasOp := it.i >= 0
+		if !it.baseOK && !hasOp {
+			it.valid = false
+			return false
+		}
+		if hasOp && (!it.baseOK || bytes.Compare(it.ops[it.i].key, it.base.Key()) >= 0) {
+			op := it.ops[it.i]
+			it.i--
+			if it.baseOK && bytes.Equal(op.key, it.base.Key()) {
+				it.baseOK = it.base.Prev()
+			}
+			if op.delete {
+				continue
+			}
+			it.set(op.key, op.value)
+			return true
+		}
+		it.set(append([]byte{}, it.base.Key()...), append([]byte{}, it.base.Value()...))
+		it.baseOK = it.base.Prev()
+		return true
+	}
+}
+
+func (it *pendingIterator) set(key, value []byte) {
+	it.valid = true
+	it.key, it.value = key, value
+}
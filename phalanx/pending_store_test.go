@@ -0,0 +1,139 @@
+package phalanx_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getumen/doctrine/phalanx"
+)
+
+func newPendingStore(t *testing.T) phalanx.StableStore {
+	tempDir, err := ioutil.TempDir("", "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	stableStore, err := phalanx.NewStableStore("leveldb", filepath.Join(tempDir, "stableStore"))
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	t.Cleanup(func() { stableStore.Close() })
+	if err := stableStore.CreateRegion(region); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := stableStore.CreateBatch()
+	for _, key := range []string{"a", "c", "e", "g"} {
+		batch.Put(region, []byte(key), []byte(key))
+	}
+	if err := stableStore.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	return phalanx.NewPendingTestStore(stableStore, func(batch phalanx.Batch) {
+		batch.Put(region, []byte("b"), []byte("b'"))
+		batch.Put(region, []byte("c"), []byte("c'"))
+		batch.Delete(region, []byte("e"))
+		batch.Put(region, []byte("h"), []byte("h'"))
+	})
+}
+
+func TestPendingSnapshotGet(t *testing.T) {
+	snapshot, err := newPendingStore(t).GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	tests := []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"a", "a", nil},
+		{"b", "b'", nil},
+		{"c", "c'", nil},
+		{"e", "", phalanx.ErrKeyNotFound},
+		{"f", "", phalanx.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		value, err := snapshot.Get(region, []byte(tt.key))
+		if err != tt.err || string(value) != tt.value {
+			t.Errorf("expect %s=%q %v, got %q %v", tt.key, tt.value, tt.err, value, err)
+		}
+		has, err := snapshot.Has(region, []byte(tt.key))
+		if err != nil || has != (tt.err == nil) {
+			t.Errorf("expect has %s %v, got %v %v", tt.key, tt.err == nil, has, err)
+		}
+	}
+	values, err := snapshot.MultiGet(region, []byte("c"), []byte("e"))
+	if err != nil || string(values[0]) != "c'" || values[1] != nil {
+		t.Errorf("expect [c' nil], got %q %v", values, err)
+	}
+}
+
+func TestPendingSnapshotIterator(t *testing.T) {
+	snapshot, err := newPendingStore(t).GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	iter, err := snapshot.NewIterator(region, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Release()
+	var keys []string
+	for iter.Next() {
+		keys = append(keys, string(iter.Key())+"="+string(iter.Value()))
+	}
+	if got := strings.Join(keys, " "); got != "a=a b=b' c=c' g=g h=h'" {
+		t.Fatalf("expect forward a b c g h, got %s", got)
+	}
+	keys = nil
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if got := strings.Join(keys, " "); got != "h g c b a" {
+		t.Fatalf("expect backward h g c b a, got %s", got)
+	}
+
+	// the direction changes around the current key
+	moves := []struct {
+		move func() bool
+		key  string
+	}{
+		{func() bool { return iter.Seek([]byte("d")) }, "g"},
+		{iter.Prev, "c"},
+		{iter.Prev, "b"},
+		{iter.Next, "c"},
+		{iter.Next, "g"},
+		{func() bool { return iter.Seek([]byte("e")) }, "g"},
+		{iter.Next, "h"},
+		{iter.Prev, "g"},
+	}
+	for i, m := range moves {
+		if !m.move() || string(iter.Key()) != m.key {
+			t.Fatalf("move %d: expect %s, got %s", i, m.key, iter.Key())
+		}
+	}
+	if iter.Seek([]byte("i")) {
+		t.Fatalf("expect no key after h, got %s", iter.Key())
+	}
+
+	ranged, err := snapshot.NewIterator(region, &phalanx.Range{Start: []byte("b"), End: []byte("h")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ranged.Release()
+	keys = nil
+	for ranged.Next() {
+		keys = append(keys, string(ranged.Key()))
+	}
+	if got := strings.Join(keys, " "); got != "b c g" {
+		t.Fatalf("expect b c g in the range, got %s", got)
+	}
+}
@@ -1,53 +1,309 @@
 package phalanx
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/coreos/etcd/pkg/idutil"
+	"github.com/coreos/etcd/pkg/wait"
 	"github.com/coreos/etcd/snap"
 	"github.com/getumen/doctrine/phalanx/phalanxpb"
+	"golang.org/x/xerrors"
 	"google.golang.org/protobuf/proto"
 )
 
+// ReadConsistency is the consistency level of a read
+type ReadConsistency int
+
+const (
+	// ReadStale reads the local StableStore without coordination.
+	// A follower or a deposed leader may return stale data.
+	ReadStale ReadConsistency = iota
+	// ReadLinearizable confirms the commit index with the leader by raft ReadIndex
+	// and reads after the local StableStore applies entries up to the index.
+	ReadLinearizable
+	// ReadLeaseBased reads on the leader without a round trip while it holds a valid lease.
+	// It relies on bounded clock drift between members.
+	// Followers and a leader which cannot confirm its lease fall back to ReadIndex.
+	ReadLeaseBased
+)
+
+func (c ReadConsistency) String() string {
+	switch c {
+	case ReadStale:
+		return "stale"
+	case ReadLinearizable:
+		return "linearizable"
+	case ReadLeaseBased:
+		return "lease-based"
+	}
+	return fmt.Sprintf("ReadConsistency(%d)", int(c))
+}
+
+// ApplyMode is how the committed entries are written to the StableStore
+type ApplyMode int
+
+const (
+	// ApplyPerEntry writes each committed entry with its applied index
+	ApplyPerEntry ApplyMode = iota
+	// ApplyPerReady writes the entries committed in a raft Ready at once with the applied index.
+	// CommandHandler.Apply reads the writes of the entries applied before it in the Ready,
+	// so the state it reads does not depend on how the entries are grouped into Readys.
+	ApplyPerReady
+)
+
+func (m ApplyMode) String() string {
+	switch m {
+	case ApplyPerEntry:
+		return "per-entry"
+	case ApplyPerReady:
+		return "per-ready"
+	}
+	return fmt.Sprintf("ApplyMode(%d)", int(m))
+}
+
+// DBConfig is the optional configuration of a DB
+type DBConfig struct {
+	// ProposalBatching packs the proposals into one raft entry if set
+	ProposalBatching *ProposalBatching
+	// ApplyMode is how the committed entries are written to the StableStore
+	ApplyMode ApplyMode
+	// Logger is the logger of the DB, or the logger of the node if nil
+	Logger Logger
+}
+
 // DB is distributed embeddable db
 type DB interface {
-	Get(key []byte) ([]byte, error)
-	Propose(command *phalanxpb.Command) error
+	Get(ctx context.Context, key []byte, consistency ReadConsistency) ([]byte, error)
+	// Propose proposes the command and returns the Future
+	// which is resolved when the command is applied locally.
+	// The deadline and the cancellation of ctx apply to both the proposal and the Future.
+	// ErrProposalTimeout is returned when the deadline passes.
+	Propose(ctx context.Context, command *phalanxpb.Command) (*Future, error)
 }
 
 type phananxDB struct {
 	regionName    string
-	proposeC      chan<- []byte // channel for proposing updates
+	node          Node
 	stableStore   StableStore
 	commandHander CommandHandler
 	snapshotter   *snap.Snapshotter
+	applyMode     ApplyMode
+
+	metrics  *nodeMetrics // nil if the metrics are not collected
+	logger   Logger
+	memberID uint64            // member ID of the node, which is put in the proposals
+	reqIDGen *idutil.Generator // generates the request IDs unique on this member
+	batcher  *proposalBatcher  // nil if each proposal is its own entry
+	wait     wait.Wait         // proposals waiting to be applied
+	stopc    chan struct{}     // closed when all commits are applied and the commit channel is closed
+
+	// entries up to recoveredIndex were applied before restart
+	// or restored from a checkpoint
+	recoveredIndex uint64
+	pending        *pendingApply // applied entries which are not written yet
+
+	appliedMu    sync.RWMutex
+	appliedIndex uint64
+	appliedC     chan struct{} // closed when appliedIndex advances
+
+	checkpointMu sync.Mutex // serializes the updates of the checkpoint chain
+	checkpoints  *checkpointChain
+
+	dirtyMu   sync.Mutex
+	dirtyKeys map[string]struct{} // keys changed since the last checkpoint
+	needBase  bool                // the changes since the last checkpoint are unknown
 }
 
-// NewDB creates new db
+// NewDB creates new db.
+// If the db fails to start or to apply commits, the node is stopped
+// and Node.Err returns the error.
+// The snapshotter may be nil for a node created by NewNodeFromConfig,
+// which is started before NewDB.
 func NewDB(
 	regionName string,
+	node Node,
 	snapshotter *snap.Snapshotter,
-	proposeC chan []byte,
-	commitC chan []byte,
+	commitC chan *Commit,
 	errorC chan error,
 	stableStore StableStore,
 	commandHander CommandHandler,
 ) DB {
+	db, err := newDB(regionName, node, snapshotter, commitC, errorC, stableStore, commandHander, DBConfig{})
+	if err != nil {
+		db.logger.Error("failed to start region", errorField(err))
+	}
+	return db
+}
+
+// NewDBWithProposalBatching creates new db
+// which packs the proposals into one raft entry
+func NewDBWithProposalBatching(
+	regionName string,
+	node Node,
+	snapshotter *snap.Snapshotter,
+	commitC chan *Commit,
+	errorC chan error,
+	stableStore StableStore,
+	commandHander CommandHandler,
+	batching ProposalBatching,
+) DB {
+	return NewDBWithConfig(
+		regionName, node, snapshotter, commitC, errorC, stableStore, commandHander,
+		DBConfig{ProposalBatching: &batching})
+}
+
+// NewDBWithConfig creates new db with the optional configuration
+func NewDBWithConfig(
+	regionName string,
+	node Node,
+	snapshotter *snap.Snapshotter,
+	commitC chan *Commit,
+	errorC chan error,
+	stableStore StableStore,
+	commandHander CommandHandler,
+	cfg DBConfig,
+) DB {
+	db, err := newDB(regionName, node, snapshotter, commitC, errorC, stableStore, commandHander, cfg)
+	if err != nil {
+		db.logger.Error("failed to start region", errorField(err))
+	}
+	return db
+}
+
+func newDB(
+	regionName string,
+	node Node,
+	snapshotter *snap.Snapshotter,
+	commitC chan *Commit,
+	errorC chan error,
+	stableStore StableStore,
+	commandHander CommandHandler,
+	cfg DBConfig,
+) (*phananxDB, error) {
+	var metrics *nodeMetrics
+	logger := cfg.Logger
+	// the member ID and the logger of the node are known after its raft log is read
+	memberID := node.ID()
+	if rc, ok := node.(*phalanxNode); ok {
+		metrics = rc.metrics
+		if snapshotter == nil {
+			snapshotter = rc.snapshotter
+		}
+		if logger == nil {
+			logger = rc.logger
+			if rc.region != regionName {
+				logger = logger.With(regionField(regionName))
+			}
+		} else {
+			logger = logger.With(nodeIDField(rc.self.id), regionField(regionName))
+		}
+	}
+	if logger == nil {
+		logger = defaultLogger.With(regionField(regionName))
+	}
 	db := &phananxDB{
 		regionName:    regionName,
-		proposeC:      proposeC,
+		node:          node,
 		stableStore:   stableStore,
 		commandHander: commandHander,
 		snapshotter:   snapshotter,
+		applyMode:     cfg.ApplyMode,
+		metrics:       metrics,
+		logger:        logger,
+		memberID:      memberID,
+		reqIDGen:      idutil.NewGenerator(uint16(memberID), time.Now()),
+		wait:          wait.New(),
+		stopc:         make(chan struct{}),
+		appliedC:      make(chan struct{}),
+		dirtyKeys:     make(map[string]struct{}),
 	}
+	if cfg.ProposalBatching != nil {
+		db.batcher = newProposalBatcher(node.Propose, *cfg.ProposalBatching)
+	}
+	if err := db.recover(); err != nil {
+		db.fail(err)
+		close(db.stopc)
+		return db, err
+	}
+
 	// replay log into key-value map
-	db.readCommits(commitC, errorC)
+	if err := db.readCommits(commitC, errorC, true); err != nil {
+		db.fail(err)
+		close(db.stopc)
+		return db, err
+	}
 	// read commits from raft into kvStore map until error
-	go db.readCommits(commitC, errorC)
+	go func() {
+		if err := db.readCommits(commitC, errorC, false); err != nil {
+			db.fail(err)
+		}
+		close(db.stopc)
+	}()
 
-	return db
+	return db, nil
 }
 
-func (db *phananxDB) Get(key []byte) ([]byte, error) {
+// recover restores the applied index, the checkpoints and the members
+// persisted in the StableStore
+func (db *phananxDB) recover() error {
+	if err := createSystemRegion(db.stableStore); err != nil {
+		return err
+	}
+	recoveredIndex, _, err := loadAppliedIndex(db.stableStore, db.regionName)
+	if err != nil {
+		return err
+	}
+	db.recoveredIndex = recoveredIndex
+	db.setAppliedIndex(recoveredIndex)
+
+	rc, ok := db.node.(*phalanxNode)
+	if !ok {
+		return nil
+	}
+	checkpoints, err := openCheckpointChain(filepath.Join(rc.snapdir, checkpointDirName))
+	if err != nil {
+		return err
+	}
+	db.checkpoints = checkpoints
+	// the keys changed after the last checkpoint are not known after restart
+	db.needBase = checkpoints.lastIndex() != recoveredIndex
+	rc.setCheckpointer(db)
+
+	// the members are persisted with the applied index
+	snapshot, err := db.stableStore.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	members, err := readMembers(snapshot, db.regionName)
+	snapshot.Release()
+	if err != nil {
+		return err
+	}
+	if members != nil {
+		rc.membership.restore(recoveredIndex, members)
+	}
+	return nil
+}
+
+// fail stops the node, since the db cannot apply the following commits
+func (db *phananxDB) fail(err error) {
+	if rc, ok := db.node.(*phalanxNode); ok {
+		rc.fail(err)
+	}
+}
+
+func (db *phananxDB) Get(
+	ctx context.Context,
+	key []byte,
+	consistency ReadConsistency,
+) ([]byte, error) {
+	if err := db.readBarrier(ctx, consistency); err != nil {
+		return nil, err
+	}
 	snapshot, err := db.stableStore.GetSnapshot()
 	if err != nil {
 		return nil, err
@@ -56,42 +312,170 @@ func (db *phananxDB) Get(key []byte) ([]byte, error) {
 	return snapshot.Get(db.regionName, key)
 }
 
-func (db *phananxDB) Propose(command *phalanxpb.Command) error {
-	message, err := proto.Marshal(command)
+// defaultProposalTimeout is the timeout of a proposal whose context has no deadline
+var defaultProposalTimeout = 10 * time.Second
+
+func (db *phananxDB) Propose(ctx context.Context, command *phalanxpb.Command) (*Future, error) {
+	proposed := time.Now()
+	id := db.reqIDGen.Next()
+	proposal := &phalanxpb.Proposal{
+		RequestID: id,
+		Command:   command,
+		MemberID:  db.memberID,
+	}
+
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); ok {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, defaultProposalTimeout)
+	}
+
+	appliedC := db.wait.Register(id)
+	leaderChangedC := db.node.LeaderChangedNotify()
+	if err := db.propose(ctx, proposal); err != nil {
+		cancel()
+		db.wait.Trigger(id, nil)
+		err = proposalError(err)
+		db.metrics.observeProposal(proposed, time.Time{}, err)
+		return nil, err
+	}
+
+	future := newFuture()
+	go func() {
+		defer cancel()
+		result := db.waitProposal(ctx, id, appliedC, leaderChangedC)
+		db.metrics.observeProposal(proposed, result.committed, result.err)
+		future.resolve(result)
+	}()
+	return future, nil
+}
+
+// propose proposes the proposal alone or packed with others
+func (db *phananxDB) propose(ctx context.Context, proposal *phalanxpb.Proposal) error {
+	if db.batcher != nil {
+		return db.batcher.add(ctx, proposal)
+	}
+	message, err := proto.Marshal(proposal)
 	if err != nil {
 		return err
 	}
-	db.proposeC <- message
-	return nil
+	return db.node.Propose(ctx, message)
+}
+
+// waitProposal returns the result when the proposal is applied or fails
+func (db *phananxDB) waitProposal(
+	ctx context.Context,
+	id uint64,
+	appliedC <-chan interface{},
+	leaderChangedC <-chan struct{},
+) *applyResult {
+	select {
+	case x := <-appliedC:
+		return x.(*applyResult)
+	case <-leaderChangedC:
+		db.wait.Trigger(id, &applyResult{err: ErrLeaderChanged})
+	case <-ctx.Done():
+		db.wait.Trigger(id, &applyResult{err: proposalError(ctx.Err())})
+	case <-db.stopc:
+		db.wait.Trigger(id, &applyResult{err: ErrNodeStopped})
+	}
+	// the proposal may be applied before the failure is triggered
+	return (<-appliedC).(*applyResult)
+}
+
+// proposalError distinguishes the deadline of a proposal from other errors
+func proposalError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrProposalTimeout
+	}
+	return err
+}
+
+// readBarrier waits until reading the local StableStore satisfies the consistency
+func (db *phananxDB) readBarrier(ctx context.Context, consistency ReadConsistency) error {
+	switch consistency {
+	case ReadStale:
+		return nil
+	case ReadLinearizable:
+		index, err := db.node.ReadIndex(ctx)
+		if err != nil {
+			return err
+		}
+		return db.waitApplied(ctx, index)
+	case ReadLeaseBased:
+		index, err := db.node.LeaseReadIndex(ctx)
+		if err != nil {
+			return err
+		}
+		return db.waitApplied(ctx, index)
+	}
+	return fmt.Errorf("unknown read consistency %s", consistency)
+}
+
+// waitApplied waits until the entry at the index is applied
+func (db *phananxDB) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		db.appliedMu.RLock()
+		appliedIndex, appliedC := db.appliedIndex, db.appliedC
+		db.appliedMu.RUnlock()
+		if appliedIndex >= index {
+			return nil
+		}
+		select {
+		case <-appliedC:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.stopc:
+			return ErrNodeStopped
+		}
+	}
 }
 
-func (db *phananxDB) readCommits(commitC chan []byte, errorC chan error) error {
-	for data := range commitC {
-		if data == nil {
+func (db *phananxDB) setAppliedIndex(index uint64) {
+	db.appliedMu.Lock()
+	defer db.appliedMu.Unlock()
+	if index <= db.appliedIndex {
+		return
+	}
+	db.appliedIndex = index
+	close(db.appliedC)
+	db.appliedC = make(chan struct{})
+}
+
+// readCommits applies commits until the commit channel is closed,
+// or until the log is replayed if replay is set
+func (db *phananxDB) readCommits(commitC chan *Commit, errorC chan error, replay bool) error {
+	for commit := range commitC {
+		if commit == nil {
 			// done replaying log; new data incoming
 			// OR signaled to load snapshot
-			snapshot, err := db.snapshotter.Load()
-			if err == snap.ErrNoSnapshot {
-				return nil
+			if err := db.writePending(); err != nil {
+				return err
 			}
-			if err != nil {
-				log.Panic(err)
+			if err := db.maybeLoadSnapshot(); err != nil {
+				return err
 			}
-			log.Printf("loading snapshot at term %d and index %d",
-				snapshot.Metadata.Term, snapshot.Metadata.Index)
-			if err := db.recoverFromSnapshot(snapshot.Data); err != nil {
-				log.Panic(err)
+			if replay {
+				return nil
 			}
 			continue
 		}
 
-		var command phalanxpb.Command
-		err := proto.Unmarshal(data, &command)
-		if err != nil {
-			errorC <- err
-			continue
+		// the entry is applied before restart if its index is not greater than recoveredIndex
+		if commit.Index > db.recoveredIndex {
+			if err := db.applyCommit(commit); err != nil {
+				return err
+			}
 		}
-		db.commandHander.Apply(db.regionName, &command, db.stableStore)
+		if db.applyMode == ApplyPerEntry || commit.EndOfReady {
+			if err := db.writePending(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := db.writePending(); err != nil {
+		return err
 	}
 	if err, ok := <-errorC; ok {
 		return err
@@ -99,6 +483,183 @@ func (db *phananxDB) readCommits(commitC chan []byte, errorC chan error) error {
 	return nil
 }
 
+// applyCommit applies the commit to the pending batch
+func (db *phananxDB) applyCommit(commit *Commit) error {
+	if db.pending == nil {
+		db.pending = &pendingApply{
+			batch:  newRecordingBatch(db.stableStore.CreateBatch(), db.regionName),
+			writes: make(pendingWrites),
+		}
+	}
+	p := db.pending
+	p.index, p.term = commit.Index, commit.Term
+
+	if commit.Data != nil {
+		var proposal phalanxpb.Proposal
+		if err := proto.Unmarshal(commit.Data, &proposal); err != nil {
+			// every member skips the entry which is not a proposal of the db
+			db.logger.Warn("skip entry", termField(commit.Term), indexField(commit.Index), errorField(err))
+			return nil
+		}
+		proposals := proposal.Proposals
+		if len(proposals) == 0 {
+			proposals = []*phalanxpb.Proposal{&proposal}
+		}
+		db.apply(p, proposals, time.Now())
+	} else if commit.Members != nil {
+		if err := putMembers(p.batch.Batch, db.regionName, commit.Members); err != nil {
+			return err
+		}
+		p.dirty = true
+	}
+	return nil
+}
+
+// maybeLoadSnapshot loads the snapshot if it is newer than the stable store
+func (db *phananxDB) maybeLoadSnapshot() error {
+	snapshot, err := db.snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if snapshot.Metadata.Index <= db.recoveredIndex {
+		// the stable store is newer than the snapshot
+		db.removeCheckpointFile(snapshot.Metadata.Index)
+		return nil
+	}
+	db.logger.Info("loading snapshot",
+		termField(snapshot.Metadata.Term), indexField(snapshot.Metadata.Index))
+	index, members, err := db.loadSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	if rc, ok := db.node.(*phalanxNode); ok && members != nil {
+		rc.membership.restore(index, members)
+	}
+	// the checkpoint may be newer than the snapshot
+	if index < snapshot.Metadata.Index {
+		index = snapshot.Metadata.Index
+	}
+	db.recoveredIndex = index
+	db.setAppliedIndex(index)
+	return nil
+}
+
+// apply applies the commands of the proposals in order to the pending batch.
+// Each command reads the writes of the commands applied before it in the batch.
+// The error of a command is returned in its result and discards the writes of the command.
+func (db *phananxDB) apply(p *pendingApply, proposals []*phalanxpb.Proposal, committed time.Time) {
+	store := &pendingStore{StableStore: db.stableStore, writes: p.writes}
+	for i := range proposals {
+		var commandBatch bufferedBatch
+		result, err := db.commandHander.Apply(db.regionName, proposals[i].Command, &commandBatch, store)
+		if err == nil {
+			commandBatch.writeTo(p.batch)
+			p.writes.add(commandBatch.ops)
+		}
+		// the proposer is waiting only on the member which proposed the command,
+		// and the request IDs of other members may be the same
+		if proposals[i].MemberID != db.memberID {
+			continue
+		}
+		p.acks = append(p.acks, proposalAck{
+			id:     proposals[i].RequestID,
+			result: &applyResult{result: result, err: err, committed: committed},
+		})
+	}
+	p.dirty = true
+}
+
+// pendingApply is the applied entries written in a batch
+type pendingApply struct {
+	batch  *recordingBatch
+	writes pendingWrites // the writes of the commands in the batch
+	dirty  bool          // the batch has writes
+	index  uint64        // index of the last applied entry
+	term   uint64        // term of the last applied entry
+	acks   []proposalAck
+}
+
+// proposalAck is the result of a command returned to its proposer after the batch is written
+type proposalAck struct {
+	id     uint64
+	result *applyResult
+}
+
+// writePending writes the pending batch with the applied index,
+// and then acknowledges the applied commands
+func (db *phananxDB) writePending() error {
+	p := db.pending
+	if p == nil {
+		return nil
+	}
+	db.pending = nil
+
+	// the entries without writes only advance the applied index in memory.
+	// The writes and the applied index are synced at once,
+	// so that a crash neither skips nor applies again the entries after restart.
+	if p.dirty {
+		putAppliedIndex(p.batch.Batch, db.regionName, p.index, p.term)
+		db.dirtyMu.Lock()
+		start := time.Now()
+		err := db.stableStore.WriteSync(p.batch.Batch)
+		db.metrics.observeBatchWrite(start, p.batch.size)
+		if err == nil {
+			db.recordChanges(p.batch.keys)
+		}
+		db.dirtyMu.Unlock()
+		if err != nil {
+			return xerrors.Errorf("phalanxDB: failed to apply entry %d: %w", p.index, err)
+		}
+	}
+	for _, ack := range p.acks {
+		db.wait.Trigger(ack.id, ack.result)
+	}
+	db.setAppliedIndex(p.index)
+	return nil
+}
+
+// bufferedBatch keeps the writes of a command until the command succeeds
+type bufferedBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	region string
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (b *bufferedBatch) Put(region string, key, value []byte) {
+	b.ops = append(b.ops, batchOp{region: region, key: key, value: value})
+}
+
+func (b *bufferedBatch) Delete(region string, key []byte) {
+	b.ops = append(b.ops, batchOp{region: region, key: key, delete: true})
+}
+
+func (b *bufferedBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *bufferedBatch) Reset() {
+	b.ops = nil
+}
+
+// writeTo replays the writes to the batch
+func (b *bufferedBatch) writeTo(batch Batch) {
+	for _, op := range b.ops {
+		if op.delete {
+			batch.Delete(op.region, op.key)
+		} else {
+			batch.Put(op.region, op.key, op.value)
+		}
+	}
+}
+
 func (db *phananxDB) GetSnapshot() ([]byte, error) {
 	return db.stableStore.CreateCheckpoint(db.regionName)
 }
@@ -0,0 +1,33 @@
+package phalanx_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/getumen/doctrine/phalanx"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+)
+
+func TestApplyAcksOnlyProposalsOfMember(t *testing.T) {
+	stableStore := newPendingStore(t)
+
+	// the request IDs of the members are the same
+	proposals := []*phalanxpb.Proposal{
+		{RequestID: 1, MemberID: 1, Command: &phalanxpb.Command{Command: "PUT"}},
+		{RequestID: 1, MemberID: 2, Command: &phalanxpb.Command{Command: "PUT"}},
+		{RequestID: 2, MemberID: 2, Command: &phalanxpb.Command{Command: "PUT"}},
+	}
+	for _, tc := range []struct {
+		memberID uint64
+		expected string
+	}{
+		{memberID: 1, expected: "[1]"},
+		{memberID: 2, expected: "[1 2]"},
+		{memberID: 3, expected: "[]"},
+	} {
+		acked := phalanx.AckedRequestIDs(stableStore, region, tc.memberID, nopHandler{}, proposals...)
+		if fmt.Sprint(acked) != tc.expected {
+			t.Fatalf("expect member %d acks %s, got %v", tc.memberID, tc.expected, acked)
+		}
+	}
+}
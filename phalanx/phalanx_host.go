@@ -0,0 +1,492 @@
+package phalanx
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft/raftpb"
+	"golang.org/x/xerrors"
+)
+
+// Host runs a raft group per region in a single process.
+// All raft groups share one listener and one transport,
+// and commits of each group are applied to its region of the shared StableStore.
+type Host struct {
+	id             int      // index of this host in peers, starting from 1
+	peers          []string // raft peers given as name=URL or URL
+	join           bool     // host is joining an existing cluster
+	dataDir        string   // path to WAL and snapshot directories of regions
+	logStoreDriver string   // log store driver name, or WAL if empty
+	stableStore    StableStore
+	commandHandler CommandHandler
+	peerTLS        *PeerTLSInfo // nil if peers communicate in plain HTTP
+	clusterToken   string       // mixed into the cluster ID of a bootstrapping host
+
+	clusterID uint64          // cluster ID of all raft groups, known after Start
+	transport *multiTransport // created by Start
+
+	mu       sync.Mutex
+	regions  map[string]*hostRegion
+	starting map[string]bool // regions being added without holding mu
+	stopped  bool
+	dbConfig DBConfig // configuration of the DB of the regions added next
+	metrics  *Metrics // collects the metrics of the regions added next if set
+	logger   Logger
+
+	stoppingc chan struct{} // signals Stop is called
+	httpstopc chan struct{} // signals http server to shutdown
+	httpdonec chan struct{} // signals http server shutdown complete
+}
+
+type hostRegion struct {
+	db          *phananxDB
+	proposeC    chan []byte
+	confChangeC chan raftpb.ConfChange
+}
+
+// NewHost creates new multi-raft host.
+// If logStoreDriver is empty, the raft log of each region is kept in WAL under dataDir.
+func NewHost(
+	id int,
+	peers []string,
+	join bool,
+	dataDir string,
+	logStoreDriver string,
+	stableStore StableStore,
+	commandHandler CommandHandler,
+) *Host {
+	return newHost(id, peers, join, dataDir, logStoreDriver, stableStore, commandHandler, nil)
+}
+
+// NewHostWithTLS creates new multi-raft host
+// whose peers communicate over mutual TLS.
+// The peer URLs must be https.
+func NewHostWithTLS(
+	id int,
+	peers []string,
+	join bool,
+	dataDir string,
+	logStoreDriver string,
+	stableStore StableStore,
+	commandHandler CommandHandler,
+	peerTLS PeerTLSInfo,
+) *Host {
+	return newHost(id, peers, join, dataDir, logStoreDriver, stableStore, commandHandler, &peerTLS)
+}
+
+func newHost(
+	id int,
+	peers []string,
+	join bool,
+	dataDir string,
+	logStoreDriver string,
+	stableStore StableStore,
+	commandHandler CommandHandler,
+	peerTLS *PeerTLSInfo,
+) *Host {
+	return &Host{
+		id:             id,
+		peers:          peers,
+		join:           join,
+		dataDir:        dataDir,
+		logStoreDriver: logStoreDriver,
+		stableStore:    stableStore,
+		commandHandler: commandHandler,
+		peerTLS:        peerTLS,
+		regions:        make(map[string]*hostRegion),
+		starting:       make(map[string]bool),
+		logger:         defaultLogger,
+		stoppingc:      make(chan struct{}),
+		httpstopc:      make(chan struct{}),
+		httpdonec:      make(chan struct{}),
+	}
+}
+
+// Start starts serving raft messages of all groups.
+// It refuses to start if the cluster identity persisted in the StableStore
+// does not match the peers.
+func (h *Host) Start() error {
+	members, err := parsePeers(h.peers)
+	if err != nil {
+		return err
+	}
+	self, err := selfMember(members, h.id)
+	if err != nil {
+		return err
+	}
+	clusterID, err := h.loadClusterID(members, self)
+	if err != nil {
+		return err
+	}
+	logger := h.logger.With(nodeIDField(self.id))
+	transport := newMultiTransport(types.ID(self.id), types.ID(clusterID), h.peerTLS, logger)
+
+	url, err := url.Parse(self.url)
+	if err != nil {
+		return xerrors.Errorf("phalanxHost: failed parsing URL: %w", err)
+	}
+
+	ln, err := newStoppableListener(url.Host, h.httpstopc)
+	if err != nil {
+		return xerrors.Errorf("phalanxHost: failed to listen multiraft: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(multiRaftPath, transport)
+	mux.HandleFunc(multiRaftSnapshotPath, transport.serveSnapshot)
+	mux.HandleFunc(clusterPath, clusterHandler(clusterID))
+	mux.HandleFunc(statusPath, statusHandler(func() interface{} { return h.Status() }, logger))
+
+	var listener net.Listener = ln
+	var handler http.Handler = mux
+	if h.peerTLS != nil {
+		if listener, err = h.peerTLS.listen(ln); err != nil {
+			ln.Close()
+			return err
+		}
+		handler = h.peerTLS.authorize(mux, logger)
+	}
+
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		ln.Close()
+		return xerrors.New("phalanxHost: host is stopped")
+	}
+	h.clusterID = clusterID
+	h.transport = transport
+	h.mu.Unlock()
+
+	go func() {
+		err := (&http.Server{Handler: handler}).Serve(listener)
+		select {
+		case <-h.httpstopc:
+		default:
+			logger.Error("failed to serve multiraft", errorField(err))
+		}
+		close(h.httpdonec)
+	}()
+	return nil
+}
+
+// loadClusterID returns the cluster ID persisted in the StableStore,
+// or persists the cluster ID of a new host
+func (h *Host) loadClusterID(members []member, self member) (uint64, error) {
+	if err := createSystemRegion(h.stableStore); err != nil {
+		return 0, err
+	}
+	identity, err := loadHostIdentity(h.stableStore)
+	if err != nil {
+		return 0, err
+	}
+	if identity != nil {
+		var clusterID uint64
+		if !h.join {
+			clusterID = initialClusterID(members, h.clusterToken)
+		}
+		if err := identity.verify(self.id, clusterID); err != nil {
+			return 0, err
+		}
+		return identity.clusterID, nil
+	}
+
+	clusterID := initialClusterID(members, h.clusterToken)
+	if h.join {
+		ctx, cancel := stopContext(h.stoppingc)
+		defer cancel()
+		if clusterID, err = fetchClusterID(ctx, members, self, h.peerTLS, h.logger.With(nodeIDField(self.id))); err != nil {
+			return 0, err
+		}
+	}
+	err = saveHostIdentity(h.stableStore, clusterIdentity{memberID: self.id, clusterID: clusterID})
+	if err != nil {
+		return 0, err
+	}
+	return clusterID, nil
+}
+
+// SetClusterToken sets the token mixed into the cluster ID when the host bootstraps a cluster.
+// All bootstrapping hosts must use the same token,
+// and a cluster bootstrapped again on the same peers must use another one.
+// It takes effect when Start is called next.
+func (h *Host) SetClusterToken(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clusterToken = token
+}
+
+// SetProposalBatching makes the regions added after it
+// pack their proposals into one raft entry
+func (h *Host) SetProposalBatching(batching ProposalBatching) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dbConfig.ProposalBatching = &batching
+}
+
+// SetApplyMode sets how the regions added after it write the committed entries
+func (h *Host) SetApplyMode(mode ApplyMode) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dbConfig.ApplyMode = mode
+}
+
+// SetLogger makes the host and the regions added after it log to the logger.
+// The host logs to it after Start is called next.
+func (h *Host) SetLogger(logger Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.logger = logger
+}
+
+// SetMetrics makes the regions added after it report to the metrics
+func (h *Host) SetMetrics(metrics *Metrics) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.metrics = metrics
+}
+
+// AddRegion starts the raft group of the region and returns its DB
+func (h *Host) AddRegion(region string) (DB, error) {
+	if region == SystemRegion || strings.HasPrefix(region, logRegionPrefix) {
+		return nil, NewErrRegionReserved(region)
+	}
+
+	// the region is started without holding mu, which is held only to reserve and register it
+	h.mu.Lock()
+	if h.transport == nil || h.stopped {
+		h.mu.Unlock()
+		return nil, xerrors.New("phalanxHost: host is not started")
+	}
+	if _, dup := h.regions[region]; dup || h.starting[region] {
+		h.mu.Unlock()
+		return nil, NewErrRegionAlreadyExists(region)
+	}
+	h.starting[region] = true
+	clusterID, transport := h.clusterID, h.transport
+	dbConfig, metrics, logger := h.dbConfig, h.metrics, h.logger
+	h.mu.Unlock()
+
+	r, err := h.startRegion(region, clusterID, transport, dbConfig, metrics, logger)
+
+	h.mu.Lock()
+	delete(h.starting, region)
+	if err == nil && h.stopped {
+		h.mu.Unlock()
+		r.stop()
+		return nil, xerrors.New("phalanxHost: host is stopped")
+	}
+	if err != nil {
+		h.mu.Unlock()
+		return nil, err
+	}
+	h.regions[region] = r
+	h.mu.Unlock()
+	return r.db, nil
+}
+
+func (h *Host) startRegion(
+	region string,
+	clusterID uint64,
+	transport *multiTransport,
+	dbConfig DBConfig,
+	metrics *Metrics,
+	logger Logger,
+) (*hostRegion, error) {
+	if !h.stableStore.HasRegion(region) {
+		if err := h.stableStore.CreateRegion(region); err != nil {
+			return nil, err
+		}
+	}
+
+	regionDir := filepath.Join(h.dataDir, region)
+	if err := os.MkdirAll(regionDir, 0750); err != nil {
+		return nil, xerrors.Errorf(
+			"phalanxHost: cannot create dir for region(%s): %w",
+			region, err)
+	}
+
+	var logStore LogStore
+	if h.logStoreDriver != "" {
+		var err error
+		logStore, err = NewLogStore(h.logStoreDriver, h.stableStore, logRegionName(region))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proposeC := make(chan []byte)
+	confChangeC := make(chan raftpb.ConfChange)
+	getSnapshot := func() ([]byte, error) { return h.stableStore.CreateCheckpoint(region) }
+
+	rc, commitC, errorC := newPhalanxNode(
+		h.id,
+		h.peers,
+		h.join,
+		getSnapshot,
+		proposeC,
+		confChangeC,
+		filepath.Join(regionDir, "wal"),
+		logStore,
+		filepath.Join(regionDir, "snap"),
+	)
+	rc.clusterID = clusterID
+	rc.transport = transport.group(groupID(region), rc)
+	rc.metrics = metrics.forNode(rc, region)
+	rc.setLogger(logger, region)
+	rc.Start()
+
+	// the failed region is stopped without affecting the others
+	db, err := newDB(
+		region,
+		rc,
+		<-rc.snapshotterReady,
+		commitC,
+		errorC,
+		h.stableStore,
+		h.commandHandler,
+		dbConfig,
+	)
+	if err != nil {
+		close(proposeC)
+		close(confChangeC)
+		return nil, xerrors.Errorf("phalanxHost: failed to start region(%s): %w", region, err)
+	}
+
+	return &hostRegion{
+		db:          db,
+		proposeC:    proposeC,
+		confChangeC: confChangeC,
+	}, nil
+}
+
+// Region returns DB of the region
+func (h *Host) Region(region string) (DB, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r, exists := h.regions[region]; exists {
+		return r.db, nil
+	}
+	return nil, NewRegionNotFound(region)
+}
+
+// Status returns the status of the raft group of each region
+func (h *Host) Status() map[string]Status {
+	h.mu.Lock()
+	regions := make(map[string]*hostRegion, len(h.regions))
+	for region, r := range h.regions {
+		regions[region] = r
+	}
+	h.mu.Unlock()
+
+	statuses := make(map[string]Status, len(regions))
+	for region, r := range regions {
+		statuses[region] = r.db.node.Status()
+	}
+	return statuses
+}
+
+// TransferLeadership transfers the leadership of the raft group of the region to the member
+func (h *Host) TransferLeadership(ctx context.Context, region string, target uint64) error {
+	h.mu.Lock()
+	r, exists := h.regions[region]
+	h.mu.Unlock()
+	if !exists {
+		return NewRegionNotFound(region)
+	}
+	return r.db.node.TransferLeadership(ctx, target)
+}
+
+// Drain transfers the leadership of the raft groups led by this host to other hosts.
+// It is called before stopping the host to avoid waiting for an election timeout.
+func (h *Host) Drain(ctx context.Context) error {
+	h.mu.Lock()
+	regions := make(map[string]*hostRegion, len(h.regions))
+	for region, r := range h.regions {
+		regions[region] = r
+	}
+	h.mu.Unlock()
+
+	for region, r := range regions {
+		if err := r.db.node.Drain(ctx); err != nil {
+			return xerrors.Errorf("phalanx: failed to drain region %s: %w", region, err)
+		}
+	}
+	return nil
+}
+
+// RemoveRegion stops the raft group of the region.
+// Data of the region is kept in the StableStore.
+func (h *Host) RemoveRegion(region string) error {
+	h.mu.Lock()
+	r, exists := h.regions[region]
+	if !exists {
+		h.mu.Unlock()
+		return NewRegionNotFound(region)
+	}
+	delete(h.regions, region)
+	h.mu.Unlock()
+
+	r.stop()
+	return nil
+}
+
+// Stop stops all raft groups and the transport.
+// The regions being added are stopped when they are started.
+func (h *Host) Stop() {
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return
+	}
+	h.stopped = true
+	close(h.stoppingc)
+	regions := h.regions
+	h.regions = make(map[string]*hostRegion)
+	transport := h.transport
+	h.mu.Unlock()
+
+	for _, r := range regions {
+		r.stop()
+	}
+
+	if transport == nil {
+		// the host is not started
+		return
+	}
+	close(h.httpstopc)
+	<-h.httpdonec
+	transport.Stop()
+}
+
+// stop stops the raft group and waits until the committed entries are applied
+func (r *hostRegion) stop() {
+	close(r.proposeC)
+	close(r.confChangeC)
+	<-r.db.stopc
+}
+
+// groupID returns the raft group ID of the region.
+// All hosts derive the same ID from the region name.
+// The region whose ID is taken by another region fails to be added.
+var groupID = func(region string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(region))
+	return h.Sum64()
+}
+
+// logRegionPrefix is the prefix of the regions which keep the raft logs.
+// It must not be used by the region of DB.
+const logRegionPrefix = "raftlog-"
+
+// logRegionName returns the name of the region which keeps the raft log of the region
+func logRegionName(region string) string {
+	return logRegionPrefix + region
+}
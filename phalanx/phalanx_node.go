@@ -2,11 +2,15 @@ package phalanx
 
 import (
 	"context"
-	"log"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/etcdserver/stats"
@@ -18,40 +22,159 @@ import (
 	"github.com/coreos/etcd/snap"
 	"github.com/coreos/etcd/wal"
 	"github.com/coreos/etcd/wal/walpb"
+	"golang.org/x/xerrors"
 )
 
+// Node is a handle of a phalanx node
+type Node interface {
+	// Start starts the node created by NewNodeFromConfig.
+	// The nodes created by the other constructors are started on creation.
+	Start() error
+	// Stop stops the node and waits until it is stopped or ctx is done.
+	// The commit channel and the error channel are closed when the node is stopped.
+	Stop(ctx context.Context) error
+	// Done returns a channel which is closed when the node is stopped
+	Done() <-chan struct{}
+	// ReadIndex returns the commit index of the raft group confirmed by the leader.
+	// Once the state machine applies entries up to the index,
+	// reading it is linearizable.
+	ReadIndex(ctx context.Context) (uint64, error)
+	// LeaseReadIndex returns the commit index of the leader without a round trip
+	// while this member is the leader holding a valid lease.
+	// Otherwise it falls back to ReadIndex.
+	LeaseReadIndex(ctx context.Context) (uint64, error)
+	// Propose proposes data to the raft group.
+	// It blocks until raft accepts the proposal or ctx is done.
+	Propose(ctx context.Context, data []byte) error
+	// ProposeConfChange proposes the conf change to the raft group.
+	// It blocks until raft accepts the proposal or ctx is done.
+	ProposeConfChange(ctx context.Context, cc raftpb.ConfChange) error
+	// ID returns the member ID of this node
+	ID() uint64
+	// Members returns the members of the raft group and their peer URLs
+	Members() []Member
+	// Status returns the status of the raft node and its peers
+	Status() Status
+	// TransferLeadership transfers the leadership to the member
+	// and waits until this member knows the member as the leader.
+	TransferLeadership(ctx context.Context, target uint64) error
+	// Drain transfers the leadership to the most up-to-date follower
+	// if this member is the leader, and waits until it takes effect.
+	Drain(ctx context.Context) error
+	// Promote promotes the learner to a voter once it is within maxLag entries
+	// of the commit index, and waits until the promotion is applied on this member.
+	// It is called on the leader, which knows the progress of the learner.
+	Promote(ctx context.Context, id uint64, maxLag uint64) error
+	// LeaderChangedNotify returns a channel which is closed when the known leader changes
+	LeaderChangedNotify() <-chan struct{}
+	// Err returns the error which stopped the node, or nil.
+	// The error is also sent on the error channel.
+	Err() error
+}
+
+// Commit is a committed raft entry published to the commit channel.
+// Every entry is published in log order, so the client can track the applied index.
+type Commit struct {
+	Index uint64 // raft index of the entry
+	Term  uint64 // raft term of the entry
+	Data  []byte // proposed data, or nil for empty entries and conf changes
+	// Members is the members after the conf change, or nil for other entries
+	Members []Member
+	// EndOfReady is set on the last entry committed in a raft Ready
+	EndOfReady bool
+}
+
 // A key-value stream backed by raft
 type phalanxNode struct {
 	proposeC    <-chan []byte            // proposed messages (k,v)
 	confChangeC <-chan raftpb.ConfChange // proposed cluster config changes
-	commitC     chan<- []byte            // entries committed to log (k,v)
+	commitC     chan<- *Commit           // entries committed to log (k,v)
 	errorC      chan<- error             // errors from raft session
 
-	id          int      // client ID for raft session
-	peers       []string // raft peer URLs
-	join        bool     // node is joining an existing cluster
-	waldir      string   // path to WAL directory
-	snapdir     string   // path to snapshot directory
-	getSnapshot func() ([]byte, error)
-	lastIndex   uint64 // index of log at start
+	id           int      // index of this member in peers, starting from 1
+	peers        []string // raft peers given as name=URL or URL
+	members      []member // members parsed from peers
+	self         member   // member of this node
+	clusterID    uint64   // cluster ID persisted with the raft log, or zero until it is known
+	clusterToken string   // mixed into the cluster ID of a bootstrapping node
+	join         bool     // node is joining an existing cluster
+	waldir       string   // path to WAL directory
+	snapdir      string   // path to snapshot directory
+	getSnapshot  func() ([]byte, error)
+	// captureSnapshot captures the state for a snapshot instead of getSnapshot if set
+	captureSnapshot func() (func() ([]byte, error), error)
+	lastIndex       uint64 // index of log at start
+
+	checkpointerMu sync.RWMutex
+	checkpointer   checkpointer // streams snapshots instead of getSnapshot if set
+
+	membership *membership // registry of the members and their peer URLs
 
 	confState     raftpb.ConfState
-	snapshotIndex uint64
-	appliedIndex  uint64
+	snapshotIndex uint64 // written atomically to be read by Status
+	appliedIndex  uint64 // written atomically to be read by Status
 
 	// raft backing for the commit/error channel
-	node        raft.Node
-	raftStorage *raft.MemoryStorage
-	wal         *wal.WAL
+	node     raft.Node
+	logStore LogStore
 
 	snapshotter      *snap.Snapshotter
 	snapshotterReady chan *snap.Snapshotter // signals when snapshotter is ready
 
-	snapCount uint64
-	transport *rafthttp.Transport
-	stopc     chan struct{} // signals proposal channel closed
-	httpstopc chan struct{} // signals http server to shutdown
-	httpdonec chan struct{} // signals http server shutdown complete
+	readMu        sync.Mutex
+	readRequestID uint64
+	readWaiters   map[uint64]chan uint64 // read index requests waiting for ReadState
+
+	leaderMu       sync.RWMutex
+	lead           uint64
+	leaderChangedC chan struct{} // closed when the known leader changes
+
+	// raft timing and snapshot thresholds
+	tickInterval           time.Duration
+	electionTick           int
+	heartbeatTick          int
+	maxSizePerMsg          uint64
+	maxInflightMsgs        int
+	snapCount              uint64
+	snapshotCatchUpEntries uint64
+
+	// the committed entries are applied in background through the queue
+	applyc            chan *applyJob
+	applyQueueSize    int
+	applyQueueWaits   uint64 // written atomically to be read by Status
+	applyQueueBlocked int64  // nanoseconds, written atomically to be read by Status
+
+	snapshotting int32 // 1 while a snapshot is created in background
+	snapshotWg   sync.WaitGroup
+
+	// the old snapshot and WAL files are purged in background
+	maxSnapshots  int
+	purgeInterval time.Duration
+
+	metrics    *nodeMetrics // nil if the metrics are not collected
+	logger     Logger       // logs with the member ID and the region
+	baseLogger Logger       // logger without the member ID and the region
+	region     string       // region of the node, or empty if it is not known
+
+	transport     raftTransport
+	httpTransport *rafthttp.Transport // nil if the transport is shared with other raft groups
+	peerTLS       *PeerTLSInfo        // nil if peers communicate in plain HTTP
+	startc        chan struct{}       // signals raft node started
+	identityc     chan struct{}       // signals the member ID does not change any more
+	identityOnce  sync.Once
+	stopc         chan struct{} // signals proposal channel closed
+	stoppingc     chan struct{} // signals Stop is called
+	failc         chan struct{} // signals node failed
+	donec         chan struct{} // signals node stopped
+	httpstopc     chan struct{} // signals http server to shutdown
+	httpdonec     chan struct{} // signals http server shutdown complete
+
+	failOnce sync.Once
+	err      error // error which stopped the node, set before failc is closed
+
+	lifecycleMu sync.Mutex
+	started     bool // Start or Stop is called
+	stopOnce    sync.Once
 }
 
 // NewNode creates new phalanx node
@@ -65,12 +188,104 @@ func NewNode(
 	walDir string,
 	snapDir string,
 ) (
-	chan []byte,
+	Node,
+	chan *Commit,
 	chan error,
 	chan *snap.Snapshotter,
 ) {
-	commitC := make(chan []byte)
-	errorC := make(chan error)
+	return newNode(id, peers, join, getSnapshot, proposeC, confChangeC, walDir, nil, snapDir, nil)
+}
+
+// NewNodeWithTLS creates new phalanx node
+// whose peers communicate over mutual TLS.
+// The peer URLs must be https.
+func NewNodeWithTLS(
+	id int,
+	peers []string,
+	join bool,
+	getSnapshot func() ([]byte, error),
+	proposeC <-chan []byte,
+	confChangeC <-chan raftpb.ConfChange,
+	walDir string,
+	snapDir string,
+	peerTLS PeerTLSInfo,
+) (
+	Node,
+	chan *Commit,
+	chan error,
+	chan *snap.Snapshotter,
+) {
+	return newNode(id, peers, join, getSnapshot, proposeC, confChangeC, walDir, nil, snapDir, &peerTLS)
+}
+
+// NewNodeWithLogStore creates new phalanx node
+// whose raft log is kept in the given LogStore instead of WAL
+func NewNodeWithLogStore(
+	id int,
+	peers []string,
+	join bool,
+	getSnapshot func() ([]byte, error),
+	proposeC <-chan []byte,
+	confChangeC <-chan raftpb.ConfChange,
+	logStore LogStore,
+	snapDir string,
+) (
+	Node,
+	chan *Commit,
+	chan error,
+	chan *snap.Snapshotter,
+) {
+	return newNode(id, peers, join, getSnapshot, proposeC, confChangeC, "", logStore, snapDir, nil)
+}
+
+func newNode(
+	id int,
+	peers []string,
+	join bool,
+	getSnapshot func() ([]byte, error),
+	proposeC <-chan []byte,
+	confChangeC <-chan raftpb.ConfChange,
+	walDir string,
+	logStore LogStore,
+	snapDir string,
+	peerTLS *PeerTLSInfo,
+) (
+	Node,
+	chan *Commit,
+	chan error,
+	chan *snap.Snapshotter,
+) {
+	rc, commitC, errorC := newPhalanxNode(id, peers, join, getSnapshot, proposeC, confChangeC, walDir, logStore, snapDir)
+	rc.peerTLS = peerTLS
+	rc.Start()
+	return rc, commitC, errorC, rc.snapshotterReady
+}
+
+// newPhalanxNode creates a phalanx node which is not started yet
+func newPhalanxNode(
+	id int,
+	peers []string,
+	join bool,
+	getSnapshot func() ([]byte, error),
+	proposeC <-chan []byte,
+	confChangeC <-chan raftpb.ConfChange,
+	walDir string,
+	logStore LogStore,
+	snapDir string,
+) (
+	*phalanxNode,
+	chan *Commit,
+	chan error,
+) {
+	commitC := make(chan *Commit)
+	// the error is sent even if the client stopped reading the channels
+	errorC := make(chan error, 1)
+
+	members, err := parsePeers(peers)
+	var self member
+	if err == nil {
+		self, err = selfMember(members, id)
+	}
 
 	rc := &phalanxNode{
 		proposeC:    proposeC,
@@ -79,95 +294,120 @@ func NewNode(
 		errorC:      errorC,
 		id:          id,
 		peers:       peers,
+		members:     members,
+		self:        self,
+		membership:  newMembership(self, members),
 		join:        join,
 		waldir:      walDir,
+		logStore:    logStore,
 		snapdir:     snapDir,
 		getSnapshot: getSnapshot,
-		snapCount:   defaultSnapshotCount,
+		startc:      make(chan struct{}),
+		identityc:   make(chan struct{}),
 		stopc:       make(chan struct{}),
+		stoppingc:   make(chan struct{}),
+		failc:       make(chan struct{}),
+		donec:       make(chan struct{}),
 		httpstopc:   make(chan struct{}),
 		httpdonec:   make(chan struct{}),
 
+		tickInterval:           defaultTickInterval,
+		electionTick:           defaultElectionTick,
+		heartbeatTick:          defaultHeartbeatTick,
+		maxSizePerMsg:          defaultMaxSizePerMsg,
+		maxInflightMsgs:        defaultMaxInflightMsgs,
+		snapCount:              defaultSnapshotCount,
+		snapshotCatchUpEntries: snapshotCatchUpEntriesN,
+		applyQueueSize:         defaultApplyQueueSize,
+		maxSnapshots:           defaultMaxSnapshots,
+		purgeInterval:          defaultPurgeInterval,
+
+		logger:           defaultLogger.With(nodeIDField(self.id)),
+		baseLogger:       defaultLogger,
+		snapshotter:      snap.New(snapDir),
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
+		readWaiters:      make(map[uint64]chan uint64),
+		leaderChangedC:   make(chan struct{}),
 		// rest of structure populated after WAL replay
 
 	}
-	go rc.startRaft()
-	return commitC, errorC, rc.snapshotterReady
+	if err != nil {
+		// the node fails to start
+		rc.fail(xerrors.Errorf("phalanxNode: invalid peers: %w", err))
+	}
+	return rc, commitC, errorC
 }
 
 var defaultSnapshotCount uint64 = 10000
 
-func (rc *phalanxNode) saveSnap(snap raftpb.Snapshot) error {
-	// must save the snapshot index to the WAL before saving the
-	// snapshot to maintain the invariant that we only Open the
-	// wal at previously-saved snapshot indexes.
-	walSnap := walpb.Snapshot{
-		Index: snap.Metadata.Index,
-		Term:  snap.Metadata.Term,
-	}
-	if err := rc.wal.SaveSnapshot(walSnap); err != nil {
-		return err
-	}
-	if err := rc.snapshotter.SaveSnap(snap); err != nil {
-		return err
-	}
-	return rc.wal.ReleaseLockTo(snap.Metadata.Index)
-}
-
-func (rc *phalanxNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
+func (rc *phalanxNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry, err error) {
 	if len(ents) == 0 {
-		return ents
+		return ents, nil
 	}
 	firstIdx := ents[0].Index
 	if firstIdx > rc.appliedIndex+1 {
-		log.Fatalf(
-			"first index of committed entry[%d] should <= progress.appliedIndex[%d]+1",
+		return nil, xerrors.Errorf(
+			"phalanxNode: first index of committed entry[%d] should <= progress.appliedIndex[%d]+1",
 			firstIdx, rc.appliedIndex)
 	}
 	if rc.appliedIndex-firstIdx+1 < uint64(len(ents)) {
 		nents = ents[rc.appliedIndex-firstIdx+1:]
 	}
-	return nents
+	return nents, nil
 }
 
 // publishEntries writes committed log entries to commit channel and returns
 // whether all entries could be published.
 func (rc *phalanxNode) publishEntries(ents []raftpb.Entry) bool {
 	for i := range ents {
+		var data []byte
+		var members []Member
 		switch ents[i].Type {
 		case raftpb.EntryNormal:
 			if len(ents[i].Data) == 0 {
-				// ignore empty messages
+				// publish empty messages without data
 				break
 			}
-			s := ents[i].Data
-			select {
-			case rc.commitC <- s:
-			case <-rc.stopc:
-				return false
-			}
+			data = ents[i].Data
 
 		case raftpb.EntryConfChange:
 			var cc raftpb.ConfChange
 			cc.Unmarshal(ents[i].Data)
 			rc.confState = *rc.node.ApplyConfChange(cc)
 			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
+			case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+				mem := Member{ID: cc.NodeID, IsLearner: cc.Type == raftpb.ConfChangeAddLearnerNode}
 				if len(cc.Context) > 0 {
-					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
+					mem.URLs = []string{string(cc.Context)}
 				}
+				rc.membership.add(ents[i].Index, mem)
 			case raftpb.ConfChangeRemoveNode:
-				if cc.NodeID == uint64(rc.id) {
-					log.Println("I've been removed from the cluster! Shutting down.")
+				if cc.NodeID == rc.self.id {
+					rc.logger.Info("removed from the cluster, shutting down")
 					return false
 				}
-				rc.transport.RemovePeer(types.ID(cc.NodeID))
+				rc.membership.remove(ents[i].Index, cc.NodeID)
 			}
+			members = rc.membership.list()
+		}
+
+		commit := &Commit{
+			Index:      ents[i].Index,
+			Term:       ents[i].Term,
+			Data:       data,
+			Members:    members,
+			EndOfReady: i == len(ents)-1,
+		}
+		select {
+		case rc.commitC <- commit:
+		case <-rc.stopc:
+			return false
+		case <-rc.failc:
+			return false
 		}
 
 		// after commit, update appliedIndex
-		rc.appliedIndex = ents[i].Index
+		atomic.StoreUint64(&rc.appliedIndex, ents[i].Index)
 
 		// special nil commit to signal replay has finished
 		if ents[i].Index == rc.lastIndex {
@@ -175,30 +415,36 @@ func (rc *phalanxNode) publishEntries(ents []raftpb.Entry) bool {
 			case rc.commitC <- nil:
 			case <-rc.stopc:
 				return false
+			case <-rc.failc:
+				return false
 			}
 		}
 	}
 	return true
 }
 
-func (rc *phalanxNode) loadSnapshot() *raftpb.Snapshot {
+func (rc *phalanxNode) loadSnapshot() (*raftpb.Snapshot, error) {
 	snapshot, err := rc.snapshotter.Load()
 	if err != nil && err != snap.ErrNoSnapshot {
-		log.Fatalf("phalanxNode: error loading snapshot (%v)", err)
+		return nil, xerrors.Errorf("phalanxNode: error loading snapshot: %w", err)
 	}
-	return snapshot
+	return snapshot, nil
 }
 
 // openWAL returns a WAL ready for reading.
-func (rc *phalanxNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
+func (rc *phalanxNode) openWAL(snapshot *raftpb.Snapshot) (*wal.WAL, error) {
 	if !wal.Exist(rc.waldir) {
 		if err := os.Mkdir(rc.waldir, 0750); err != nil {
-			log.Fatalf("phalanxNode: cannot create dir for wal (%v)", err)
+			return nil, xerrors.Errorf("phalanxNode: cannot create dir for wal: %w", err)
 		}
 
-		w, err := wal.Create(rc.waldir, nil)
+		identity, err := rc.newClusterIdentity()
 		if err != nil {
-			log.Fatalf("phalanxNode: create wal error (%v)", err)
+			return nil, err
+		}
+		w, err := wal.Create(rc.waldir, identity.marshal())
+		if err != nil {
+			return nil, xerrors.Errorf("phalanxNode: create wal error: %w", err)
 		}
 		w.Close()
 	}
@@ -207,75 +453,263 @@ func (rc *phalanxNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 	if snapshot != nil {
 		walsnap.Index, walsnap.Term = snapshot.Metadata.Index, snapshot.Metadata.Term
 	}
-	log.Printf("loading WAL at term %d and index %d", walsnap.Term, walsnap.Index)
+	rc.logger.Info("loading WAL", termField(walsnap.Term), indexField(walsnap.Index))
 	w, err := wal.Open(rc.waldir, walsnap)
 	if err != nil {
-		log.Fatalf("phalanxNode: error loading wal (%v)", err)
+		return nil, xerrors.Errorf("phalanxNode: error loading wal: %w", err)
 	}
 
-	return w
+	return w, nil
 }
 
 // replayWAL replays WAL entries into the raft instance.
-func (rc *phalanxNode) replayWAL() *wal.WAL {
-	log.Printf("replaying WAL of member %d", rc.id)
-	snapshot := rc.loadSnapshot()
-	w := rc.openWAL(snapshot)
-	_, st, ents, err := w.ReadAll()
+func (rc *phalanxNode) replayWAL() (*walLogStore, error) {
+	rc.logger.Info("replaying WAL")
+	snapshot, err := rc.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	w, err := rc.openWAL(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	metadata, st, ents, err := w.ReadAll()
 	if err != nil {
-		log.Fatalf("phalanxNode: failed to read WAL (%v)", err)
+		w.Close()
+		return nil, xerrors.Errorf("phalanxNode: failed to read WAL: %w", err)
+	}
+	if err := rc.checkClusterIdentity(metadata); err != nil {
+		w.Close()
+		return nil, xerrors.Errorf("phalanxNode: refused to start: %w", err)
+	}
+	// the membership is restored after the identity which may change the member IDs
+	if snapshot != nil {
+		if err := rc.restoreMembership(*snapshot); err != nil {
+			w.Close()
+			return nil, err
+		}
 	}
-	rc.raftStorage = raft.NewMemoryStorage()
+	raftStorage := raft.NewMemoryStorage()
 	if snapshot != nil {
-		rc.raftStorage.ApplySnapshot(*snapshot)
+		raftStorage.ApplySnapshot(*snapshot)
 	}
-	rc.raftStorage.SetHardState(st)
+	raftStorage.SetHardState(st)
 
 	// append to storage so raft starts at the right place in log
-	rc.raftStorage.Append(ents)
+	raftStorage.Append(ents)
+	return &walLogStore{
+		MemoryStorage: raftStorage,
+		wal:           w,
+		hardState:     st,
+		metrics:       rc.metrics,
+	}, nil
+}
+
+// replayLog sets lastIndex to the last entry of the log
+// which is published again after restart.
+// A bootstrapping node publishes the conf changes of the initial peers first.
+func (rc *phalanxNode) replayLog(bootstrap bool) error {
+	firstIndex, err := rc.logStore.FirstIndex()
+	if err != nil {
+		return xerrors.Errorf("phalanxNode: failed to read first index: %w", err)
+	}
+	lastIndex, err := rc.logStore.LastIndex()
+	if err != nil {
+		return xerrors.Errorf("phalanxNode: failed to read last index: %w", err)
+	}
 	// send nil once lastIndex is published so client knows commit channel is current
-	if len(ents) > 0 {
-		rc.lastIndex = ents[len(ents)-1].Index
+	if lastIndex >= firstIndex {
+		rc.lastIndex = lastIndex
+	} else if bootstrap {
+		rc.lastIndex = uint64(len(rc.members))
 	} else {
-		rc.commitC <- nil
+		select {
+		case rc.commitC <- nil:
+		case <-rc.failc:
+			return rc.Err()
+		}
+	}
+	return nil
+}
+
+// hasLogState returns if the log store has the state of a previous run
+func (rc *phalanxNode) hasLogState() (bool, error) {
+	st, _, err := rc.logStore.InitialState()
+	if err != nil {
+		return false, xerrors.Errorf("phalanxNode: failed to read initial state: %w", err)
+	}
+	return !raft.IsEmptyHardState(st), nil
+}
+
+// setLogger makes the node log to the logger with its member ID and the region
+func (rc *phalanxNode) setLogger(logger Logger, region string) {
+	rc.region = region
+	rc.baseLogger = logger
+	rc.logger = logger.With(nodeIDField(rc.self.id))
+	if region != "" {
+		rc.logger = rc.logger.With(regionField(region))
+	}
+}
+
+// fail records the error which stops the node.
+// Only the first error is kept.
+func (rc *phalanxNode) fail(err error) {
+	rc.failOnce.Do(func() {
+		rc.logger.Error("stopping member", errorField(err))
+		rc.err = &ErrNodeFailed{Err: err}
+		close(rc.failc)
+	})
+}
+
+// Err returns the error which stopped the node, or nil
+func (rc *phalanxNode) Err() error {
+	select {
+	case <-rc.failc:
+		return rc.err
+	default:
+		return nil
 	}
-	return w
 }
 
 func (rc *phalanxNode) writeError(err error) {
-	rc.stopHTTP()
-	close(rc.commitC)
-	rc.errorC <- err
-	close(rc.errorC)
-	rc.node.Stop()
+	rc.fail(err)
+	rc.stop()
+}
+
+// waitStarted waits until raft is started
+func (rc *phalanxNode) waitStarted(ctx context.Context) error {
+	select {
+	case <-rc.startc:
+		return nil
+	case <-rc.failc:
+		return rc.Err()
+	case <-rc.donec:
+		return ErrNodeStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start starts the raft node in background.
+// The failure to start is reported by Err and the error channel.
+func (rc *phalanxNode) Start() error {
+	rc.lifecycleMu.Lock()
+	defer rc.lifecycleMu.Unlock()
+	if rc.started {
+		return xerrors.New("phalanxNode: node is already started or stopped")
+	}
+	rc.started = true
+	go rc.startRaft()
+	return nil
+}
+
+// Stop stops the node and waits until it is stopped or ctx is done
+func (rc *phalanxNode) Stop(ctx context.Context) error {
+	rc.lifecycleMu.Lock()
+	if !rc.started {
+		// the node is never started
+		rc.started = true
+		rc.abortStart()
+	}
+	rc.lifecycleMu.Unlock()
+
+	rc.stopOnce.Do(func() { close(rc.stoppingc) })
+	select {
+	case <-rc.donec:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel which is closed when the node is stopped
+func (rc *phalanxNode) Done() <-chan struct{} {
+	return rc.donec
 }
 
 func (rc *phalanxNode) startRaft() {
-	if !fileutil.Exist(rc.snapdir) {
-		if err := os.Mkdir(rc.snapdir, 0750); err != nil {
-			log.Fatalf("phalanxNode: cannot create dir for snapshot (%v)", err)
+	err := rc.Err()
+	if err == nil && !fileutil.Exist(rc.snapdir) {
+		if err = os.Mkdir(rc.snapdir, 0750); err != nil {
+			err = xerrors.Errorf("phalanxNode: cannot create dir for snapshot: %w", err)
 		}
 	}
-	rc.snapshotter = snap.New(rc.snapdir)
+	// the client waits for the snapshotter even if the node fails to start
 	rc.snapshotterReady <- rc.snapshotter
 
-	oldwal := wal.Exist(rc.waldir)
-	rc.wal = rc.replayWAL()
+	if err == nil {
+		err = rc.initRaft()
+	}
+	if err != nil {
+		select {
+		case <-rc.stoppingc:
+			// the node is stopped while starting
+		default:
+			rc.fail(err)
+		}
+		rc.abortStart()
+		return
+	}
+
+	if rc.httpTransport != nil {
+		go rc.serveRaft()
+	}
+	go rc.serveChannels()
+}
+
+// initRaft replays the raft log and starts the raft node and the transport
+func (rc *phalanxNode) initRaft() error {
+	var oldlog bool
+	if rc.logStore == nil {
+		oldlog = wal.Exist(rc.waldir)
+		logStore, err := rc.replayWAL()
+		if err != nil {
+			return err
+		}
+		rc.logStore = logStore
+	} else {
+		var err error
+		if oldlog, err = rc.hasLogState(); err != nil {
+			return err
+		}
+		snapshot, err := rc.logStore.Snapshot()
+		if err != nil {
+			return xerrors.Errorf("phalanxNode: failed to read snapshot: %w", err)
+		}
+		if err := rc.loadClusterIdentity(oldlog); err != nil {
+			return xerrors.Errorf("phalanxNode: refused to start: %w", err)
+		}
+		if err := rc.restoreMembership(snapshot); err != nil {
+			return err
+		}
+	}
+	// the log is published to the client waiting for the member ID
+	rc.knowIdentity()
+	if err := rc.replayLog(!oldlog && !rc.join); err != nil {
+		return err
+	}
+
+	rc.applyc = make(chan *applyJob, rc.applyQueueSize)
 
-	rpeers := make([]raft.Peer, len(rc.peers))
-	for i := range rpeers {
-		rpeers[i] = raft.Peer{ID: uint64(i + 1)}
+	rpeers := make([]raft.Peer, len(rc.members))
+	for i, m := range rc.members {
+		rpeers[i] = raft.Peer{ID: m.id}
 	}
 	c := &raft.Config{
-		ID:              uint64(rc.id),
-		ElectionTick:    10,
-		HeartbeatTick:   1,
-		Storage:         rc.raftStorage,
-		MaxSizePerMsg:   1024 * 1024,
-		MaxInflightMsgs: 256,
+		ID:              rc.self.id,
+		ElectionTick:    rc.electionTick,
+		HeartbeatTick:   rc.heartbeatTick,
+		Storage:         rc.logStore,
+		MaxSizePerMsg:   rc.maxSizePerMsg,
+		MaxInflightMsgs: rc.maxInflightMsgs,
+		// the leader steps down when it loses the quorum,
+		// so it can serve reads by its lease
+		CheckQuorum:    true,
+		ReadOnlyOption: raft.ReadOnlyLeaseBased,
+		Logger:         &raftLogger{logger: rc.logger},
 	}
 
-	if oldwal {
+	if oldlog {
 		rc.node = raft.RestartNode(c)
 	} else {
 		startPeers := rpeers
@@ -284,109 +718,282 @@ func (rc *phalanxNode) startRaft() {
 		}
 		rc.node = raft.StartNode(c, startPeers)
 	}
+	close(rc.startc)
 
-	rc.transport = &rafthttp.Transport{
-		ID:          types.ID(rc.id),
-		ClusterID:   0x1000,
-		Raft:        rc,
-		ServerStats: stats.NewServerStats("", ""),
-		LeaderStats: stats.NewLeaderStats(strconv.Itoa(rc.id)),
-		ErrorC:      make(chan error),
+	if rc.transport == nil {
+		rc.httpTransport = &rafthttp.Transport{
+			ID:          types.ID(rc.self.id),
+			ClusterID:   types.ID(rc.clusterID),
+			Raft:        rc,
+			ServerStats: stats.NewServerStats("", ""),
+			LeaderStats: stats.NewLeaderStats(types.ID(rc.self.id).String()),
+			ErrorC:      make(chan error),
+			Snapshotter: rc.snapshotter,
+		}
+		rc.transport = rc.httpTransport
+		if rc.peerTLS != nil {
+			rc.transport = newTLSTransport(rc.httpTransport, rc.peerTLS, rc.logger)
+		}
 	}
 
-	rc.transport.Start()
-	for i := range rc.peers {
-		if i+1 != rc.id {
-			rc.transport.AddPeer(types.ID(i+1), []string{rc.peers[i]})
-		}
+	if err := rc.transport.Start(); err != nil {
+		return xerrors.Errorf("phalanxNode: failed to start transport: %w", err)
 	}
+	rc.membership.start(rc.transport)
+	return nil
+}
 
-	go rc.serveRaft()
-	go rc.serveChannels()
+// abortStart closes all channels and releases the log of a node which failed to start
+func (rc *phalanxNode) abortStart() {
+	rc.knowIdentity()
+	if rc.logStore != nil {
+		rc.logStore.Close()
+	}
+	close(rc.commitC)
+	if err := rc.Err(); err != nil {
+		rc.errorC <- err
+	}
+	close(rc.errorC)
+	if rc.node != nil {
+		rc.node.Stop()
+	}
+	close(rc.donec)
 }
 
 // stop closes http, closes all channels, and stops raft.
+// The error of a failed node is sent before the error channel is closed.
 func (rc *phalanxNode) stop() {
 	rc.stopHTTP()
 	close(rc.commitC)
+	if err := rc.Err(); err != nil {
+		rc.errorC <- err
+	}
 	close(rc.errorC)
 	rc.node.Stop()
 }
 
 func (rc *phalanxNode) stopHTTP() {
 	rc.transport.Stop()
+	if rc.httpTransport == nil {
+		// the shared transport is stopped by its owner
+		return
+	}
 	close(rc.httpstopc)
 	<-rc.httpdonec
 }
 
-func (rc *phalanxNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
+func (rc *phalanxNode) publishSnapshot(snapshotToSave raftpb.Snapshot) error {
 	if raft.IsEmptySnap(snapshotToSave) {
-		return
+		return nil
 	}
 
-	log.Printf("publishing snapshot at index %d", rc.snapshotIndex)
-	defer log.Printf("finished publishing snapshot at index %d", rc.snapshotIndex)
+	rc.logger.Info("publishing snapshot",
+		termField(snapshotToSave.Metadata.Term), indexField(snapshotToSave.Metadata.Index))
+	defer rc.logger.Info("finished publishing snapshot",
+		termField(snapshotToSave.Metadata.Term), indexField(snapshotToSave.Metadata.Index))
 
 	if snapshotToSave.Metadata.Index <= rc.appliedIndex {
-		log.Fatalf("snapshot index [%d] should > progress.appliedIndex [%d]", snapshotToSave.Metadata.Index, rc.appliedIndex)
+		return xerrors.Errorf(
+			"phalanxNode: snapshot index [%d] should > progress.appliedIndex [%d]",
+			snapshotToSave.Metadata.Index, rc.appliedIndex)
+	}
+	// trigger kvstore to load snapshot
+	select {
+	case rc.commitC <- nil:
+	case <-rc.stopc:
+		return ErrNodeStopped
+	case <-rc.failc:
+		return rc.Err()
 	}
-	rc.commitC <- nil // trigger kvstore to load snapshot
 
+	if err := rc.restoreMembership(snapshotToSave); err != nil {
+		return err
+	}
 	rc.confState = snapshotToSave.Metadata.ConfState
-	rc.snapshotIndex = snapshotToSave.Metadata.Index
-	rc.appliedIndex = snapshotToSave.Metadata.Index
+	storeMaxUint64(&rc.snapshotIndex, snapshotToSave.Metadata.Index)
+	atomic.StoreUint64(&rc.appliedIndex, snapshotToSave.Metadata.Index)
+	return nil
 }
 
 var snapshotCatchUpEntriesN uint64 = 10000
 
-func (rc *phalanxNode) maybeTriggerSnapshot() {
-	if rc.appliedIndex-rc.snapshotIndex <= rc.snapCount {
+// snapshotJob is the state of the applied entries captured for a snapshot
+type snapshotJob struct {
+	index     uint64
+	confState raftpb.ConfState
+	members   []Member
+	// serialize returns the data of the state captured at the index,
+	// or nil if the checkpointer keeps the state
+	serialize func() ([]byte, error)
+}
+
+// maybeTriggerSnapshot starts a snapshot in background
+// if enough entries are applied since the last snapshot.
+// Only one snapshot is created at a time.
+func (rc *phalanxNode) maybeTriggerSnapshot(ctx context.Context) {
+	if rc.appliedIndex-atomic.LoadUint64(&rc.snapshotIndex) <= rc.snapCount {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&rc.snapshotting, 0, 1) {
 		return
 	}
+	job := snapshotJob{
+		index:     rc.appliedIndex,
+		confState: rc.confState,
+		members:   rc.membership.list(),
+	}
+	if rc.getCheckpointer() == nil {
+		// the state moves on once the raft loop returns to the apply loop
+		serialize, err := rc.snapshotState()
+		if err != nil {
+			atomic.StoreInt32(&rc.snapshotting, 0)
+			rc.fail(xerrors.Errorf("phalanxNode: failed to get snapshot: %w", err))
+			return
+		}
+		job.serialize = serialize
+	}
+	rc.snapshotWg.Add(1)
+	go func() {
+		defer rc.snapshotWg.Done()
+		defer atomic.StoreInt32(&rc.snapshotting, 0)
+		if err := rc.createSnapshot(ctx, job); err != nil {
+			rc.fail(err)
+		}
+	}()
+}
 
-	log.Printf("start snapshot [applied index: %d | last snapshot index: %d]", rc.appliedIndex, rc.snapshotIndex)
+// snapshotState captures the state of the application for a snapshot
+// and returns the function which serializes it
+func (rc *phalanxNode) snapshotState() (func() ([]byte, error), error) {
+	if rc.captureSnapshot != nil {
+		return rc.captureSnapshot()
+	}
 	data, err := rc.getSnapshot()
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+	return func() ([]byte, error) { return data, nil }, nil
+}
+
+// createSnapshot serializes the state at the index of the job,
+// and registers the snapshot with the log store and the snapshotter once it is complete
+func (rc *phalanxNode) createSnapshot(ctx context.Context, job snapshotJob) error {
+	rc.logger.Info("start snapshot", indexField(job.index),
+		Field{Key: "last-snapshot-index", Value: atomic.LoadUint64(&rc.snapshotIndex)})
+	start := time.Now()
+	var data []byte
+	var size int64 // bytes of the state written for the snapshot
+	if job.serialize != nil {
+		var err error
+		data, err = job.serialize()
+		if err != nil {
+			return xerrors.Errorf("phalanxNode: failed to get snapshot: %w", err)
+		}
+		size = int64(len(data))
+	} else if cp := rc.getCheckpointer(); cp != nil {
+		// the stable store keeps the state, so the snapshot has no data
+		if err := cp.waitApplied(ctx, job.index); err != nil {
+			rc.logger.Warn("skip snapshot", indexField(job.index), errorField(err))
+			return nil
+		}
+		written, err := cp.saveCheckpoint()
+		if err != nil {
+			// the checkpoint is saved again when a follower needs it
+			rc.logger.Warn("failed to save checkpoint", indexField(job.index), errorField(err))
+		}
+		size = written
 	}
-	snap, err := rc.raftStorage.CreateSnapshot(rc.appliedIndex, &rc.confState, data)
+	data, err := encodeSnapshotData(job.members, data)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	snap, err := rc.logStore.CreateSnapshot(job.index, &job.confState, data)
+	if err == raft.ErrSnapOutOfDate {
+		// the snapshot of the leader is saved by the raft loop
+		rc.logger.Info("skip snapshot", indexField(job.index), errorField(err))
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("phalanxNode: failed to create snapshot: %w", err)
 	}
-	if err := rc.saveSnap(snap); err != nil {
-		panic(err)
+	if err := rc.snapshotter.SaveSnap(snap); err != nil {
+		return xerrors.Errorf("phalanxNode: failed to save snapshot: %w", err)
 	}
 
 	compactIndex := uint64(1)
-	if rc.appliedIndex > snapshotCatchUpEntriesN {
-		compactIndex = rc.appliedIndex - snapshotCatchUpEntriesN
+	if job.index > rc.snapshotCatchUpEntries {
+		compactIndex = job.index - rc.snapshotCatchUpEntries
 	}
-	if err := rc.raftStorage.Compact(compactIndex); err != nil {
-		panic(err)
+	if err := rc.logStore.Compact(compactIndex); err == raft.ErrCompacted {
+		rc.logger.Info("log is already compacted", indexField(compactIndex))
+	} else if err != nil {
+		return xerrors.Errorf("phalanxNode: failed to compact log: %w", err)
+	} else {
+		rc.logger.Info("compacted log", indexField(compactIndex))
 	}
+	storeMaxUint64(&rc.snapshotIndex, job.index)
+	rc.metrics.observeSnapshot(start, size)
+	return nil
+}
 
-	log.Printf("compacted log at index %d", compactIndex)
-	rc.snapshotIndex = rc.appliedIndex
+// storeMaxUint64 stores v to addr atomically unless addr has a larger value
+func storeMaxUint64(addr *uint64, v uint64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if old >= v || atomic.CompareAndSwapUint64(addr, old, v) {
+			return
+		}
+	}
 }
 
 func (rc *phalanxNode) serveChannels() {
-	snap, err := rc.raftStorage.Snapshot()
+	defer close(rc.donec)
+	defer rc.logStore.Close()
+
+	snap, err := rc.logStore.Snapshot()
 	if err != nil {
-		panic(err)
+		rc.writeError(xerrors.Errorf("phalanxNode: failed to read snapshot: %w", err))
+		return
 	}
 	rc.confState = snap.Metadata.ConfState
-	rc.snapshotIndex = snap.Metadata.Index
-	rc.appliedIndex = snap.Metadata.Index
+	atomic.StoreUint64(&rc.snapshotIndex, snap.Metadata.Index)
+	atomic.StoreUint64(&rc.appliedIndex, snap.Metadata.Index)
 
-	defer rc.wal.Close()
+	// the committed entries are applied while raft keeps ticking and sending messages
+	snapshotCtx, cancelSnapshot := context.WithCancel(context.Background())
+	applydonec := make(chan struct{})
+	go rc.applyAll(snapshotCtx, applydonec)
+	purgeCtx, cancelPurge := context.WithCancel(context.Background())
+	purgedonec := make(chan struct{})
+	go rc.purgeFiles(purgeCtx, purgedonec)
+	defer func() {
+		close(rc.applyc)
+		<-applydonec
+		// the log store is closed after the snapshot job and the purge
+		cancelSnapshot()
+		rc.snapshotWg.Wait()
+		cancelPurge()
+		<-purgedonec
+		rc.stop()
+	}()
 
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := time.NewTicker(rc.tickInterval)
 	defer ticker.Stop()
 
+	var transportErrorC chan error
+	if rc.httpTransport != nil {
+		transportErrorC = rc.httpTransport.ErrorC
+	}
+
+	// proposals from the channels are dropped when the node stops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// send proposals over raft
 	go func() {
 		confChangeCount := uint64(0)
 
+	loop:
 		for rc.proposeC != nil && rc.confChangeC != nil {
 			select {
 			case prop, ok := <-rc.proposeC:
@@ -394,7 +1001,7 @@ func (rc *phalanxNode) serveChannels() {
 					rc.proposeC = nil
 				} else {
 					// blocks until accepted by raft state machine
-					rc.node.Propose(context.TODO(), []byte(prop))
+					rc.node.Propose(ctx, []byte(prop))
 				}
 
 			case cc, ok := <-rc.confChangeC:
@@ -403,11 +1010,14 @@ func (rc *phalanxNode) serveChannels() {
 				} else {
 					confChangeCount++
 					cc.ID = confChangeCount
-					rc.node.ProposeConfChange(context.TODO(), cc)
+					rc.node.ProposeConfChange(ctx, cc)
 				}
+
+			case <-rc.stoppingc:
+				break loop
 			}
 		}
-		// client closed channel; shutdown raft if not already
+		// client closed channel or stopped the node; shutdown raft if not already
 		close(rc.stopc)
 	}()
 
@@ -417,55 +1027,416 @@ func (rc *phalanxNode) serveChannels() {
 		case <-ticker.C:
 			rc.node.Tick()
 
-		// store raft entries to wal, then publish over commit channel
+		// store raft entries to log store, then publish over commit channel
 		case rd := <-rc.node.Ready():
-			rc.wal.Save(rd.HardState, rd.Entries)
+			if rd.SoftState != nil {
+				rc.updateLeader(rd.SoftState.Lead)
+			}
+			if err := rc.logStore.Save(rd.HardState, rd.Entries, rd.Snapshot); err != nil {
+				rc.fail(err)
+				return
+			}
 			if !raft.IsEmptySnap(rd.Snapshot) {
-				rc.saveSnap(rd.Snapshot)
-				rc.raftStorage.ApplySnapshot(rd.Snapshot)
-				rc.publishSnapshot(rd.Snapshot)
+				if err := rc.snapshotter.SaveSnap(rd.Snapshot); err != nil {
+					rc.fail(err)
+					return
+				}
 			}
-			rc.raftStorage.Append(rd.Entries)
-			rc.transport.Send(rd.Messages)
-			if ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries)); !ok {
-				rc.stop()
+			rc.transport.Send(rc.streamSnapshots(rd.Messages))
+			rc.publishReadStates(rd.ReadStates)
+
+			job := &applyJob{snapshot: rd.Snapshot, entries: rd.CommittedEntries}
+			if hasConfChange(rd.CommittedEntries) {
+				// the members are updated before raft proceeds
+				job.done = make(chan struct{})
+			}
+			if !rc.enqueueApply(job, applydonec) {
 				return
 			}
-			rc.maybeTriggerSnapshot()
+			if job.done != nil {
+				select {
+				case <-job.done:
+				case <-applydonec:
+					return
+				}
+			}
 			rc.node.Advance()
 
-		case err := <-rc.transport.ErrorC:
-			rc.writeError(err)
+		case err := <-transportErrorC:
+			rc.fail(err)
+			return
+
+		case <-applydonec:
 			return
 
 		case <-rc.stopc:
-			rc.stop()
 			return
+
+		case <-rc.failc:
+			return
+		}
+	}
+}
+
+// applyJob is the snapshot and the committed entries of a raft Ready
+type applyJob struct {
+	snapshot raftpb.Snapshot
+	entries  []raftpb.Entry
+	done     chan struct{} // closed when the job is applied if not nil
+}
+
+// hasConfChange returns if the entries have a conf change
+func hasConfChange(ents []raftpb.Entry) bool {
+	for i := range ents {
+		if ents[i].Type == raftpb.EntryConfChange {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueApply queues the job, and records how long the raft loop waits for the full queue
+func (rc *phalanxNode) enqueueApply(job *applyJob, applydonec <-chan struct{}) bool {
+	select {
+	case rc.applyc <- job:
+		return true
+	default:
+	}
+
+	atomic.AddUint64(&rc.applyQueueWaits, 1)
+	start := time.Now()
+	defer func() { atomic.AddInt64(&rc.applyQueueBlocked, int64(time.Since(start))) }()
+	select {
+	case rc.applyc <- job:
+		return true
+	case <-applydonec:
+	case <-rc.stopc:
+	case <-rc.failc:
+	}
+	return false
+}
+
+// applyAll publishes the queued snapshots and entries in order
+// until the queue is closed or the node stops
+func (rc *phalanxNode) applyAll(snapshotCtx context.Context, donec chan<- struct{}) {
+	defer close(donec)
+	for job := range rc.applyc {
+		if err := rc.publishSnapshot(job.snapshot); err != nil {
+			rc.fail(err)
+			return
+		}
+		ents, err := rc.entriesToApply(job.entries)
+		if err != nil {
+			rc.fail(err)
+			return
+		}
+		if ok := rc.publishEntries(ents); !ok {
+			return
+		}
+		rc.maybeTriggerSnapshot(snapshotCtx)
+		if job.done != nil {
+			close(job.done)
 		}
 	}
 }
 
 func (rc *phalanxNode) serveRaft() {
-	url, err := url.Parse(rc.peers[rc.id-1])
+	defer close(rc.httpdonec)
+
+	url, err := url.Parse(rc.self.url)
 	if err != nil {
-		log.Fatalf("phalanxNode: Failed parsing URL (%v)", err)
+		rc.fail(xerrors.Errorf("phalanxNode: failed parsing URL: %w", err))
+		return
 	}
 
 	ln, err := newStoppableListener(url.Host, rc.httpstopc)
 	if err != nil {
-		log.Fatalf("phalanxNode: Failed to listen rafthttp (%v)", err)
+		rc.fail(xerrors.Errorf("phalanxNode: failed to listen rafthttp: %w", err))
+		return
 	}
 
-	err = (&http.Server{Handler: rc.transport.Handler()}).Serve(ln)
+	raftHandler := rc.httpTransport.Handler()
+	if t, ok := rc.transport.(*tlsTransport); ok {
+		raftHandler = t.Handler()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", raftHandler)
+	mux.HandleFunc(clusterPath, clusterHandler(rc.clusterID))
+	mux.HandleFunc(statusPath, statusHandler(func() interface{} { return rc.Status() }, rc.logger))
+
+	var listener net.Listener = ln
+	var handler http.Handler = mux
+	if rc.peerTLS != nil {
+		if listener, err = rc.peerTLS.listen(ln); err != nil {
+			ln.Close()
+			rc.fail(xerrors.Errorf("phalanxNode: failed to listen rafthttp: %w", err))
+			return
+		}
+		handler = rc.peerTLS.authorize(handler, rc.logger)
+	}
+
+	err = (&http.Server{Handler: handler}).Serve(listener)
 	select {
 	case <-rc.httpstopc:
 	default:
-		log.Fatalf("phalanxNode: Failed to serve rafthttp (%v)", err)
+		rc.fail(xerrors.Errorf("phalanxNode: failed to serve rafthttp: %w", err))
 	}
-	close(rc.httpdonec)
 }
 
+func (rc *phalanxNode) setCheckpointer(cp checkpointer) {
+	rc.checkpointerMu.Lock()
+	defer rc.checkpointerMu.Unlock()
+	rc.checkpointer = cp
+}
+
+func (rc *phalanxNode) getCheckpointer() checkpointer {
+	rc.checkpointerMu.RLock()
+	defer rc.checkpointerMu.RUnlock()
+	return rc.checkpointer
+}
+
+// streamSnapshots sends snapshot messages with the streamed checkpoint
+// and returns the other messages
+func (rc *phalanxNode) streamSnapshots(msgs []raftpb.Message) []raftpb.Message {
+	cp := rc.getCheckpointer()
+	if cp == nil {
+		return msgs
+	}
+	for i := range msgs {
+		if msgs[i].Type == raftpb.MsgSnap {
+			go rc.sendSnapshot(msgs[i], cp)
+			// ignored by the transport
+			msgs[i].To = 0
+		}
+	}
+	return msgs
+}
+
+// sendSnapshot writes the checkpoint to a temporary file,
+// and streams it to the follower with the snapshot message.
+func (rc *phalanxNode) sendSnapshot(m raftpb.Message, cp checkpointer) {
+	f, err := ioutil.TempFile(rc.snapdir, "checkpoint")
+	if err != nil {
+		rc.logger.Error("failed to create checkpoint file", indexField(m.Snapshot.Metadata.Index), errorField(err))
+		rc.ReportSnapshot(m.To, raft.SnapshotFailure)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	size, err := writeCheckpointFile(f, m.Snapshot.Metadata.Index, cp)
+	if err != nil {
+		f.Close()
+		rc.logger.Error("failed to write checkpoint", indexField(m.Snapshot.Metadata.Index), errorField(err))
+		rc.ReportSnapshot(m.To, raft.SnapshotFailure)
+		return
+	}
+
+	// the transport closes the file and reports the result to raft
+	msg := snap.NewMessage(m, f, size)
+	rc.transport.SendSnapshot(*msg)
+	<-msg.CloseNotify()
+}
+
+// writeCheckpointFile writes the checkpoint to f and rewinds f
+func writeCheckpointFile(f *os.File, index uint64, cp checkpointer) (int64, error) {
+	if err := cp.writeCheckpoint(index, f); err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+var readIndexRetryTime = 500 * time.Millisecond
+
+// ReadIndex returns the commit index confirmed by the leader
+func (rc *phalanxNode) ReadIndex(ctx context.Context) (uint64, error) {
+	if err := rc.waitStarted(ctx); err != nil {
+		return 0, err
+	}
+
+	rc.readMu.Lock()
+	rc.readRequestID++
+	id := rc.readRequestID
+	readC := make(chan uint64, 1)
+	rc.readWaiters[id] = readC
+	rc.readMu.Unlock()
+
+	defer func() {
+		rc.readMu.Lock()
+		delete(rc.readWaiters, id)
+		rc.readMu.Unlock()
+	}()
+
+	rctx := make([]byte, 8)
+	binary.BigEndian.PutUint64(rctx, id)
+
+	retry := time.NewTicker(readIndexRetryTime)
+	defer retry.Stop()
+
+	for {
+		// the request is dropped if there is no leader or
+		// the leader has not committed an entry in its term yet
+		if err := rc.node.ReadIndex(ctx, rctx); err != nil {
+			return 0, err
+		}
+		select {
+		case index := <-readC:
+			return index, nil
+		case <-retry.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-rc.donec:
+			return 0, ErrNodeStopped
+		}
+	}
+}
+
+// LeaseReadIndex returns the commit index confirmed by the lease of the leader
+func (rc *phalanxNode) LeaseReadIndex(ctx context.Context) (uint64, error) {
+	if err := rc.waitStarted(ctx); err != nil {
+		return 0, err
+	}
+	if index, ok := rc.leaseIndex(); ok {
+		return index, nil
+	}
+	return rc.ReadIndex(ctx)
+}
+
+// leaseIndex returns the commit index if this member is the leader with a valid lease
+func (rc *phalanxNode) leaseIndex() (uint64, bool) {
+	status := rc.node.Status()
+	if status.RaftState != raft.StateLeader {
+		return 0, false
+	}
+	// the commit index may be behind the previous leader
+	// until the leader commits an entry in its term
+	term, err := rc.logStore.Term(status.Commit)
+	if err != nil || term != status.Term {
+		return 0, false
+	}
+	return status.Commit, true
+}
+
+// publishReadStates notifies ReadIndex callers of the confirmed commit index
+func (rc *phalanxNode) publishReadStates(readStates []raft.ReadState) {
+	if len(readStates) == 0 {
+		return
+	}
+	rc.readMu.Lock()
+	defer rc.readMu.Unlock()
+	for i := range readStates {
+		if len(readStates[i].RequestCtx) != 8 {
+			continue
+		}
+		id := binary.BigEndian.Uint64(readStates[i].RequestCtx)
+		if readC, ok := rc.readWaiters[id]; ok {
+			select {
+			case readC <- readStates[i].Index:
+			default:
+			}
+		}
+	}
+}
+
+// Propose proposes data to the raft group
+func (rc *phalanxNode) Propose(ctx context.Context, data []byte) error {
+	if err := rc.waitStarted(ctx); err != nil {
+		return err
+	}
+	if err := rc.node.Propose(ctx, data); err != nil {
+		if err == raft.ErrStopped {
+			return ErrNodeStopped
+		}
+		return err
+	}
+	return nil
+}
+
+// ProposeConfChange proposes the conf change to the raft group
+func (rc *phalanxNode) ProposeConfChange(ctx context.Context, cc raftpb.ConfChange) error {
+	if err := rc.waitStarted(ctx); err != nil {
+		return err
+	}
+	if err := rc.node.ProposeConfChange(ctx, cc); err != nil {
+		if err == raft.ErrStopped {
+			return ErrNodeStopped
+		}
+		return err
+	}
+	return nil
+}
+
+// ID returns the member ID of this node.
+// It waits until the member ID is known from the raft log.
+func (rc *phalanxNode) ID() uint64 {
+	<-rc.identityc
+	return rc.self.id
+}
+
+// knowIdentity signals that the member ID is known from the raft log
+// or the node fails to start
+func (rc *phalanxNode) knowIdentity() {
+	rc.identityOnce.Do(func() { close(rc.identityc) })
+}
+
+// Members returns the members of the raft group and their peer URLs
+func (rc *phalanxNode) Members() []Member {
+	return rc.membership.list()
+}
+
+// restoreMembership restores the members carried by the snapshot
+func (rc *phalanxNode) restoreMembership(snapshot raftpb.Snapshot) error {
+	if raft.IsEmptySnap(snapshot) {
+		return nil
+	}
+	members, _, err := decodeSnapshotData(snapshot.Data)
+	if err != nil {
+		return err
+	}
+	if members != nil {
+		rc.membership.restore(snapshot.Metadata.Index, members)
+	}
+	return nil
+}
+
+// LeaderChangedNotify returns a channel which is closed when the known leader changes
+func (rc *phalanxNode) LeaderChangedNotify() <-chan struct{} {
+	rc.leaderMu.RLock()
+	defer rc.leaderMu.RUnlock()
+	return rc.leaderChangedC
+}
+
+func (rc *phalanxNode) updateLeader(lead uint64) {
+	rc.leaderMu.Lock()
+	defer rc.leaderMu.Unlock()
+	if lead == rc.lead {
+		return
+	}
+	// electing the first leader does not drop proposals
+	if rc.lead != raft.None {
+		close(rc.leaderChangedC)
+		rc.leaderChangedC = make(chan struct{})
+	}
+	if lead != raft.None {
+		rc.metrics.leaderChanged()
+	}
+	rc.lead = lead
+}
+
+// Process steps the message of a peer.
+// The message must be sent by the member authenticated by the request, if any.
 func (rc *phalanxNode) Process(ctx context.Context, m raftpb.Message) error {
+	if from, ok := senderFrom(ctx); ok && from != types.ID(m.From) {
+		return xerrors.Errorf(
+			"phalanxNode: message of %s sent by member %s: %w",
+			types.ID(m.From), from, ErrSenderMismatch)
+	}
 	return rc.node.Step(ctx, m)
 }
 func (rc *phalanxNode) IsIDRemoved(id uint64) bool {
@@ -473,7 +1444,13 @@ func (rc *phalanxNode) IsIDRemoved(id uint64) bool {
 }
 
 func (rc *phalanxNode) ReportUnreachable(id uint64) {
+	rc.metrics.peerSendFailed(id)
+	rc.node.ReportUnreachable(id)
 }
 
 func (rc *phalanxNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
+	if status == raft.SnapshotFailure {
+		rc.metrics.peerSendFailed(id)
+	}
+	rc.node.ReportSnapshot(id, status)
 }
@@ -135,6 +135,77 @@ func (x *Command) GetKeyValues() []*KeyValue {
 	return nil
 }
 
+type Proposal struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	RequestID uint64      `protobuf:"varint,1,opt,name=requestID,proto3" json:"requestID,omitempty"`
+	Command   *Command    `protobuf:"bytes,2,opt,name=command,proto3" json:"command,omitempty"`
+	Proposals []*Proposal `protobuf:"bytes,3,rep,name=proposals,proto3" json:"proposals,omitempty"`
+	MemberID  uint64      `protobuf:"varint,4,opt,name=memberID,proto3" json:"memberID,omitempty"`
+}
+
+func (x *Proposal) Reset() {
+	*x = Proposal{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_command_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Proposal) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Proposal) ProtoMessage() {}
+
+func (x *Proposal) ProtoReflect() protoreflect.Message {
+	mi := &file_command_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Proposal.ProtoReflect.Descriptor instead.
+func (*Proposal) Descriptor() ([]byte, []int) {
+	return file_command_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Proposal) GetRequestID() uint64 {
+	if x != nil {
+		return x.RequestID
+	}
+	return 0
+}
+
+func (x *Proposal) GetCommand() *Command {
+	if x != nil {
+		return x.Command
+	}
+	return nil
+}
+
+func (x *Proposal) GetProposals() []*Proposal {
+	if x != nil {
+		return x.Proposals
+	}
+	return nil
+}
+
+func (x *Proposal) GetMemberID() uint64 {
+	if x != nil {
+		return x.MemberID
+	}
+	return 0
+}
+
 var File_command_proto protoreflect.FileDescriptor
 
 var file_command_proto_rawDesc = []byte{
@@ -149,10 +220,22 @@ var file_command_proto_rawDesc = []byte{
 	0x79, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e,
 	0x64, 0x6f, 0x63, 0x74, 0x72, 0x69, 0x6e, 0x65, 0x2e, 0x70, 0x68, 0x61, 0x6c, 0x61, 0x6e, 0x78,
 	0x2e, 0x4b, 0x65, 0x79, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x52, 0x09, 0x6b, 0x65, 0x79, 0x56, 0x61,
-	0x6c, 0x75, 0x65, 0x73, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63,
-	0x6f, 0x6d, 0x2f, 0x67, 0x65, 0x74, 0x75, 0x6d, 0x65, 0x6e, 0x2f, 0x64, 0x6f, 0x63, 0x74, 0x72,
-	0x69, 0x6e, 0x65, 0x2f, 0x70, 0x68, 0x61, 0x6c, 0x61, 0x6e, 0x78, 0x2f, 0x70, 0x68, 0x61, 0x6c,
-	0x61, 0x6e, 0x78, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6c, 0x75, 0x65, 0x73, 0x22, 0xb3, 0x01, 0x0a, 0x08, 0x50, 0x72, 0x6f, 0x70, 0x6f, 0x73, 0x61,
+	0x6c, 0x12, 0x1c, 0x0a, 0x09, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49, 0x44, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49, 0x44, 0x12,
+	0x33, 0x0a, 0x07, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x19, 0x2e, 0x64, 0x6f, 0x63, 0x74, 0x72, 0x69, 0x6e, 0x65, 0x2e, 0x70, 0x68, 0x61, 0x6c,
+	0x61, 0x6e, 0x78, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x07, 0x63, 0x6f, 0x6d,
+	0x6d, 0x61, 0x6e, 0x64, 0x12, 0x38, 0x0a, 0x09, 0x70, 0x72, 0x6f, 0x70, 0x6f, 0x73, 0x61, 0x6c,
+	0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x64, 0x6f, 0x63, 0x74, 0x72, 0x69,
+	0x6e, 0x65, 0x2e, 0x70, 0x68, 0x61, 0x6c, 0x61, 0x6e, 0x78, 0x2e, 0x50, 0x72, 0x6f, 0x70, 0x6f,
+	0x73, 0x61, 0x6c, 0x52, 0x09, 0x70, 0x72, 0x6f, 0x70, 0x6f, 0x73, 0x61, 0x6c, 0x73, 0x12, 0x1a,
+	0x0a, 0x08, 0x6d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x49, 0x44, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x08, 0x6d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x49, 0x44, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x65, 0x74, 0x75, 0x6d, 0x65, 0x6e,
+	0x2f, 0x64, 0x6f, 0x63, 0x74, 0x72, 0x69, 0x6e, 0x65, 0x2f, 0x70, 0x68, 0x61, 0x6c, 0x61, 0x6e,
+	0x78, 0x2f, 0x70, 0x68, 0x61, 0x6c, 0x61, 0x6e, 0x78, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x33,
 }
 
 var (
@@ -167,18 +250,21 @@ func file_command_proto_rawDescGZIP() []byte {
 	return file_command_proto_rawDescData
 }
 
-var file_command_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_command_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_command_proto_goTypes = []interface{}{
 	(*KeyValue)(nil), // 0: doctrine.phalanx.KeyValue
 	(*Command)(nil),  // 1: doctrine.phalanx.Command
+	(*Proposal)(nil), // 2: doctrine.phalanx.Proposal
 }
 var file_command_proto_depIdxs = []int32{
 	0, // 0: doctrine.phalanx.Command.keyValues:type_name -> doctrine.phalanx.KeyValue
-	1, // [1:1] is the sub-list for method output_type
-	1, // [1:1] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	1, // 1: doctrine.phalanx.Proposal.command:type_name -> doctrine.phalanx.Command
+	2, // 2: doctrine.phalanx.Proposal.proposals:type_name -> doctrine.phalanx.Proposal
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_command_proto_init() }
@@ -211,6 +297,18 @@ func file_command_proto_init() {
 				return nil
 			}
 		}
+		file_command_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Proposal); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -218,7 +316,7 @@ func file_command_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_command_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,176 @@
+package phalanx
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultProposalBatchBytes is the max size of a batch whose MaxBytes is zero.
+// It is kept below the max size of an append message.
+const defaultProposalBatchBytes = 64 * 1024
+
+// ProposalBatching packs the proposals of a DB into one raft entry.
+// The commands in an entry are applied in order and written to the StableStore at once,
+// and CommandHandler.Apply reads the writes of the commands packed before it.
+// A proposal whose context is done before its entry is proposed is dropped.
+type ProposalBatching struct {
+	// MaxBytes is the max size of the proposals in an entry.
+	// A proposal larger than MaxBytes is proposed alone.
+	MaxBytes int
+	// MaxDelay is the max time a proposal waits for other proposals.
+	// If zero, proposals are packed only while the previous entry is being proposed.
+	MaxDelay time.Duration
+}
+
+// proposalBatcher proposes the packed proposals one entry at a time
+type proposalBatcher struct {
+	propose  func(ctx context.Context, data []byte) error
+	maxBytes int
+	maxDelay time.Duration
+
+	mu       sync.Mutex
+	batches  []*proposalBatch // the last batch takes proposals until it is full
+	flushing bool             // the first batch is being proposed
+}
+
+type proposalBatch struct {
+	proposals []*phalanxpb.Proposal
+	ctxs      []context.Context // contexts of the proposers in the order of the proposals
+	size      int
+	full      bool          // no more proposals are packed
+	ready     bool          // MaxDelay passed or the batch is full
+	done      chan struct{} // closed when the batch is proposed
+	err       error
+}
+
+func newProposalBatcher(
+	propose func(ctx context.Context, data []byte) error,
+	batching ProposalBatching,
+) *proposalBatcher {
+	if batching.MaxBytes <= 0 {
+		batching.MaxBytes = defaultProposalBatchBytes
+	}
+	return &proposalBatcher{
+		propose:  propose,
+		maxBytes: batching.MaxBytes,
+		maxDelay: batching.MaxDelay,
+	}
+}
+
+// add packs the proposal and waits until raft accepts its entry or ctx is done
+func (b *proposalBatcher) add(ctx context.Context, proposal *phalanxpb.Proposal) error {
+	size := proto.Size(proposal)
+
+	b.mu.Lock()
+	var batch *proposalBatch
+	if n := len(b.batches); n > 0 && !b.batches[n-1].full {
+		batch = b.batches[n-1]
+		if batch.size+size > b.maxBytes {
+			batch.full, batch.ready = true, true
+			batch = nil
+		}
+	}
+	if batch == nil {
+		batch = &proposalBatch{done: make(chan struct{})}
+		b.batches = append(b.batches, batch)
+		if b.maxDelay > 0 {
+			time.AfterFunc(b.maxDelay, func() { b.markReady(batch) })
+		} else {
+			batch.ready = true
+		}
+	}
+	batch.proposals = append(batch.proposals, proposal)
+	batch.ctxs = append(batch.ctxs, ctx)
+	batch.size += size
+	if batch.size >= b.maxBytes {
+		batch.full, batch.ready = true, true
+	}
+	b.mu.Unlock()
+
+	b.maybeFlush()
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *proposalBatcher) markReady(batch *proposalBatch) {
+	b.mu.Lock()
+	batch.ready = true
+	b.mu.Unlock()
+	b.maybeFlush()
+}
+
+// maybeFlush proposes the first batch if it is ready and no batch is being proposed
+func (b *proposalBatcher) maybeFlush() {
+	b.mu.Lock()
+	if b.flushing || len(b.batches) == 0 || !b.batches[0].ready {
+		b.mu.Unlock()
+		return
+	}
+	batch := b.batches[0]
+	b.batches = b.batches[1:]
+	batch.full = true
+	b.flushing = true
+	b.mu.Unlock()
+
+	go func() {
+		batch.err = b.flush(batch)
+		close(batch.done)
+
+		b.mu.Lock()
+		b.flushing = false
+		b.mu.Unlock()
+		b.maybeFlush()
+	}()
+}
+
+// flush proposes the batch as an envelope, or as the proposal itself if it is alone.
+// The proposals whose proposers gave up are dropped.
+func (b *proposalBatcher) flush(batch *proposalBatch) error {
+	var proposals []*phalanxpb.Proposal
+	var ctxs []context.Context
+	for i, ctx := range batch.ctxs {
+		if ctx.Err() == nil {
+			proposals = append(proposals, batch.proposals[i])
+			ctxs = append(ctxs, ctx)
+		}
+	}
+	if len(proposals) == 0 {
+		return batch.ctxs[0].Err()
+	}
+
+	message := proposals[0]
+	if len(proposals) > 1 {
+		message = &phalanxpb.Proposal{Proposals: proposals}
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := proposersContext(ctxs)
+	defer cancel()
+	return b.propose(ctx, data)
+}
+
+// proposersContext returns the context which is done when the contexts of all the proposers are done
+func proposersContext(ctxs []context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for _, proposer := range ctxs {
+			select {
+			case <-proposer.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,129 @@
+package phalanx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"golang.org/x/xerrors"
+)
+
+// defaults of the file retention
+const (
+	defaultMaxSnapshots  = 5
+	defaultPurgeInterval = 30 * time.Second
+)
+
+const (
+	snapSuffix = ".snap"
+	walSuffix  = ".wal"
+)
+
+// purgeFiles purges the old snapshot and WAL files every purge interval until ctx is done
+func (rc *phalanxNode) purgeFiles(ctx context.Context, donec chan<- struct{}) {
+	defer close(donec)
+
+	ticker := time.NewTicker(rc.purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := rc.purge(); err != nil {
+			// the files are purged again at the next interval
+			rc.logger.Warn("failed to purge files", errorField(err))
+		}
+	}
+}
+
+// purge removes the snapshot files except the last maxSnapshots,
+// and the WAL files older than the oldest retained snapshot.
+func (rc *phalanxNode) purge() error {
+	snapIndex, err := purgeSnapshots(rc.snapdir, rc.maxSnapshots, rc.logger)
+	if err != nil {
+		return err
+	}
+	if _, ok := rc.logStore.(*walLogStore); !ok || snapIndex == 0 {
+		return nil
+	}
+	return purgeWAL(rc.waldir, snapIndex, rc.logger)
+}
+
+// purgeSnapshots removes the snapshot files except the last max,
+// and returns the index of the oldest retained snapshot, or zero if there is none.
+func purgeSnapshots(dir string, max int, logger Logger) (uint64, error) {
+	names, err := readDirWithSuffix(dir, snapSuffix)
+	if err != nil {
+		return 0, err
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+	for len(names) > max {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return 0, xerrors.Errorf("phalanxNode: failed to remove snapshot file: %w", err)
+		}
+		logger.Info("purged snapshot file", fileField(names[0]))
+		names = names[1:]
+	}
+	var term, index uint64
+	if _, err := fmt.Sscanf(names[0], "%016x-%016x"+snapSuffix, &term, &index); err != nil {
+		return 0, xerrors.Errorf("phalanxNode: bad snapshot file name %s: %w", names[0], err)
+	}
+	return index, nil
+}
+
+// purgeWAL removes the WAL files whose entries are all before snapIndex.
+// A file locked by the WAL is kept with the files after it.
+func purgeWAL(dir string, snapIndex uint64, logger Logger) error {
+	names, err := readDirWithSuffix(dir, walSuffix)
+	if err != nil {
+		return err
+	}
+	// the WAL is opened at the snapshot from the last file starting at or before its index
+	for len(names) > 1 {
+		var seq, index uint64
+		if _, err := fmt.Sscanf(names[1], "%016x-%016x"+walSuffix, &seq, &index); err != nil {
+			return xerrors.Errorf("phalanxNode: bad WAL file name %s: %w", names[1], err)
+		}
+		if index > snapIndex {
+			return nil
+		}
+		f := filepath.Join(dir, names[0])
+		l, err := fileutil.TryLockFile(f, os.O_WRONLY, fileutil.PrivateFileMode)
+		if err != nil {
+			return nil
+		}
+		if err := os.Remove(f); err != nil {
+			l.Close()
+			return xerrors.Errorf("phalanxNode: failed to remove WAL file: %w", err)
+		}
+		if err := l.Close(); err != nil {
+			return xerrors.Errorf("phalanxNode: failed to unlock WAL file: %w", err)
+		}
+		logger.Info("purged WAL file", fileField(names[0]))
+		names = names[1:]
+	}
+	return nil
+}
+
+// readDirWithSuffix returns the sorted names of the files in dir with the suffix
+func readDirWithSuffix(dir, suffix string) ([]string, error) {
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("phalanxNode: failed to read dir: %w", err)
+	}
+	var filtered []string
+	for _, name := range names {
+		if strings.HasSuffix(name, suffix) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered, nil
+}
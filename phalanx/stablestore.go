@@ -1,11 +1,20 @@
 package phalanx
 
+import (
+	"bytes"
+	"io"
+)
+
 // StableStore is a local persistent storage.
 type StableStore interface {
 	// CreateBatch creates batch
 	CreateBatch() Batch
-	// Write apply the given batch to the StableStorage
+	// Write apply the given batch to the StableStorage.
+	// The writes of all regions in the batch must be applied atomically.
 	Write(batch Batch) error
+	// WriteSync apply the given batch to the StableStorage and syncs it to the disk,
+	// so that the batch survives a crash of the machine
+	WriteSync(batch Batch) error
 	// Close Close closes the StableStorage
 	Close() error
 	// GetSnapshot returns snapshot
@@ -17,6 +26,11 @@ type StableStore interface {
 	CreateCheckpoint(region string) ([]byte, error)
 	// RestoreToCheckpoint restores the given region to checkpoint
 	RestoreToCheckpoint(region string, checkpointInfo []byte) error
+	// WriteCheckpoint writes a checkpoint of the given region in the snapshot to w.
+	// The checkpoint is streamed, so it is not buffered in memory.
+	WriteCheckpoint(snapshot Snapshot, region string, w io.Writer) error
+	// RestoreFromCheckpoint restores the given region to the checkpoint read from r
+	RestoreFromCheckpoint(region string, r io.Reader) error
 	// CreateRegion creates a region
 	CreateRegion(name string) error
 	// DropRegion drop a region
@@ -102,3 +116,22 @@ func BytesPrefixRange(prefix []byte) *Range {
 func FullScanRange() *Range {
 	return &Range{nil, nil}
 }
+
+// CaptureRegion returns NodeConfig.CaptureSnapshot which captures the region of the StableStore.
+// The captured snapshot is serialized as a checkpoint of the region.
+func CaptureRegion(stableStore StableStore, region string) func() (func() ([]byte, error), error) {
+	return func() (func() ([]byte, error), error) {
+		snapshot, err := stableStore.GetSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		return func() ([]byte, error) {
+			defer snapshot.Release()
+			var buffer bytes.Buffer
+			if err := stableStore.WriteCheckpoint(snapshot, region, &buffer); err != nil {
+				return nil, err
+			}
+			return buffer.Bytes(), nil
+		}, nil
+	}
+}
@@ -2,30 +2,28 @@ package leveldb
 
 import "github.com/syndtr/goleveldb/leveldb"
 
-// batch is batchs partitioned by region
+// batch is a batch of all regions
 // batch is not thread safe
 type batch struct {
-	batchs map[string]*leveldb.Batch
+	internal *leveldb.Batch
+	regions  map[string]struct{} // regions written by the batch
 }
 
 func (b *batch) Put(region string, key, value []byte) {
-	b.batchs[region].Put(key, value)
+	b.internal.Put(regionKey(region, key), value)
+	b.regions[region] = struct{}{}
 }
 
 func (b *batch) Delete(region string, key []byte) {
-	b.batchs[region].Delete(key)
+	b.internal.Delete(regionKey(region, key))
+	b.regions[region] = struct{}{}
 }
 
 func (b *batch) Len() int {
-	l := 0
-	for _, v := range b.batchs {
-		l += v.Len()
-	}
-	return l
+	return b.internal.Len()
 }
 
 func (b *batch) Reset() {
-	for _, v := range b.batchs {
-		v.Reset()
-	}
+	b.internal.Reset()
+	b.regions = make(map[string]struct{})
 }
@@ -6,10 +6,16 @@ import (
 
 type iterator struct {
 	internal itpkg.Iterator
+	// prefix of the region stripped from the keys
+	prefix []byte
 }
 
 func (it *iterator) Key() []byte {
-	return it.internal.Key()
+	key := it.internal.Key()
+	if key == nil {
+		return nil
+	}
+	return key[len(it.prefix):]
 }
 
 func (it *iterator) Value() []byte {
@@ -33,7 +39,7 @@ func (it *iterator) Last() bool {
 }
 
 func (it *iterator) Seek(key []byte) bool {
-	return it.internal.Seek(key)
+	return it.internal.Seek(append(append([]byte{}, it.prefix...), key...))
 }
 
 func (it *iterator) Prev() bool {
@@ -9,13 +9,15 @@ import (
 )
 
 type snapshot struct {
-	// read only snapshots
-	regionSnaps map[string]*leveldb.Snapshot
+	// read only snapshot
+	internal *leveldb.Snapshot
+	// regions existing when the snapshot is taken
+	regions map[string]struct{}
 }
 
 func (snap *snapshot) Get(region string, key []byte) (value []byte, err error) {
-	if sn, exists := snap.regionSnaps[region]; exists {
-		v, err := sn.Get(key, nil)
+	if _, exists := snap.regions[region]; exists {
+		v, err := snap.internal.Get(regionKey(region, key), nil)
 		if err == leveldb.ErrNotFound {
 			return nil, phalanx.ErrKeyNotFound
 		} else if err != nil {
@@ -27,15 +29,17 @@ func (snap *snapshot) Get(region string, key []byte) (value []byte, err error) {
 }
 
 func (snap *snapshot) MultiGet(region string, keys ...[]byte) ([][]byte, error) {
-	if sn, exists := snap.regionSnaps[region]; exists {
+	if _, exists := snap.regions[region]; exists {
 
 		values := make([][]byte, len(keys))
 
 		for i := range keys {
-			v, err := sn.Get(keys[i], nil)
+			v, err := snap.internal.Get(regionKey(region, keys[i]), nil)
 			if err == leveldb.ErrNotFound {
 				values[i] = nil
 			} else if err != nil {
+				return nil, xerrors.Errorf("leveldb stable store: %w", err)
+			} else {
 				values[i] = v
 			}
 		}
@@ -46,8 +50,8 @@ func (snap *snapshot) MultiGet(region string, keys ...[]byte) ([][]byte, error)
 }
 
 func (snap *snapshot) Has(region string, key []byte) (ret bool, err error) {
-	if sn, exists := snap.regionSnaps[region]; exists {
-		return sn.Has(key, nil)
+	if _, exists := snap.regions[region]; exists {
+		return snap.internal.Has(regionKey(region, key), nil)
 	}
 	return false, phalanx.NewRegionNotFound(region)
 }
@@ -59,22 +63,26 @@ func (snap *snapshot) NewIterator(
 	if slice == nil {
 		slice = phalanx.FullScanRange()
 	}
-	if sn, exists := snap.regionSnaps[region]; exists {
+	if _, exists := snap.regions[region]; exists {
+		prefix := regionPrefix(region)
+		r := util.BytesPrefix(prefix)
+		if slice.Start != nil {
+			r.Start = regionKey(region, slice.Start)
+		}
+		if slice.End != nil {
+			r.Limit = regionKey(region, slice.End)
+		}
 		return &iterator{
-			internal: sn.NewIterator(
-				&util.Range{
-					Start: slice.Start,
-					Limit: slice.End,
-				},
+			internal: snap.internal.NewIterator(
+				r,
 				&opt.ReadOptions{DontFillCache: true},
 			),
+			prefix: prefix,
 		}, nil
 	}
 	return nil, phalanx.NewRegionNotFound(region)
 }
 
 func (snap *snapshot) Release() {
-	for key := range snap.regionSnaps {
-		snap.regionSnaps[key].Release()
-	}
+	snap.internal.Release()
 }
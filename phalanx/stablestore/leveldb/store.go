@@ -3,9 +3,11 @@ package leveldb
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 
 	"github.com/getumen/doctrine/phalanx"
@@ -13,6 +15,8 @@ import (
 	"github.com/linkedin/goavro"
 	"github.com/pkg/errors"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/xerrors"
 )
 
@@ -36,10 +40,25 @@ var (
 	regionNameRegExp = regexp.MustCompile(allowedRegionChars)
 )
 
+// The keys of the metadata of the store start with a zero byte,
+// which no region name starts with.
+var (
+	// regionMarkerPrefix prefixes the key which exists while the region exists
+	regionMarkerPrefix = []byte("\x00region\x00")
+	// regionTombstonePrefix prefixes the key which exists
+	// while the keys of the dropped region are deleted
+	regionTombstonePrefix = []byte("\x00dropped\x00")
+)
+
+// store keeps all regions in one LevelDB,
+// so that a batch across regions is written atomically.
+// The keys of a region are prefixed by the region name and a zero byte.
 type store struct {
 	sync.RWMutex
-	storages map[string]*leveldb.DB
+	db       *leveldb.DB
+	regions  map[string]struct{}
 	dataPath string
+	logger   phalanx.Logger
 }
 
 type storeDriver struct {
@@ -47,16 +66,167 @@ type storeDriver struct {
 
 // New creates stable store implemented by LevelDB
 func (d *storeDriver) New(dataPath string) (phalanx.StableStore, error) {
-	return &store{
-		storages: map[string]*leveldb.DB{},
+	return d.NewWithLogger(dataPath, phalanx.NewStdLogger())
+}
+
+// NewWithLogger creates stable store implemented by LevelDB which logs to the logger
+func (d *storeDriver) NewWithLogger(dataPath string, logger phalanx.Logger) (phalanx.StableStore, error) {
+	db, err := leveldb.OpenFile(dataPath, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("leveldb stable store: fail to open db: %w", err)
+	}
+	s := &store{
+		db:       db,
+		regions:  map[string]struct{}{},
 		dataPath: dataPath,
-	}, nil
+		logger:   logger.With(phalanx.Field{Key: "stable-store", Value: "leveldb"}),
+	}
+	if err := s.open(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// open finishes the drops interrupted by a crash, loads the regions
+// and migrates the regions kept in the legacy layout
+func (s *store) open() error {
+	dropped, err := s.listMetadata(regionTombstonePrefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range dropped {
+		if err := s.deleteRegionKeys(name); err != nil {
+			return err
+		}
+	}
+	regions, err := s.listMetadata(regionMarkerPrefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range regions {
+		s.regions[name] = struct{}{}
+	}
+	return s.migrateLegacyRegions()
+}
+
+// listMetadata returns the region names of the metadata keys with the prefix
+func (s *store) listMetadata(prefix []byte) ([]string, error) {
+	iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	var names []string
+	for iter.Next() {
+		names = append(names, string(iter.Key()[len(prefix):]))
+	}
+	if err := iter.Error(); err != nil {
+		return nil, xerrors.Errorf("leveldb stable store: fail to load regions: %w", err)
+	}
+	return names, nil
+}
+
+// migrateLegacyRegions moves the regions kept in a LevelDB per region
+// under the data path into the LevelDB of the store
+func (s *store) migrateLegacyRegions() error {
+	entries, err := ioutil.ReadDir(s.dataPath)
+	if err != nil {
+		return xerrors.Errorf("leveldb stable store: fail to read data path: %w", err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(s.dataPath, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "CURRENT")); err != nil {
+			continue
+		}
+		if err := s.migrateLegacyRegion(entry.Name(), dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) migrateLegacyRegion(name, dir string) error {
+	// the region marker is written after all keys,
+	// so the region which has it is migrated before a crash
+	if _, migrated := s.regions[name]; !migrated {
+		s.logger.Info("migrating legacy region", phalanx.Field{Key: "region", Value: name})
+		legacy, err := leveldb.OpenFile(dir, nil)
+		if err != nil {
+			return xerrors.Errorf(
+				"leveldb stable store: fail to open legacy region(%s): %w",
+				name, err)
+		}
+		if err := s.copyLegacyRegion(name, legacy); err != nil {
+			legacy.Close()
+			return err
+		}
+		if err := legacy.Close(); err != nil {
+			return xerrors.Errorf(
+				"leveldb stable store: fail to close legacy region(%s): %w",
+				name, err)
+		}
+		s.regions[name] = struct{}{}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return xerrors.Errorf(
+			"leveldb stable store: fail to remove legacy region(%s): %w",
+			name, err)
+	}
+	s.logger.Info("migrated legacy region", phalanx.Field{Key: "region", Value: name})
+	return nil
+}
+
+func (s *store) copyLegacyRegion(name string, legacy *leveldb.DB) error {
+	iter := legacy.NewIterator(nil, nil)
+	defer iter.Release()
+	b := new(leveldb.Batch)
+	for iter.Next() {
+		b.Put(regionKey(name, iter.Key()), iter.Value())
+		if b.Len() >= maxBatchSize {
+			if err := s.db.Write(b, nil); err != nil {
+				return xerrors.Errorf(
+					"leveldb stable store: fail to migrate legacy region(%s): %w",
+					name, err)
+			}
+			b.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return xerrors.Errorf(
+			"leveldb stable store: fail to migrate legacy region(%s): %w",
+			name, err)
+	}
+	b.Put(metadataKey(regionMarkerPrefix, name), nil)
+	if err := s.db.Write(b, &opt.WriteOptions{Sync: true}); err != nil {
+		return xerrors.Errorf(
+			"leveldb stable store: fail to migrate legacy region(%s): %w",
+			name, err)
+	}
+	return nil
 }
 
 func init() {
 	phalanx.RegisterStableStore("leveldb", &storeDriver{})
 }
 
+// regionPrefix returns the prefix of the keys of the region
+func regionPrefix(region string) []byte {
+	prefix := make([]byte, len(region)+1)
+	copy(prefix, region)
+	return prefix
+}
+
+// regionKey returns the key of the region in the db
+func regionKey(region string, key []byte) []byte {
+	return append(regionPrefix(region), key...)
+}
+
+// metadataKey returns the metadata key of the region
+func metadataKey(prefix []byte, region string) []byte {
+	return append(append([]byte{}, prefix...), region...)
+}
+
 // CreateRegion creates a region
 func (s *store) CreateRegion(name string) error {
 	s.Lock()
@@ -66,23 +236,33 @@ func (s *store) CreateRegion(name string) error {
 
 func (s *store) createRegion(name string) error {
 
-	if matched := regionNameRegExp.Match([]byte(name)); !matched {
+	if matched := regionNameRegExp.Match([]byte(name)); !matched || strings.IndexByte(name, 0) >= 0 {
 		return errors.Errorf(
 			"leveldb stable store: invalid region name (%s) allowed chars are %s",
 			name, allowedRegionChars,
 		)
 	}
 
-	if _, dup := s.storages[name]; dup {
+	if _, dup := s.regions[name]; dup {
 		return phalanx.NewErrRegionAlreadyExists(name)
 	}
-	db, err := leveldb.OpenFile(filepath.Join(s.dataPath, name), nil)
-	if err != nil {
+	// finish the drop of the region of the same name if it failed
+	if dropping, err := s.db.Has(metadataKey(regionTombstonePrefix, name), nil); err != nil {
+		return xerrors.Errorf(
+			"leveldb stable store: fail to create region(%s): %w",
+			name, err)
+	} else if dropping {
+		if err := s.deleteRegionKeys(name); err != nil {
+			return err
+		}
+	}
+	if err := s.db.Put(metadataKey(regionMarkerPrefix, name), nil, &opt.WriteOptions{Sync: true}); err != nil {
 		return xerrors.Errorf(
 			"leveldb stable store: fail to create region(%s): %w",
 			name, err)
 	}
-	s.storages[name] = db
+	s.regions[name] = struct{}{}
+	s.logger.Info("created region", phalanx.Field{Key: "region", Value: name})
 	return nil
 }
 
@@ -94,18 +274,56 @@ func (s *store) DropRegion(name string) error {
 }
 
 func (s *store) dropRegion(name string) error {
-	if region, exist := s.storages[name]; exist {
-		if err := region.Close(); err != nil {
-			return xerrors.Errorf(
-				"leveldb stable store: fail to close region(%s): %w",
-				name, err)
-		}
+	if _, exist := s.regions[name]; !exist {
+		return phalanx.NewRegionNotFound(name)
+	}
 
-		os.RemoveAll(filepath.Join(s.dataPath, name))
-		delete(s.storages, name)
-		return nil
+	// the region is dropped at once by replacing its marker with a tombstone,
+	// and the keys are deleted after it, or when the store opens after a crash
+	b := new(leveldb.Batch)
+	b.Delete(metadataKey(regionMarkerPrefix, name))
+	b.Put(metadataKey(regionTombstonePrefix, name), nil)
+	if err := s.db.Write(b, &opt.WriteOptions{Sync: true}); err != nil {
+		return xerrors.Errorf(
+			"leveldb stable store: fail to drop region(%s): %w",
+			name, err)
+	}
+	delete(s.regions, name)
+	if err := s.deleteRegionKeys(name); err != nil {
+		return err
+	}
+	s.logger.Info("dropped region", phalanx.Field{Key: "region", Value: name})
+	return nil
+}
+
+// deleteRegionKeys deletes the keys of the dropped region and then its tombstone
+func (s *store) deleteRegionKeys(name string) error {
+	iter := s.db.NewIterator(util.BytesPrefix(regionPrefix(name)), nil)
+	defer iter.Release()
+	b := new(leveldb.Batch)
+	for iter.Next() {
+		b.Delete(iter.Key())
+		if b.Len() >= maxBatchSize {
+			if err := s.db.Write(b, nil); err != nil {
+				return xerrors.Errorf(
+					"leveldb stable store: fail to drop region(%s): %w",
+					name, err)
+			}
+			b.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return xerrors.Errorf(
+			"leveldb stable store: fail to drop region(%s): %w",
+			name, err)
+	}
+	b.Delete(metadataKey(regionTombstonePrefix, name))
+	if err := s.db.Write(b, &opt.WriteOptions{Sync: true}); err != nil {
+		return xerrors.Errorf(
+			"leveldb stable store: fail to drop region(%s): %w",
+			name, err)
 	}
-	return phalanx.NewRegionNotFound(name)
+	return nil
 }
 
 func (s *store) HasRegion(name string) bool {
@@ -115,23 +333,19 @@ func (s *store) HasRegion(name string) bool {
 }
 
 func (s *store) hasRegion(name string) bool {
-	_, exists := s.storages[name]
+	_, exists := s.regions[name]
 	return exists
 }
 
 // CreateBatch creates batch
 func (s *store) CreateBatch() phalanx.Batch {
-	s.RLock()
-	defer s.RUnlock()
 	return s.createBatch()
 }
+
 func (s *store) createBatch() phalanx.Batch {
-	batchs := make(map[string]*leveldb.Batch)
-	for key := range s.storages {
-		batchs[key] = new(leveldb.Batch)
-	}
 	return &batch{
-		batchs: batchs,
+		internal: new(leveldb.Batch),
+		regions:  make(map[string]struct{}),
 	}
 }
 
@@ -139,35 +353,37 @@ func (s *store) createBatch() phalanx.Batch {
 func (s *store) Write(b phalanx.Batch) error {
 	s.RLock()
 	defer s.RUnlock()
-	return s.write(b)
+	return s.write(b, nil)
 }
 
-func (s *store) write(b phalanx.Batch) error {
+// WriteSync apply the given batch to the StableStorage and syncs it to the disk
+func (s *store) WriteSync(b phalanx.Batch) error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.write(b, &opt.WriteOptions{Sync: true})
+}
+
+// write writes all regions of the batch at once
+func (s *store) write(b phalanx.Batch, wo *opt.WriteOptions) error {
 	if bi, ok := b.(*batch); ok {
 		// check all region exists
-		for key := range bi.batchs {
-			if _, exists := s.storages[key]; !exists {
+		for key := range bi.regions {
+			if _, exists := s.regions[key]; !exists {
 				return phalanx.NewRegionNotFound(key)
 			}
 		}
-		var errs *multierror.Error
-		for key := range bi.batchs {
-			err := s.storages[key].Write(bi.batchs[key], nil)
-			if err != nil {
-				errs = multierror.Append(
-					errs,
-					xerrors.Errorf(
-						"leveldb stable store: fail to write batch to region(%s): %w",
-						key, err))
-			}
-
+		if err := s.db.Write(bi.internal, wo); err != nil {
+			return xerrors.Errorf(
+				"leveldb stable store: fail to write batch: %w",
+				err)
 		}
-		return errs.ErrorOrNil()
+		return nil
 	}
 	return errors.New("cast fail")
 }
 
 func (s *store) writeRegionCheckpoint(
+	snap phalanx.Snapshot,
 	region string,
 	w io.Writer,
 ) error {
@@ -176,8 +392,10 @@ func (s *store) writeRegionCheckpoint(
 		return xerrors.Errorf("fail to create codec: %w", err)
 	}
 
+	// hide the concrete type of w because goavro appends to an existing OCF
+	// when w is an *os.File
 	config := goavro.OCFConfig{
-		W:               w,
+		W:               struct{ io.Writer }{w},
 		Codec:           codec,
 		CompressionName: goavro.CompressionSnappyLabel,
 	}
@@ -189,13 +407,6 @@ func (s *store) writeRegionCheckpoint(
 	}
 
 	block := []interface{}{}
-	snap, err := s.GetSnapshot()
-	if err != nil {
-		return xerrors.Errorf(
-			"leveldb stable store: fail to get snapshot: %w",
-			err)
-	}
-	defer snap.Release()
 	iter, err := snap.NewIterator(
 		region,
 		phalanx.FullScanRange(),
@@ -257,14 +468,31 @@ func (s *store) writeRegionCheckpoint(
 
 // CreateCheckpoint creates a checkpoint of this StableStore
 func (s *store) CreateCheckpoint(region string) ([]byte, error) {
+	snap, err := s.GetSnapshot()
+	if err != nil {
+		return nil, xerrors.Errorf(
+			"leveldb stable store: fail to get snapshot: %w",
+			err)
+	}
+	defer snap.Release()
+
 	buffer := new(bytes.Buffer)
-	err := s.writeRegionCheckpoint(region, buffer)
+	err = s.writeRegionCheckpoint(snap, region, buffer)
 	if err != nil {
 		return nil, err
 	}
 	return buffer.Bytes(), nil
 }
 
+// WriteCheckpoint writes a checkpoint of the region in the snapshot to w
+func (s *store) WriteCheckpoint(
+	snap phalanx.Snapshot,
+	region string,
+	w io.Writer,
+) error {
+	return s.writeRegionCheckpoint(snap, region, w)
+}
+
 // RestoreToCheckpoint restores internal storage to checkpoint
 func (s *store) RestoreToCheckpoint(
 	region string,
@@ -272,15 +500,26 @@ func (s *store) RestoreToCheckpoint(
 ) error {
 	s.Lock()
 	defer s.Unlock()
-	return s.restoreToCheckpoint(region, checkpoint)
+	return s.restoreToCheckpoint(region, bytes.NewReader(checkpoint))
+}
 
+// RestoreFromCheckpoint restores internal storage to the checkpoint read from r
+func (s *store) RestoreFromCheckpoint(
+	region string,
+	r io.Reader,
+) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.restoreToCheckpoint(region, r)
 }
+
 func (s *store) restoreToCheckpoint(
 	region string,
-	checkpoint []byte,
+	r io.Reader,
 ) error {
+	s.logger.Info("restoring checkpoint", phalanx.Field{Key: "region", Value: region})
 
-	if _, regionExists := s.storages[region]; !regionExists {
+	if _, regionExists := s.regions[region]; !regionExists {
 		err := s.createRegion(region)
 		if err != nil {
 			return xerrors.Errorf(
@@ -317,12 +556,12 @@ func (s *store) restoreToCheckpoint(
 		batch.Delete(region, key)
 
 		if batch.Len() >= maxBatchSize {
-			err = s.write(batch)
+			err = s.write(batch, nil)
 			resultError = multierror.Append(resultError, err)
 			batch = s.createBatch()
 		}
 	}
-	err = s.write(batch)
+	err = s.write(batch, nil)
 	resultError = multierror.Append(resultError, err)
 	resultError = multierror.Append(resultError, iter.Error())
 
@@ -330,7 +569,7 @@ func (s *store) restoreToCheckpoint(
 		return resultError.ErrorOrNil()
 	}
 
-	reader, err := goavro.NewOCFReader(bytes.NewBuffer(checkpoint))
+	reader, err := goavro.NewOCFReader(r)
 	batch = s.createBatch()
 	resultError = new(multierror.Error)
 	if err != nil {
@@ -350,13 +589,13 @@ func (s *store) restoreToCheckpoint(
 		}
 
 		if batch.Len() >= maxBatchSize {
-			err = s.write(batch)
+			err = s.write(batch, nil)
 			resultError = multierror.Append(resultError, err)
 			batch = s.createBatch()
 		}
 	}
 	if batch.Len() > 0 {
-		err = s.write(batch)
+		err = s.write(batch, nil)
 		resultError = multierror.Append(resultError, err)
 	}
 
@@ -365,12 +604,7 @@ func (s *store) restoreToCheckpoint(
 
 // Close Close closes the StableStorage
 func (s *store) Close() error {
-	var errorResults *multierror.Error
-	for key := range s.storages {
-		err := s.storages[key].Close()
-		errorResults = multierror.Append(errorResults, err)
-	}
-	return errorResults.ErrorOrNil()
+	return s.db.Close()
 }
 
 // GetSnapshot
@@ -380,20 +614,19 @@ func (s *store) GetSnapshot() (phalanx.Snapshot, error) {
 	return s.getSnapshot()
 }
 func (s *store) getSnapshot() (phalanx.Snapshot, error) {
-
-	snapshots := make(map[string]*leveldb.Snapshot)
-
-	var err error
-	for key := range s.storages {
-		snapshots[key], err = s.storages[key].GetSnapshot()
-		if err != nil {
-			return nil, xerrors.Errorf(
-				"leveldb stable store: fail to get snapshot of region(%s): %w",
-				key, err,
-			)
-		}
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, xerrors.Errorf(
+			"leveldb stable store: fail to get snapshot: %w",
+			err,
+		)
+	}
+	regions := make(map[string]struct{}, len(s.regions))
+	for key := range s.regions {
+		regions[key] = struct{}{}
 	}
 	return &snapshot{
-		regionSnaps: snapshots,
+		internal: snap,
+		regions:  regions,
 	}, nil
 }
@@ -2,10 +2,14 @@ package leveldb
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/getumen/doctrine/phalanx"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
@@ -48,9 +52,9 @@ func TestStore_Checkpoint(t *testing.T) {
 		t.Fatal(err)
 	}
 	t.Cleanup(func() { os.RemoveAll(tempDir) })
-	target := &store{
-		storages: make(map[string]*leveldb.DB),
-		dataPath: tempDir,
+	target, err := (&storeDriver{}).New(tempDir)
+	if err != nil {
+		t.Fatalf("fail to create db: %+v", err)
 	}
 	t.Cleanup(func() { target.Close() })
 
@@ -80,9 +84,9 @@ func TestStore_Checkpoint(t *testing.T) {
 	}
 	t.Cleanup(func() { os.RemoveAll(tempDir2) })
 
-	actual := &store{
-		storages: make(map[string]*leveldb.DB),
-		dataPath: tempDir2,
+	actual, err := (&storeDriver{}).New(tempDir2)
+	if err != nil {
+		t.Fatalf("fail to create db: %+v", err)
 	}
 	t.Cleanup(func() { actual.Close() })
 
@@ -119,3 +123,313 @@ func TestStore_Checkpoint(t *testing.T) {
 	}
 
 }
+
+func TestStore_StreamingCheckpoint(t *testing.T) {
+
+	const region = "default"
+
+	newStore := func() phalanx.StableStore {
+		tempDir, err := ioutil.TempDir("", t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tempDir) })
+		driver := &storeDriver{}
+		s, err := driver.New(tempDir)
+		if err != nil {
+			t.Fatalf("fail to create db: %+v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		if err := s.CreateRegion(region); err != nil {
+			t.Fatalf("fail to create region: %+v", err)
+		}
+		return s
+	}
+
+	target := newStore()
+	batch := target.CreateBatch()
+	for i := 0; i < 1000; i++ {
+		batch.Put(region, []byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	if err := target.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := target.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	// writes after the snapshot are not in the checkpoint
+	batch = target.CreateBatch()
+	batch.Put(region, []byte("key-new"), []byte("value-new"))
+	if err := target.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := newStore()
+	batch = actual.CreateBatch()
+	batch.Put(region, []byte("stale"), []byte("value"))
+	if err := actual.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(target.WriteCheckpoint(snap, region, w))
+	}()
+	if err := actual.RestoreFromCheckpoint(region, r); err != nil {
+		t.Fatalf("fail to restore: %+v", err)
+	}
+
+	actualSnap, err := actual.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actualSnap.Release()
+
+	for i := 0; i < 1000; i++ {
+		v, err := actualSnap.Get(region, []byte(fmt.Sprintf("key-%04d", i)))
+		if err != nil {
+			t.Fatalf("fail to get key-%04d: %+v", i, err)
+		}
+		if !bytes.Equal(v, []byte(fmt.Sprintf("value-%d", i))) {
+			t.Fatalf("values not match: expected value-%d, but got %s", i, v)
+		}
+	}
+	for _, key := range []string{"key-new", "stale"} {
+		if _, err := actualSnap.Get(region, []byte(key)); err != phalanx.ErrKeyNotFound {
+			t.Fatalf("expect %s is not found, got %+v", key, err)
+		}
+	}
+}
+
+func TestStore_RegionsShareOneDB(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	driver := &storeDriver{}
+	target, err := driver.New(tempDir)
+	if err != nil {
+		t.Fatalf("fail to create db: %+v", err)
+	}
+	for _, region := range []string{"a", "ab", "b"} {
+		if err := target.CreateRegion(region); err != nil {
+			t.Fatalf("fail to create region: %+v", err)
+		}
+	}
+
+	// a batch across regions is written at once
+	batch := target.CreateBatch()
+	for _, region := range []string{"a", "ab", "b"} {
+		for i := 0; i < 3; i++ {
+			batch.Put(region, []byte(fmt.Sprintf("key-%d", i)), []byte(region))
+		}
+	}
+	if err := target.WriteSync(batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// a batch writing to a dropped region is not written to any region
+	if err := target.DropRegion("b"); err != nil {
+		t.Fatalf("fail to drop region: %+v", err)
+	}
+	batch = target.CreateBatch()
+	batch.Put("a", []byte("key-3"), []byte("a"))
+	batch.Put("b", []byte("key-3"), []byte("b"))
+	if err := target.Write(batch); err == nil {
+		t.Fatalf("expect the batch to the dropped region fails")
+	}
+
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+	target, err = driver.New(tempDir)
+	if err != nil {
+		t.Fatalf("fail to reopen db: %+v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	// the regions are kept across restart
+	for _, region := range []string{"a", "ab"} {
+		if !target.HasRegion(region) {
+			t.Fatalf("expect region %s exists after reopen", region)
+		}
+	}
+	if target.HasRegion("b") {
+		t.Fatalf("expect the dropped region does not exist after reopen")
+	}
+	if err := target.CreateRegion("b"); err != nil {
+		t.Fatalf("fail to create region: %+v", err)
+	}
+
+	snap, err := target.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	if _, err := snap.Get("a", []byte("key-3")); err != phalanx.ErrKeyNotFound {
+		t.Fatalf("expect key-3 is not written, got %+v", err)
+	}
+	if _, err := snap.Get("b", []byte("key-0")); err != phalanx.ErrKeyNotFound {
+		t.Fatalf("expect the keys of the dropped region are deleted, got %+v", err)
+	}
+
+	// the iterator of a region does not see the keys of the region "ab"
+	iter, err := snap.NewIterator("a", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer iter.Release()
+	var keys []string
+	for iter.Next() {
+		if string(iter.Value()) != "a" {
+			t.Fatalf("unexpected value %s of key %s", iter.Value(), iter.Key())
+		}
+		keys = append(keys, string(iter.Key()))
+	}
+	if fmt.Sprint(keys) != "[key-0 key-1 key-2]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if !iter.Last() || string(iter.Key()) != "key-2" {
+		t.Fatalf("expect the last key is key-2, got %s", iter.Key())
+	}
+	if !iter.Seek([]byte("key-1")) || string(iter.Key()) != "key-1" {
+		t.Fatalf("expect seeking key-1, got %s", iter.Key())
+	}
+
+	iter, err = snap.NewIterator("ab", &phalanx.Range{Start: []byte("key-1"), End: []byte("key-2")})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer iter.Release()
+	if !iter.Next() || string(iter.Key()) != "key-1" || string(iter.Value()) != "ab" || iter.Next() {
+		t.Fatalf("expect only key-1 of region ab in the range")
+	}
+}
+
+func TestStore_DropRegionResumesAfterCrash(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	driver := &storeDriver{}
+	target, err := driver.New(tempDir)
+	if err != nil {
+		t.Fatalf("fail to create db: %+v", err)
+	}
+	if err := target.CreateRegion("a"); err != nil {
+		t.Fatalf("fail to create region: %+v", err)
+	}
+	batch := target.CreateBatch()
+	for i := 0; i < 3*maxBatchSize; i++ {
+		batch.Put("a", []byte(fmt.Sprintf("key-%04d", i)), []byte("a"))
+	}
+	if err := target.WriteSync(batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// crash after the tombstone and the first keys are written
+	s := target.(*store)
+	b := new(leveldb.Batch)
+	b.Delete(metadataKey(regionMarkerPrefix, "a"))
+	b.Put(metadataKey(regionTombstonePrefix, "a"), nil)
+	b.Delete(regionKey("a", []byte("key-0000")))
+	if err := s.db.Write(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err = driver.New(tempDir)
+	if err != nil {
+		t.Fatalf("fail to reopen db: %+v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	if target.HasRegion("a") {
+		t.Fatalf("expect the dropped region does not exist after reopen")
+	}
+	if err := target.CreateRegion("a"); err != nil {
+		t.Fatalf("fail to create region: %+v", err)
+	}
+	snap, err := target.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	iter, err := snap.NewIterator("a", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer iter.Release()
+	if iter.Next() {
+		t.Fatalf("expect the keys of the dropped region are deleted, got %s", iter.Key())
+	}
+}
+
+func TestStore_MigratesLegacyRegions(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	// the legacy layout keeps a LevelDB per region under the data path
+	for _, region := range []string{"a", "b"} {
+		legacy, err := leveldb.OpenFile(filepath.Join(tempDir, region), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < maxBatchSize+1; i++ {
+			if err := legacy.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(region), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := legacy.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	driver := &storeDriver{}
+	target, err := driver.New(tempDir)
+	if err != nil {
+		t.Fatalf("fail to create db: %+v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+
+	snap, err := target.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	for _, region := range []string{"a", "b"} {
+		if !target.HasRegion(region) {
+			t.Fatalf("expect region %s is migrated", region)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, region)); !os.IsNotExist(err) {
+			t.Fatalf("expect the legacy region %s is removed, got %+v", region, err)
+		}
+		iter, err := snap.NewIterator(region, nil)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		count := 0
+		for iter.Next() {
+			if string(iter.Value()) != region {
+				t.Fatalf("unexpected value %s of key %s", iter.Value(), iter.Key())
+			}
+			count++
+		}
+		iter.Release()
+		if count != maxBatchSize+1 {
+			t.Fatalf("expect %d keys in region %s, got %d", maxBatchSize+1, region, count)
+		}
+	}
+}
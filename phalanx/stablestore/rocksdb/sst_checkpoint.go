@@ -0,0 +1,392 @@
+package rocksdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/getumen/doctrine/phalanx"
+	"github.com/linkedin/goavro"
+	"github.com/pkg/errors"
+	"github.com/tecbot/gorocksdb"
+	"golang.org/x/xerrors"
+)
+
+// checkpointFormat is the format of checkpoints created by the store
+type checkpointFormat int
+
+const (
+	// avroCheckpoint is a checkpoint of the key-values in an Avro OCF
+	avroCheckpoint checkpointFormat = iota
+	// sstCheckpoint is a checkpoint of the SST files of the column family
+	sstCheckpoint
+)
+
+// sstCheckpointMagic is the beginning of a SST checkpoint.
+// It is distinct from the magic bytes of Avro OCF ("Obj\x01").
+var sstCheckpointMagic = []byte("phalanx-sst\x01")
+
+// sstManifestSchema describes the file set of a SST checkpoint.
+// The contents of the files follow the manifest in the order of the files.
+const sstManifestSchema = `
+{
+	"namespace": "phalanx.avro",
+	"type": "record",
+	"name": "SSTManifest",
+	"fields": [
+		{
+			"name": "files",
+			"type": {
+				"type": "array",
+				"items": {
+					"type": "record",
+					"name": "SSTFile",
+					"fields": [
+						{"name": "name", "type": "string"},
+						{"name": "size", "type": "long"},
+						{"name": "entries", "type": "long"}
+					]
+				}
+			}
+		}
+	]
+}
+`
+
+// maxSSTFileSize is the approximate size of the key-values in a SST file
+const maxSSTFileSize = 64 << 20
+
+// maxSSTManifestSize is the largest manifest read from a checkpoint
+const maxSSTManifestSize = 16 << 20
+
+type sstFile struct {
+	name    string
+	size    int64
+	entries int64
+}
+
+// writeSSTCheckpoint exports the region in the snapshot to SST files
+// and writes the manifest and the files to w
+func (s *store) writeSSTCheckpoint(
+	snap phalanx.Snapshot,
+	region string,
+	w io.Writer,
+) error {
+	dir, err := ioutil.TempDir(s.dataPath, "checkpoint")
+	if err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to create checkpoint dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := s.exportSSTFiles(snap, region, dir)
+	if err != nil {
+		return err
+	}
+
+	codec, err := goavro.NewCodec(sstManifestSchema)
+	if err != nil {
+		return xerrors.Errorf("fail to create codec: %w", err)
+	}
+	records := make([]interface{}, len(files))
+	for i, f := range files {
+		records[i] = map[string]interface{}{
+			"name":    f.name,
+			"size":    f.size,
+			"entries": f.entries,
+		}
+	}
+	manifest, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"files": records,
+	})
+	if err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to encode manifest: %w", err)
+	}
+
+	header := make([]byte, len(sstCheckpointMagic)+8)
+	copy(header, sstCheckpointMagic)
+	binary.BigEndian.PutUint64(header[len(sstCheckpointMagic):], uint64(len(manifest)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := copyFile(w, filepath.Join(dir, f.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportSSTFiles writes the key-values of the region in the snapshot to SST files in dir
+func (s *store) exportSSTFiles(
+	snap phalanx.Snapshot,
+	region string,
+	dir string,
+) ([]sstFile, error) {
+	iter, err := snap.NewIterator(region, phalanx.FullScanRange())
+	if err != nil {
+		return nil, xerrors.Errorf(
+			"rocksdb stable store: fail to get iterator of region(%s): %w",
+			region, err,
+		)
+	}
+	defer iter.Release()
+
+	envOpts := gorocksdb.NewDefaultEnvOptions()
+	defer envOpts.Destroy()
+
+	var files []sstFile
+	var writer *gorocksdb.SSTFileWriter
+	var current sstFile
+	var currentSize int
+
+	finish := func() error {
+		if writer == nil {
+			return nil
+		}
+		w := writer
+		writer = nil
+		defer w.Destroy()
+		if err := w.Finish(); err != nil {
+			return xerrors.Errorf(
+				"rocksdb stable store: fail to finish sst file: %w", err)
+		}
+		info, err := os.Stat(filepath.Join(dir, current.name))
+		if err != nil {
+			return err
+		}
+		current.size = info.Size()
+		files = append(files, current)
+		return nil
+	}
+
+	for iter.Next() {
+		if writer == nil {
+			current = sstFile{name: fmt.Sprintf("%06d.sst", len(files))}
+			currentSize = 0
+			writer = gorocksdb.NewSSTFileWriter(envOpts, s.opt)
+			if err := writer.Open(filepath.Join(dir, current.name)); err != nil {
+				writer.Destroy()
+				writer = nil
+				return nil, xerrors.Errorf(
+					"rocksdb stable store: fail to open sst file: %w", err)
+			}
+		}
+		key, value := iter.Key(), iter.Value()
+		if err := writer.Add(key, value); err != nil {
+			writer.Destroy()
+			return nil, xerrors.Errorf(
+				"rocksdb stable store: fail to add to sst file: %w", err)
+		}
+		current.entries++
+		currentSize += len(key) + len(value)
+
+		if currentSize >= maxSSTFileSize {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		if writer != nil {
+			writer.Destroy()
+		}
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// restoreFromSSTCheckpoint replaces the region with the SST files in the checkpoint
+func (s *store) restoreFromSSTCheckpoint(region string, r io.Reader) error {
+	header := make([]byte, len(sstCheckpointMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to read checkpoint header: %w", err)
+	}
+	manifestSize := binary.BigEndian.Uint64(header[len(sstCheckpointMagic):])
+	if manifestSize > maxSSTManifestSize {
+		return xerrors.Errorf(
+			"rocksdb stable store: manifest size %d exceeds %d", manifestSize, maxSSTManifestSize)
+	}
+	manifest := make([]byte, manifestSize)
+	if _, err := io.ReadFull(r, manifest); err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to read manifest: %w", err)
+	}
+	files, err := decodeSSTManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(s.dataPath, "checkpoint")
+	if err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to create checkpoint dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := receiveFile(path, io.LimitReader(r, f.size), f.size); err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+
+	if err := s.clearRegion(region); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	opts := gorocksdb.NewDefaultIngestExternalFileOptions()
+	defer opts.Destroy()
+	opts.SetMoveFiles(true)
+	if err := s.storage.IngestExternalFileCF(s.cf[region], paths, opts); err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to ingest sst files of region(%s): %w",
+			region, err)
+	}
+	return nil
+}
+
+// clearRegion deletes all the key-values of the region
+func (s *store) clearRegion(region string) error {
+	snapIF, err := s.getSnapshot()
+	if err != nil {
+		return err
+	}
+	snap, ok := snapIF.(*snapshot)
+	if !ok {
+		return errors.New("cast failed")
+	}
+	defer snap.Release()
+
+	iter, err := snap.newIterator(region, phalanx.FullScanRange())
+	if err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to get iterator of region(%s): %w",
+			region, err,
+		)
+	}
+	defer iter.Release()
+
+	if !iter.First() {
+		return iter.Error()
+	}
+	first := iter.Key()
+	if !iter.Last() {
+		return iter.Error()
+	}
+	last := iter.Key()
+
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	// the end of a range deletion is exclusive
+	wb.DeleteRangeCF(s.cf[region], first, last)
+	wb.DeleteCF(s.cf[region], last)
+
+	wo := gorocksdb.NewDefaultWriteOptions()
+	defer wo.Destroy()
+	if err := s.storage.Write(wo, wb); err != nil {
+		return xerrors.Errorf(
+			"rocksdb stable store: fail to clear region(%s): %w", region, err)
+	}
+	return nil
+}
+
+// isSSTCheckpoint tells whether the checkpoint read from r is a SST checkpoint
+func isSSTCheckpoint(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(sstCheckpointMagic))
+	return err == nil && bytes.Equal(magic, sstCheckpointMagic)
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// decodeSSTManifest returns the files in the manifest
+func decodeSSTManifest(manifest []byte) ([]sstFile, error) {
+	codec, err := goavro.NewCodec(sstManifestSchema)
+	if err != nil {
+		return nil, xerrors.Errorf("fail to create codec: %w", err)
+	}
+	native, _, err := codec.NativeFromBinary(manifest)
+	if err != nil {
+		return nil, xerrors.Errorf(
+			"rocksdb stable store: fail to decode manifest: %w", err)
+	}
+	invalid := xerrors.New("rocksdb stable store: invalid manifest")
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, invalid
+	}
+	records, ok := record["files"].([]interface{})
+	if !ok {
+		return nil, invalid
+	}
+	files := make([]sstFile, 0, len(records))
+	for _, record := range records {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return nil, invalid
+		}
+		name, ok := m["name"].(string)
+		if !ok {
+			return nil, invalid
+		}
+		size, ok := m["size"].(int64)
+		if !ok || size < 0 {
+			return nil, invalid
+		}
+		entries, _ := m["entries"].(int64)
+		// the file is received only into the checkpoint dir
+		name = filepath.Base(name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return nil, xerrors.Errorf(
+				"rocksdb stable store: invalid sst file name %q in manifest", name)
+		}
+		files = append(files, sstFile{name: name, size: size, entries: entries})
+	}
+	return files, nil
+}
+
+func receiveFile(path string, r io.Reader, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return xerrors.Errorf(
+			"rocksdb stable store: sst file is truncated: %w", io.ErrUnexpectedEOF)
+	}
+	return nil
+}
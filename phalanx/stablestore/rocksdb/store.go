@@ -1,6 +1,7 @@
 package rocksdb
 
 import (
+	"bufio"
 	"bytes"
 	"io"
 	"regexp"
@@ -35,18 +36,26 @@ var (
 )
 
 type store struct {
-	cfMutex  *sync.RWMutex
-	cf       map[string]*gorocksdb.ColumnFamilyHandle
-	storage  *gorocksdb.DB
-	dataPath string
-	opt      *gorocksdb.Options
+	cfMutex          *sync.RWMutex
+	cf               map[string]*gorocksdb.ColumnFamilyHandle
+	storage          *gorocksdb.DB
+	dataPath         string
+	opt              *gorocksdb.Options
+	checkpointFormat checkpointFormat
+	logger           phalanx.Logger
 }
 
 type storeDriver struct {
+	checkpointFormat checkpointFormat
 }
 
 // New creates stable store implemented by RocksDB
 func (d *storeDriver) New(dataPath string) (phalanx.StableStore, error) {
+	return d.NewWithLogger(dataPath, phalanx.NewStdLogger())
+}
+
+// NewWithLogger creates stable store implemented by RocksDB which logs to the logger
+func (d *storeDriver) NewWithLogger(dataPath string, logger phalanx.Logger) (phalanx.StableStore, error) {
 	opt := gorocksdb.NewDefaultOptions()
 	opt.SetCreateIfMissing(true)
 	opt.SetCreateIfMissingColumnFamilies(true)
@@ -55,16 +64,21 @@ func (d *storeDriver) New(dataPath string) (phalanx.StableStore, error) {
 		return nil, xerrors.Errorf("fail to create rocksdb: %w", err)
 	}
 	return &store{
-		storage:  storage,
-		dataPath: dataPath,
-		opt:      opt,
-		cf:       make(map[string]*gorocksdb.ColumnFamilyHandle),
-		cfMutex:  new(sync.RWMutex),
+		storage:          storage,
+		dataPath:         dataPath,
+		opt:              opt,
+		cf:               make(map[string]*gorocksdb.ColumnFamilyHandle),
+		cfMutex:          new(sync.RWMutex),
+		checkpointFormat: d.checkpointFormat,
+		logger:           logger.With(phalanx.Field{Key: "stable-store", Value: "rocksdb"}),
 	}, nil
 }
 
 func init() {
 	phalanx.RegisterStableStore("rocksdb", &storeDriver{})
+	// rocksdb-sst creates checkpoints of SST files
+	// which are ingested into the column family on restore
+	phalanx.RegisterStableStore("rocksdb-sst", &storeDriver{checkpointFormat: sstCheckpoint})
 }
 
 // CreateRegion creates a region
@@ -100,6 +114,7 @@ func (s *store) createRegion(name string) error {
 			name, err)
 	}
 	s.cf[name] = cf
+	s.logger.Info("created region", phalanx.Field{Key: "region", Value: name})
 	return nil
 }
 
@@ -120,6 +135,7 @@ func (s *store) dropRegion(name string) error {
 	if cf, exist := s.cf[name]; exist {
 		s.storage.DropColumnFamily(cf)
 		delete(s.cf, name)
+		s.logger.Info("dropped region", phalanx.Field{Key: "region", Value: name})
 		return nil
 	}
 	return phalanx.NewRegionNotFound(name)
@@ -158,12 +174,23 @@ func (s *store) Write(b phalanx.Batch) error {
 		defer ba.batchs.Destroy()
 	}
 
-	return s.write(b)
+	return s.write(b, false)
 }
 
-func (s *store) write(b phalanx.Batch) error {
+// WriteSync apply the given batch to the StableStorage and syncs it to the disk
+func (s *store) WriteSync(b phalanx.Batch) error {
+	if ba, ok := b.(*batch); ok {
+		defer ba.batchs.Destroy()
+	}
+
+	return s.write(b, true)
+}
+
+func (s *store) write(b phalanx.Batch, sync bool) error {
 
 	opt := gorocksdb.NewDefaultWriteOptions()
+	defer opt.Destroy()
+	opt.SetSync(sync)
 
 	if bi, ok := b.(*batch); ok {
 		err := s.storage.Write(opt, bi.batchs)
@@ -177,16 +204,23 @@ func (s *store) write(b phalanx.Batch) error {
 }
 
 func (s *store) writeRegionCheckpoint(
+	snap phalanx.Snapshot,
 	region string,
 	w io.Writer,
 ) error {
+	if s.checkpointFormat == sstCheckpoint {
+		return s.writeSSTCheckpoint(snap, region, w)
+	}
+
 	codec, err := goavro.NewCodec(schema)
 	if err != nil {
 		return xerrors.Errorf("fail to create codec: %w", err)
 	}
 
+	// hide the concrete type of w because goavro appends to an existing OCF
+	// when w is an *os.File
 	config := goavro.OCFConfig{
-		W:               w,
+		W:               struct{ io.Writer }{w},
 		Codec:           codec,
 		CompressionName: goavro.CompressionSnappyLabel,
 	}
@@ -198,13 +232,6 @@ func (s *store) writeRegionCheckpoint(
 	}
 
 	block := []interface{}{}
-	snap, err := s.getSnapshot()
-	if err != nil {
-		return xerrors.Errorf(
-			"leveldb stable store: fail to get snapshot: %w",
-			err)
-	}
-	defer snap.Release()
 	iter, err := snap.NewIterator(
 		region,
 		phalanx.FullScanRange(),
@@ -266,14 +293,31 @@ func (s *store) writeRegionCheckpoint(
 
 // CreateCheckpoint creates a checkpoint of this StableStore
 func (s *store) CreateCheckpoint(region string) ([]byte, error) {
+	snap, err := s.getSnapshot()
+	if err != nil {
+		return nil, xerrors.Errorf(
+			"rocksdb stable store: fail to get snapshot: %w",
+			err)
+	}
+	defer snap.Release()
+
 	buffer := new(bytes.Buffer)
-	err := s.writeRegionCheckpoint(region, buffer)
+	err = s.writeRegionCheckpoint(snap, region, buffer)
 	if err != nil {
 		return nil, err
 	}
 	return buffer.Bytes(), nil
 }
 
+// WriteCheckpoint writes a checkpoint of the region in the snapshot to w
+func (s *store) WriteCheckpoint(
+	snap phalanx.Snapshot,
+	region string,
+	w io.Writer,
+) error {
+	return s.writeRegionCheckpoint(snap, region, w)
+}
+
 // RestoreToCheckpoint restores internal storage to checkpoint
 func (s *store) RestoreToCheckpoint(
 	region string,
@@ -282,13 +326,24 @@ func (s *store) RestoreToCheckpoint(
 
 	s.cfMutex.Lock()
 	defer s.cfMutex.Unlock()
-	return s.restoreToCheckpoint(region, checkpoint)
+	return s.restoreToCheckpoint(region, bytes.NewReader(checkpoint))
+}
+
+// RestoreFromCheckpoint restores internal storage to the checkpoint read from r
+func (s *store) RestoreFromCheckpoint(
+	region string,
+	r io.Reader,
+) error {
+	s.cfMutex.Lock()
+	defer s.cfMutex.Unlock()
+	return s.restoreToCheckpoint(region, r)
 }
 
 func (s *store) restoreToCheckpoint(
 	region string,
-	checkpoint []byte,
+	r io.Reader,
 ) error {
+	s.logger.Info("restoring checkpoint", phalanx.Field{Key: "region", Value: region})
 
 	if _, regionExists := s.cf[region]; !regionExists {
 		err := s.createRegion(region)
@@ -300,6 +355,12 @@ func (s *store) restoreToCheckpoint(
 		}
 	}
 
+	// both formats are restored regardless of the format of this store
+	br := bufio.NewReader(r)
+	if isSSTCheckpoint(br) {
+		return s.restoreFromSSTCheckpoint(region, br)
+	}
+
 	// delete all data
 	snapIF, err := s.getSnapshot()
 	if err != nil {
@@ -344,7 +405,7 @@ func (s *store) restoreToCheckpoint(
 		ba.delete(region, key)
 
 		if ba.Len() >= maxBatchSize {
-			err = s.write(ba)
+			err = s.write(ba, false)
 			resultError = multierror.Append(resultError, err)
 			baIF := s.createBatch()
 
@@ -355,7 +416,7 @@ func (s *store) restoreToCheckpoint(
 			}
 		}
 	}
-	err = s.write(ba)
+	err = s.write(ba, false)
 	resultError = multierror.Append(resultError, err)
 	resultError = multierror.Append(resultError, iter.Error())
 
@@ -365,7 +426,7 @@ func (s *store) restoreToCheckpoint(
 
 	resultError = new(multierror.Error)
 
-	reader, err := goavro.NewOCFReader(bytes.NewBuffer(checkpoint))
+	reader, err := goavro.NewOCFReader(br)
 	if err != nil {
 		return err
 	}
@@ -392,7 +453,7 @@ func (s *store) restoreToCheckpoint(
 		}
 
 		if ba.Len() >= maxBatchSize {
-			err = s.write(ba)
+			err = s.write(ba, false)
 			resultError = multierror.Append(resultError, err)
 			baIF := s.createBatch()
 
@@ -404,7 +465,7 @@ func (s *store) restoreToCheckpoint(
 		}
 	}
 	if ba.Len() > 0 {
-		err = s.write(ba)
+		err = s.write(ba, false)
 		resultError = multierror.Append(resultError, err)
 	}
 
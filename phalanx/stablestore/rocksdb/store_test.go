@@ -2,9 +2,15 @@ package rocksdb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/getumen/doctrine/phalanx"
+	"github.com/linkedin/goavro"
 )
 
 func TestStore_Checkpoint(t *testing.T) {
@@ -118,3 +124,242 @@ func TestStore_Checkpoint(t *testing.T) {
 	}
 
 }
+
+func TestStore_StreamingCheckpoint(t *testing.T) {
+
+	const region = "region-1"
+
+	newStore := func() phalanx.StableStore {
+		tempDir, err := ioutil.TempDir("", t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tempDir) })
+		driver := &storeDriver{}
+		s, err := driver.New(tempDir)
+		if err != nil {
+			t.Fatalf("fail to create db: %+v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		if err := s.CreateRegion(region); err != nil {
+			t.Fatalf("fail to create region: %+v", err)
+		}
+		return s
+	}
+
+	target := newStore()
+	batch := target.CreateBatch()
+	for i := 0; i < 1000; i++ {
+		batch.Put(region, []byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	if err := target.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := target.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	// writes after the snapshot are not in the checkpoint
+	batch = target.CreateBatch()
+	batch.Put(region, []byte("key-new"), []byte("value-new"))
+	if err := target.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := newStore()
+	batch = actual.CreateBatch()
+	batch.Put(region, []byte("stale"), []byte("value"))
+	if err := actual.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(target.WriteCheckpoint(snap, region, w))
+	}()
+	if err := actual.RestoreFromCheckpoint(region, r); err != nil {
+		t.Fatalf("fail to restore: %+v", err)
+	}
+
+	actualSnap, err := actual.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actualSnap.Release()
+
+	for i := 0; i < 1000; i++ {
+		v, err := actualSnap.Get(region, []byte(fmt.Sprintf("key-%04d", i)))
+		if err != nil {
+			t.Fatalf("fail to get key-%04d: %+v", i, err)
+		}
+		if !bytes.Equal(v, []byte(fmt.Sprintf("value-%d", i))) {
+			t.Fatalf("values not match: expected value-%d, but got %s", i, v)
+		}
+	}
+	for _, key := range []string{"key-new", "stale"} {
+		if _, err := actualSnap.Get(region, []byte(key)); err != phalanx.ErrKeyNotFound {
+			t.Fatalf("expect %s is not found, got %+v", key, err)
+		}
+	}
+}
+
+func TestStore_SSTCheckpoint(t *testing.T) {
+
+	const region = "region-1"
+
+	newStore := func(format checkpointFormat) phalanx.StableStore {
+		tempDir, err := ioutil.TempDir("", t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tempDir) })
+		driver := &storeDriver{checkpointFormat: format}
+		s, err := driver.New(tempDir)
+		if err != nil {
+			t.Fatalf("fail to create db: %+v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		if err := s.CreateRegion(region); err != nil {
+			t.Fatalf("fail to create region: %+v", err)
+		}
+		return s
+	}
+
+	testCases := []struct {
+		name   string
+		format checkpointFormat
+		keys   int
+	}{
+		{name: "sst", format: sstCheckpoint, keys: 1000},
+		{name: "empty sst", format: sstCheckpoint, keys: 0},
+		{name: "avro", format: avroCheckpoint, keys: 1000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			target := newStore(tc.format)
+			batch := target.CreateBatch()
+			for i := 0; i < tc.keys; i++ {
+				batch.Put(region, []byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+			}
+			if err := target.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+
+			checkpoint, err := target.CreateCheckpoint(region)
+			if err != nil {
+				t.Fatalf("fail to create checkpoint: %+v", err)
+			}
+
+			// the store ingests a checkpoint of either format
+			actual := newStore(sstCheckpoint)
+			batch = actual.CreateBatch()
+			batch.Put(region, []byte("stale-0"), []byte("value"))
+			batch.Put(region, []byte("stale-1"), []byte("value"))
+			if err := actual.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := actual.RestoreToCheckpoint(region, checkpoint); err != nil {
+				t.Fatalf("fail to restore: %+v", err)
+			}
+
+			snap, err := actual.GetSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer snap.Release()
+
+			iter, err := snap.NewIterator(region, nil)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			defer iter.Release()
+
+			counter := 0
+			for iter.Next() {
+				if !bytes.Equal(iter.Key(), []byte(fmt.Sprintf("key-%04d", counter))) {
+					t.Fatalf("keys not match: expected key-%04d, but got %s", counter, iter.Key())
+				}
+				if !bytes.Equal(iter.Value(), []byte(fmt.Sprintf("value-%d", counter))) {
+					t.Fatalf("values not match: expected value-%d, but got %s", counter, iter.Value())
+				}
+				counter++
+			}
+			if counter != tc.keys {
+				t.Fatalf("expect %d keys, but got %d", tc.keys, counter)
+			}
+		})
+	}
+}
+
+func TestStore_SSTCheckpointRejectsInvalidManifest(t *testing.T) {
+
+	const region = "region-1"
+
+	tempDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	driver := &storeDriver{checkpointFormat: sstCheckpoint}
+	target, err := driver.New(tempDir)
+	if err != nil {
+		t.Fatalf("fail to create db: %+v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	if err := target.CreateRegion(region); err != nil {
+		t.Fatalf("fail to create region: %+v", err)
+	}
+	batch := target.CreateBatch()
+	batch.Put(region, []byte("key"), []byte("value"))
+	if err := target.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := func(manifestSize uint64, manifest []byte) []byte {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint64(header, manifestSize)
+		return append(append(append([]byte{}, sstCheckpointMagic...), header...), manifest...)
+	}
+	codec, err := goavro.NewCodec(sstManifestSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negative, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"files": []interface{}{
+			map[string]interface{}{"name": "000000.sst", "size": int64(-1), "entries": int64(0)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		checkpoint []byte
+	}{
+		{name: "oversized manifest", checkpoint: checkpoint(1<<62, nil)},
+		{name: "negative file size", checkpoint: checkpoint(uint64(len(negative)), negative)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := target.RestoreToCheckpoint(region, tc.checkpoint); err == nil {
+				t.Fatalf("expect the checkpoint is rejected")
+			}
+			// the region is not cleared
+			snap, err := target.GetSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer snap.Release()
+			if _, err := snap.Get(region, []byte("key")); err != nil {
+				t.Fatalf("expect the key is kept, got %+v", err)
+			}
+		})
+	}
+}
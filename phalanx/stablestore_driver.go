@@ -7,6 +7,12 @@ type StableStoreDriver interface {
 	New(path string) (StableStore, error)
 }
 
+// StableStoreDriverWithLogger is driver of stable store which logs to the logger
+type StableStoreDriverWithLogger interface {
+	StableStoreDriver
+	NewWithLogger(path string, logger Logger) (StableStore, error)
+}
+
 var (
 	stableStoreDroverLock sync.RWMutex
 	stableStoreDrivers    map[string]StableStoreDriver = make(map[string]StableStoreDriver)
@@ -26,10 +32,20 @@ func RegisterStableStore(
 
 // NewStableStore creates new stable store
 func NewStableStore(name string, path string) (StableStore, error) {
+	return NewStableStoreWithLogger(name, path, nil)
+}
+
+// NewStableStoreWithLogger creates new stable store which logs to the logger.
+// The logger is ignored if the driver does not implement StableStoreDriverWithLogger.
+func NewStableStoreWithLogger(name string, path string, logger Logger) (StableStore, error) {
 	stableStoreDroverLock.RLock()
 	defer stableStoreDroverLock.RUnlock()
-	if driver, ok := stableStoreDrivers[name]; ok {
-		return driver.New(path)
+	driver, ok := stableStoreDrivers[name]
+	if !ok {
+		return nil, &ErrStableStoreDriverNotFound{DriverName: name}
+	}
+	if d, ok := driver.(StableStoreDriverWithLogger); ok && logger != nil {
+		return d.NewWithLogger(path, logger)
 	}
-	return nil, &ErrStableStoreDriverNotFound{DriverName: name}
+	return driver.New(path)
 }
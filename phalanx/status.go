@@ -0,0 +1,141 @@
+package phalanx
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft"
+)
+
+// statusPath serves the status of the node as JSON
+const statusPath = "/debug/phalanx/status"
+
+// Status is the status of a phalanx node
+type Status struct {
+	// Raft is the status of the raft node.
+	// The progress of the followers is known only on the leader.
+	Raft          raft.Status      `json:"raft"`
+	ClusterID     uint64           `json:"clusterID"`
+	AppliedIndex  uint64           `json:"appliedIndex"`
+	SnapshotIndex uint64           `json:"snapshotIndex"`
+	Peers         []PeerStatus     `json:"peers"`
+	ApplyQueue    ApplyQueueStatus `json:"applyQueue"`
+}
+
+// ApplyQueueStatus is the status of the queue of raft Readys waiting to be applied.
+// The growing Waits and Blocked tell that the apply path is the bottleneck.
+type ApplyQueueStatus struct {
+	Length   int `json:"length"`
+	Capacity int `json:"capacity"`
+	// Waits is the number of times the raft loop waited for the full queue
+	Waits uint64 `json:"waits"`
+	// Blocked is the total time the raft loop waited for the full queue
+	Blocked time.Duration `json:"blocked"`
+}
+
+// PeerStatus is the status of the connection to a peer
+type PeerStatus struct {
+	ID        uint64   `json:"id"`
+	URLs      []string `json:"urls"`
+	IsLearner bool     `json:"isLearner"`
+	// ActiveSince is the time since when the peer is reachable, or zero if it is not
+	ActiveSince time.Time `json:"activeSince"`
+	// Lag is the number of committed entries the peer does not have.
+	// It is known only on the leader.
+	Lag uint64 `json:"lag"`
+}
+
+// MarshalJSON formats the IDs in hex as the raft status does
+func (s Status) MarshalJSON() ([]byte, error) {
+	type status Status
+	return json.Marshal(struct {
+		ClusterID string `json:"clusterID"`
+		status
+	}{
+		ClusterID: types.ID(s.ClusterID).String(),
+		status:    status(s),
+	})
+}
+
+// MarshalJSON formats the ID in hex as the raft status does
+func (s PeerStatus) MarshalJSON() ([]byte, error) {
+	type peerStatus PeerStatus
+	return json.Marshal(struct {
+		ID string `json:"id"`
+		peerStatus
+	}{
+		ID:         types.ID(s.ID).String(),
+		peerStatus: peerStatus(s),
+	})
+}
+
+// Status returns the status of the node
+func (rc *phalanxNode) Status() Status {
+	st := Status{
+		AppliedIndex:  atomic.LoadUint64(&rc.appliedIndex),
+		SnapshotIndex: atomic.LoadUint64(&rc.snapshotIndex),
+	}
+	select {
+	case <-rc.startc:
+		st.Raft = rc.node.Status()
+		st.ClusterID = rc.clusterID
+		st.ApplyQueue = ApplyQueueStatus{
+			Length:   len(rc.applyc),
+			Capacity: cap(rc.applyc),
+			Waits:    atomic.LoadUint64(&rc.applyQueueWaits),
+			Blocked:  time.Duration(atomic.LoadInt64(&rc.applyQueueBlocked)),
+		}
+	default:
+		// raft is not started yet
+		st.Raft.ID = rc.self.id
+	}
+
+	for _, m := range rc.membership.list() {
+		if m.ID == rc.self.id {
+			continue
+		}
+		peer := PeerStatus{
+			ID:          m.ID,
+			URLs:        m.URLs,
+			IsLearner:   m.IsLearner,
+			ActiveSince: rc.activeSince(m.ID),
+		}
+		if pr, exists := st.Raft.Progress[m.ID]; exists {
+			peer.Lag = progressLag(st.Raft, pr)
+		}
+		st.Peers = append(st.Peers, peer)
+	}
+	return st
+}
+
+func (rc *phalanxNode) activeSince(id uint64) time.Time {
+	rc.membership.mu.Lock()
+	transport := rc.membership.transport
+	rc.membership.mu.Unlock()
+	if transport == nil {
+		return time.Time{}
+	}
+	return transport.ActiveSince(types.ID(id))
+}
+
+// statusHandler serves the status as JSON
+func statusHandler(status func() interface{}, logger Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := json.MarshalIndent(status(), "", "  ")
+		if err != nil {
+			logger.Error("failed to marshal status", errorField(err))
+			http.Error(w, "error marshaling status", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,121 @@
+package phalanx
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// SystemRegion is the region of the StableStore reserved for the state of phalanx.
+// It must not be used as a region of DB.
+const SystemRegion = "phalanx-system"
+
+var appliedIndexPrefix = []byte("applied/")
+
+var membersPrefix = []byte("members/")
+
+// clusterIdentityKey is the key of the cluster identity of the host
+var clusterIdentityKey = []byte("cluster")
+
+// createSystemRegion creates the system region if it does not exist
+func createSystemRegion(stableStore StableStore) error {
+	if stableStore.HasRegion(SystemRegion) {
+		return nil
+	}
+	if err := stableStore.CreateRegion(SystemRegion); err != nil {
+		return xerrors.Errorf("phalanx: failed to create system region: %w", err)
+	}
+	return nil
+}
+
+func appliedIndexKey(region string) []byte {
+	return append(append([]byte{}, appliedIndexPrefix...), region...)
+}
+
+// putAppliedIndex writes the index and the term of the last applied entry of the region to the batch.
+// The batch is written atomically with the writes of the entry.
+func putAppliedIndex(batch Batch, region string, index, term uint64) {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value[:8], index)
+	binary.BigEndian.PutUint64(value[8:], term)
+	batch.Put(SystemRegion, appliedIndexKey(region), value)
+}
+
+// loadAppliedIndex returns the index and the term of the last applied entry of the region.
+// It returns zeros if no entry is applied.
+func loadAppliedIndex(stableStore StableStore, region string) (uint64, uint64, error) {
+	snapshot, err := stableStore.GetSnapshot()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer snapshot.Release()
+	return readAppliedIndex(snapshot, region)
+}
+
+// readAppliedIndex returns the applied index and term of the region in the snapshot
+func readAppliedIndex(snapshot Snapshot, region string) (uint64, uint64, error) {
+	value, err := snapshot.Get(SystemRegion, appliedIndexKey(region))
+	if err == ErrKeyNotFound {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if len(value) != 16 {
+		return 0, 0, xerrors.Errorf(
+			"phalanx: invalid applied index of region(%s)", region)
+	}
+	return binary.BigEndian.Uint64(value[:8]), binary.BigEndian.Uint64(value[8:]), nil
+}
+
+// loadHostIdentity returns the cluster identity of the host, or nil if it is not persisted
+func loadHostIdentity(stableStore StableStore) (*clusterIdentity, error) {
+	snapshot, err := stableStore.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+	value, err := snapshot.Get(SystemRegion, clusterIdentityKey)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	identity, err := unmarshalClusterIdentity(value)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// saveHostIdentity persists the cluster identity of the host
+func saveHostIdentity(stableStore StableStore, identity clusterIdentity) error {
+	batch := stableStore.CreateBatch()
+	batch.Put(SystemRegion, clusterIdentityKey, identity.marshal())
+	return stableStore.WriteSync(batch)
+}
+
+func membersKey(region string) []byte {
+	return append(append([]byte{}, membersPrefix...), region...)
+}
+
+// putMembers writes the members of the raft group of the region to the batch
+func putMembers(batch Batch, region string, members []Member) error {
+	value, err := marshalMembers(members)
+	if err != nil {
+		return err
+	}
+	batch.Put(SystemRegion, membersKey(region), value)
+	return nil
+}
+
+// readMembers returns the members of the raft group of the region in the snapshot,
+// or nil if no member is persisted
+func readMembers(snapshot Snapshot, region string) ([]Member, error) {
+	value, err := snapshot.Get(SystemRegion, membersKey(region))
+	if err == ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return unmarshalMembers(value)
+}
@@ -0,0 +1,339 @@
+package phalanx
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/rafthttp"
+	"github.com/coreos/etcd/snap"
+	"golang.org/x/xerrors"
+)
+
+// serverFromHeader is the header of the member ID of the sender
+const serverFromHeader = "X-Server-From"
+
+// senderKey is the context key of the member authenticated by the request
+type senderKey struct{}
+
+func withSender(ctx context.Context, id types.ID) context.Context {
+	return context.WithValue(ctx, senderKey{}, id)
+}
+
+// senderFrom returns the member authenticated by the request of the context
+func senderFrom(ctx context.Context) (types.ID, bool) {
+	id, ok := ctx.Value(senderKey{}).(types.ID)
+	return id, ok
+}
+
+// PeerTLSInfo is the TLS configuration of the raft peer transport.
+// The listener and the client of a member use the same certificate,
+// so members authenticate each other by client certificates.
+// The certificate and the key are read at each handshake,
+// so renewed files take effect without a restart.
+type PeerTLSInfo struct {
+	CertFile      string
+	KeyFile       string
+	TrustedCAFile string
+	// MemberIdentity returns the identity of the member in its certificate,
+	// which is matched with the common name or a DNS name of the certificate.
+	// A Node matches the certificate of the member it connects to only by the common name.
+	// If nil, the identity is the member ID in hex.
+	MemberIdentity func(id uint64) string
+}
+
+func (info *PeerTLSInfo) tlsInfo() transport.TLSInfo {
+	return transport.TLSInfo{
+		CertFile:       info.CertFile,
+		KeyFile:        info.KeyFile,
+		TrustedCAFile:  info.TrustedCAFile,
+		ClientCertAuth: true,
+	}
+}
+
+func (info *PeerTLSInfo) identity(id uint64) string {
+	if info.MemberIdentity != nil {
+		return info.MemberIdentity(id)
+	}
+	return types.ID(id).String()
+}
+
+// verifyIdentity checks that the certificate belongs to the member
+func (info *PeerTLSInfo) verifyIdentity(cert *x509.Certificate, id uint64) error {
+	identity := info.identity(id)
+	if cert.Subject.CommonName == identity {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == identity {
+			return nil
+		}
+	}
+	return xerrors.Errorf(
+		"phalanx: certificate of %q does not match member %s",
+		cert.Subject.CommonName, types.ID(id))
+}
+
+// listen wraps the listener with TLS which requires client certificates
+func (info *PeerTLSInfo) listen(ln net.Listener) (net.Listener, error) {
+	config, err := info.tlsInfo().ServerConfig()
+	if err != nil {
+		return nil, xerrors.Errorf("phalanx: invalid peer TLS: %w", err)
+	}
+	return tls.NewListener(ln, config), nil
+}
+
+// clientConfig returns the client configuration to connect to the member
+func (info *PeerTLSInfo) clientConfig(id uint64) (*tls.Config, error) {
+	config, err := info.tlsInfo().ClientConfig()
+	if err != nil {
+		return nil, xerrors.Errorf("phalanx: invalid peer TLS: %w", err)
+	}
+	config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return xerrors.New("phalanx: peer certificate is not verified")
+		}
+		return info.verifyIdentity(chains[0][0], id)
+	}
+	return config, nil
+}
+
+// authorize rejects requests whose client certificate does not match
+// the member ID of the sender or the sender of the posted raft message.
+// The authenticated member is passed to the handler by the request context.
+func (info *PeerTLSInfo) authorize(next http.Handler, logger Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, rafthttp.ProbingPrefix) || r.URL.Path == statusPath {
+			// probing and status tell only the health of the member,
+			// and the client certificate is still verified by the CA
+			next.ServeHTTP(w, r)
+			return
+		}
+		from, err := info.authorizeRequest(r)
+		if err == nil {
+			err = verifyMessageSender(r, from)
+		}
+		if err != nil {
+			logger.Warn("rejected peer request", remoteField(r.RemoteAddr), errorField(err))
+			http.Error(w, "peer certificate does not match the member", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withSender(r.Context(), from)))
+	})
+}
+
+func (info *PeerTLSInfo) authorizeRequest(r *http.Request) (types.ID, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return 0, xerrors.New("phalanx: no client certificate")
+	}
+	header := r.Header.Get(serverFromHeader)
+	from, err := types.IDFromString(header)
+	if strings.HasPrefix(r.URL.Path, rafthttp.RaftStreamPrefix+"/") {
+		// rafthttp takes the member of a stream from the path
+		pathFrom, pathErr := types.IDFromString(path.Base(r.URL.Path))
+		if pathErr != nil {
+			return 0, xerrors.Errorf("phalanx: invalid stream member: %w", pathErr)
+		}
+		if header != "" && (err != nil || from != pathFrom) {
+			return 0, xerrors.Errorf(
+				"phalanx: stream of member %s requested by %q", pathFrom, header)
+		}
+		from, err = pathFrom, nil
+	}
+	if err != nil {
+		return 0, xerrors.Errorf("phalanx: invalid sender: %w", err)
+	}
+	return from, info.verifyIdentity(r.TLS.PeerCertificates[0], uint64(from))
+}
+
+// verifyMessageSender checks the sender of the message posted to rafthttp,
+// because rafthttp steps the message without checking it.
+// The read bytes are put back to the body.
+func verifyMessageSender(r *http.Request, from types.ID) error {
+	if r.Method != http.MethodPost {
+		return nil
+	}
+	var data []byte
+	switch r.URL.Path {
+	case rafthttp.RaftPrefix:
+		// rafthttp reads the whole body of a pipeline request as the message
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return xerrors.Errorf("phalanx: fail to read raft message: %w", err)
+		}
+		data = b
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{bytes.NewReader(b), r.Body}
+	case rafthttp.RaftSnapshotPrefix:
+		// the message is prefixed by its size and followed by the checkpoint
+		var size uint64
+		if err := binary.Read(r.Body, binary.BigEndian, &size); err != nil {
+			return xerrors.Errorf("phalanx: fail to read snapshot message: %w", err)
+		}
+		if size > maxFrameSize {
+			return xerrors.Errorf("phalanx: snapshot message size %d exceeds the limit %d", size, maxFrameSize)
+		}
+		b := make([]byte, 8+size)
+		binary.BigEndian.PutUint64(b, size)
+		if _, err := io.ReadFull(r.Body, b[8:]); err != nil {
+			return xerrors.Errorf("phalanx: fail to read snapshot message: %w", err)
+		}
+		data = b[8:]
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	default:
+		return nil
+	}
+	var m raftpb.Message
+	if err := m.Unmarshal(data); err != nil {
+		return xerrors.Errorf("phalanx: invalid raft message: %w", err)
+	}
+	if types.ID(m.From) != from {
+		return xerrors.Errorf("phalanx: message of %s sent by member %s: %w", types.ID(m.From), from, ErrSenderMismatch)
+	}
+	return nil
+}
+
+// tlsTransport is the rafthttp transport of a node with TLS.
+// rafthttp connects to all peers with one client configuration,
+// so each peer has its own rafthttp transport
+// which accepts only the common name of the member.
+// The requests of a peer are served by its transport,
+// and the other requests are served by the base transport.
+type tlsTransport struct {
+	base   *rafthttp.Transport
+	info   *PeerTLSInfo
+	logger Logger
+
+	mu    sync.RWMutex
+	peers map[types.ID]*tlsPeer
+}
+
+type tlsPeer struct {
+	transport *rafthttp.Transport
+	handler   http.Handler
+}
+
+func newTLSTransport(base *rafthttp.Transport, info *PeerTLSInfo, logger Logger) *tlsTransport {
+	base.TLSInfo = info.tlsInfo()
+	return &tlsTransport{
+		base:   base,
+		info:   info,
+		logger: logger,
+		peers:  make(map[types.ID]*tlsPeer),
+	}
+}
+
+func (t *tlsTransport) Start() error {
+	return t.base.Start()
+}
+
+func (t *tlsTransport) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, p := range t.peers {
+		p.transport.Stop()
+		delete(t.peers, id)
+	}
+	t.base.Stop()
+}
+
+// Handler serves the requests with the transport of the authenticated sender
+func (t *tlsTransport) Handler() http.Handler {
+	base := t.base.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if from, ok := senderFrom(r.Context()); ok {
+			t.mu.RLock()
+			p, exists := t.peers[from]
+			t.mu.RUnlock()
+			if exists {
+				p.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		base.ServeHTTP(w, r)
+	})
+}
+
+func (t *tlsTransport) Send(msgs []raftpb.Message) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for i := range msgs {
+		if p, exists := t.peers[types.ID(msgs[i].To)]; exists {
+			p.transport.Send(msgs[i : i+1])
+		}
+	}
+}
+
+func (t *tlsTransport) SendSnapshot(m snap.Message) {
+	t.mu.RLock()
+	p, exists := t.peers[types.ID(m.To)]
+	t.mu.RUnlock()
+	if !exists {
+		m.CloseWithError(xerrors.Errorf("phalanx: peer %s not found", types.ID(m.To)))
+		return
+	}
+	p.transport.SendSnapshot(m)
+}
+
+func (t *tlsTransport) AddPeer(id types.ID, urls []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, dup := t.peers[id]; dup {
+		return
+	}
+	info := t.info.tlsInfo()
+	// rafthttp verifies the certificate of the peer by its common name
+	info.AllowedCN = t.info.identity(uint64(id))
+	pt := &rafthttp.Transport{
+		TLSInfo:     info,
+		ID:          t.base.ID,
+		ClusterID:   t.base.ClusterID,
+		Raft:        t.base.Raft,
+		ServerStats: t.base.ServerStats,
+		LeaderStats: t.base.LeaderStats,
+		ErrorC:      t.base.ErrorC,
+		Snapshotter: t.base.Snapshotter,
+	}
+	if err := pt.Start(); err != nil {
+		t.logger.Error("failed to configure TLS to peer", peerField(id), errorField(err))
+		return
+	}
+	pt.AddPeer(id, urls)
+	t.peers[id] = &tlsPeer{transport: pt, handler: pt.Handler()}
+}
+
+func (t *tlsTransport) RemovePeer(id types.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, exists := t.peers[id]; exists {
+		p.transport.Stop()
+		delete(t.peers, id)
+	}
+}
+
+func (t *tlsTransport) ActiveSince(id types.ID) time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if p, exists := t.peers[id]; exists {
+		return p.transport.ActiveSince(id)
+	}
+	return time.Time{}
+}
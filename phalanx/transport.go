@@ -0,0 +1,623 @@
+package phalanx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// raftTransport sends raft messages to the other members of a raft group.
+// It is implemented by rafthttp.Transport and groupTransport.
+type raftTransport interface {
+	Start() error
+	Stop()
+	Send(msgs []raftpb.Message)
+	SendSnapshot(m snap.Message)
+	AddPeer(id types.ID, urls []string)
+	RemovePeer(id types.ID)
+	// ActiveSince returns the time since when the peer is reachable, or zero if it is not
+	ActiveSince(id types.ID) time.Time
+}
+
+const (
+	multiRaftPath         = "/multiraft"
+	multiRaftSnapshotPath = "/multiraft/snapshot"
+
+	// frame header is group ID and message length
+	frameHeaderSize = 8 + 4
+	// a longer frame is refused before it is allocated, as rafthttp limits a message
+	maxFrameSize = 512 * 1024 * 1024
+
+	peerQueueSize         = 4096
+	maxMessagesPerRequest = 256
+	peerRequestTimeout    = 5 * time.Second
+	// messages are posted to a peer over concurrent requests,
+	// so that a slow request does not hold the messages of all groups
+	sendersPerPeer = 4
+)
+
+// multiTransport multiplexes messages of many raft groups
+// over one connection per peer.
+// Each message is framed with the ID of its raft group.
+type multiTransport struct {
+	sync.RWMutex
+	id             types.ID
+	clusterID      types.ID
+	client         *http.Client
+	snapshotClient *http.Client // without timeout to stream large snapshots
+	peerTLS        *PeerTLSInfo // nil if peers communicate in plain HTTP
+	logger         Logger
+
+	groups map[uint64]*phalanxNode
+	// peers shared by the groups and the number of groups which use them
+	peers      map[types.ID]*multiPeer
+	peerRefs   map[types.ID]int
+	groupPeers map[uint64]map[types.ID]struct{}
+}
+
+func newMultiTransport(id, clusterID types.ID, peerTLS *PeerTLSInfo, logger Logger) *multiTransport {
+	return &multiTransport{
+		id:        id,
+		clusterID: clusterID,
+		peerTLS:   peerTLS,
+		logger:    logger,
+		client:    &http.Client{Timeout: peerRequestTimeout},
+		// streaming is canceled by the peer
+		snapshotClient: &http.Client{},
+		groups:         make(map[uint64]*phalanxNode),
+		peers:          make(map[types.ID]*multiPeer),
+		peerRefs:       make(map[types.ID]int),
+		groupPeers:     make(map[uint64]map[types.ID]struct{}),
+	}
+}
+
+// group returns the transport of a raft group
+func (t *multiTransport) group(groupID uint64, rc *phalanxNode) *groupTransport {
+	return &groupTransport{
+		multi:   t,
+		groupID: groupID,
+		node:    rc,
+	}
+}
+
+// Stop stops all peers
+func (t *multiTransport) Stop() {
+	t.Lock()
+	defer t.Unlock()
+	for id, p := range t.peers {
+		p.stop()
+		delete(t.peers, id)
+	}
+}
+
+// addGroup registers the raft group.
+// The group ID taken by another group is refused.
+func (t *multiTransport) addGroup(groupID uint64, rc *phalanxNode) error {
+	t.Lock()
+	defer t.Unlock()
+	if other, dup := t.groups[groupID]; dup {
+		return xerrors.Errorf(
+			"multiraft: group %x of region %s is taken by region %s: %w",
+			groupID, rc.region, other.region, ErrGroupIDConflict)
+	}
+	t.groups[groupID] = rc
+	t.groupPeers[groupID] = make(map[types.ID]struct{})
+	return nil
+}
+
+// removeGroup unregisters the raft group if it is registered by rc
+func (t *multiTransport) removeGroup(groupID uint64, rc *phalanxNode) {
+	t.Lock()
+	defer t.Unlock()
+	if t.groups[groupID] != rc {
+		return
+	}
+	for id := range t.groupPeers[groupID] {
+		t.releasePeer(id)
+	}
+	delete(t.groupPeers, groupID)
+	delete(t.groups, groupID)
+}
+
+func (t *multiTransport) addPeer(groupID uint64, id types.ID, urls []string) {
+	t.Lock()
+	defer t.Unlock()
+	groupPeers, ok := t.groupPeers[groupID]
+	if !ok {
+		return
+	}
+	if _, dup := groupPeers[id]; dup {
+		return
+	}
+	groupPeers[id] = struct{}{}
+	t.peerRefs[id]++
+	if _, exists := t.peers[id]; !exists {
+		p := newMultiPeer(t, id, urls)
+		t.peers[id] = p
+		p.start()
+	}
+}
+
+func (t *multiTransport) removePeer(groupID uint64, id types.ID) {
+	t.Lock()
+	defer t.Unlock()
+	groupPeers, ok := t.groupPeers[groupID]
+	if !ok {
+		return
+	}
+	if _, exists := groupPeers[id]; !exists {
+		return
+	}
+	delete(groupPeers, id)
+	t.releasePeer(id)
+}
+
+// releasePeer stops the peer if no group uses it.
+// the caller must hold the lock.
+func (t *multiTransport) releasePeer(id types.ID) {
+	t.peerRefs[id]--
+	if t.peerRefs[id] > 0 {
+		return
+	}
+	delete(t.peerRefs, id)
+	if p, exists := t.peers[id]; exists {
+		p.stop()
+		delete(t.peers, id)
+	}
+}
+
+func (t *multiTransport) send(groupID uint64, msgs []raftpb.Message) {
+	t.RLock()
+	defer t.RUnlock()
+	for i := range msgs {
+		if msgs[i].To == 0 {
+			// ignore intentionally dropped message
+			continue
+		}
+		p, exists := t.peers[types.ID(msgs[i].To)]
+		if !exists {
+			continue
+		}
+		msgc := p.msgc
+		if isHeartbeat(msgs[i]) {
+			msgc = p.heartbeatc
+		}
+		select {
+		case msgc <- groupMessage{groupID: groupID, msg: msgs[i]}:
+		default:
+			// raft retries dropped messages
+			t.report(groupID, msgs[i], false)
+		}
+	}
+}
+
+// isHeartbeat tells whether the message keeps the leadership,
+// which is sent apart from the other messages not to be delayed by them
+func isHeartbeat(m raftpb.Message) bool {
+	return m.Type == raftpb.MsgHeartbeat || m.Type == raftpb.MsgHeartbeatResp
+}
+
+// report reports the result of sending the message to its raft group
+func (t *multiTransport) report(groupID uint64, m raftpb.Message, ok bool) {
+	rc, exists := t.groups[groupID]
+	if !exists {
+		return
+	}
+	if !ok {
+		rc.ReportUnreachable(m.To)
+	}
+	if m.Type == raftpb.MsgSnap {
+		if ok {
+			rc.ReportSnapshot(m.To, raft.SnapshotFinish)
+		} else {
+			rc.ReportSnapshot(m.To, raft.SnapshotFailure)
+		}
+	}
+}
+
+// ServeHTTP receives messages from peers and steps them into their raft groups
+func (t *multiTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	if !t.fromCluster(r) {
+		http.Error(w, "cluster ID mismatch", http.StatusPreconditionFailed)
+		return
+	}
+
+	reader := bufio.NewReader(r.Body)
+	for {
+		groupID, m, err := readFrame(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.logger.Warn("failed to read multiraft message", errorField(err))
+			http.Error(w, "error reading raft message", http.StatusBadRequest)
+			return
+		}
+		if !t.fromSender(r, m) {
+			t.logger.Warn("dropped multiraft message sent by another member", peerField(types.ID(m.From)))
+			continue
+		}
+
+		t.RLock()
+		rc, exists := t.groups[groupID]
+		t.RUnlock()
+		if !exists {
+			// the group is not created on this host yet
+			continue
+		}
+		if err := rc.Process(r.Context(), m); err != nil {
+			t.logger.Warn("failed to process multiraft message", errorField(err))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// activeSince returns the time since when the peer is reachable
+func (t *multiTransport) activeSince(id types.ID) time.Time {
+	t.RLock()
+	p, exists := t.peers[id]
+	t.RUnlock()
+	if !exists {
+		return time.Time{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.activeSince
+}
+
+// sendSnapshot streams the snapshot message and the checkpoint to the peer
+func (t *multiTransport) sendSnapshot(groupID uint64, m snap.Message) {
+	t.RLock()
+	p, exists := t.peers[types.ID(m.To)]
+	t.RUnlock()
+	if !exists {
+		m.CloseWithError(errors.Errorf("multiraft: peer %s not found", types.ID(m.To)))
+		t.RLock()
+		t.report(groupID, m.Message, false)
+		t.RUnlock()
+		return
+	}
+
+	go func() {
+		err := p.postSnapshot(groupID, m)
+		m.CloseWithError(err)
+		if err != nil {
+			t.logger.Warn("failed to send snapshot", peerField(p.id), indexField(m.Snapshot.Metadata.Index), errorField(err))
+		}
+		t.RLock()
+		t.report(groupID, m.Message, err == nil)
+		t.RUnlock()
+	}()
+}
+
+// serveSnapshot saves the streamed checkpoint and steps the snapshot message into its raft group
+func (t *multiTransport) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	if !t.fromCluster(r) {
+		http.Error(w, "cluster ID mismatch", http.StatusPreconditionFailed)
+		return
+	}
+
+	reader := bufio.NewReader(r.Body)
+	groupID, m, err := readFrame(reader)
+	if err != nil || m.Type != raftpb.MsgSnap {
+		t.logger.Warn("failed to read snapshot message", errorField(err))
+		http.Error(w, "error reading snapshot message", http.StatusBadRequest)
+		return
+	}
+	if !t.fromSender(r, m) {
+		http.Error(w, "snapshot message sent by another member", http.StatusForbidden)
+		return
+	}
+
+	t.RLock()
+	rc, exists := t.groups[groupID]
+	t.RUnlock()
+	if !exists {
+		http.Error(w, "raft group not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := rc.snapshotter.SaveDBFrom(reader, m.Snapshot.Metadata.Index); err != nil {
+		t.logger.Error("failed to save checkpoint", indexField(m.Snapshot.Metadata.Index), errorField(err))
+		http.Error(w, "error saving checkpoint", http.StatusInternalServerError)
+		return
+	}
+	if err := rc.Process(r.Context(), m); err != nil {
+		t.logger.Error("failed to process snapshot message", indexField(m.Snapshot.Metadata.Index), errorField(err))
+		http.Error(w, "error processing snapshot message", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fromCluster tells whether the request is sent by a member of the same cluster
+func (t *multiTransport) fromCluster(r *http.Request) bool {
+	clusterID := r.Header.Get(clusterIDHeader)
+	if clusterID != t.clusterID.String() {
+		t.logger.Warn("rejected multiraft request of another cluster",
+			Field{Key: "cluster-id", Value: clusterID}, remoteField(r.RemoteAddr))
+		return false
+	}
+	return true
+}
+
+// fromSender tells whether the message is sent by the authenticated member.
+// The sender is not authenticated without TLS.
+func (t *multiTransport) fromSender(r *http.Request, m raftpb.Message) bool {
+	if t.peerTLS == nil {
+		return true
+	}
+	from, ok := senderFrom(r.Context())
+	return ok && from == types.ID(m.From)
+}
+
+// groupTransport is the transport of a raft group on a shared multiTransport
+type groupTransport struct {
+	multi   *multiTransport
+	groupID uint64
+	node    *phalanxNode
+}
+
+func (g *groupTransport) Start() error {
+	return g.multi.addGroup(g.groupID, g.node)
+}
+
+func (g *groupTransport) Stop() {
+	g.multi.removeGroup(g.groupID, g.node)
+}
+
+func (g *groupTransport) Send(msgs []raftpb.Message) {
+	g.multi.send(g.groupID, msgs)
+}
+
+func (g *groupTransport) SendSnapshot(m snap.Message) {
+	g.multi.sendSnapshot(g.groupID, m)
+}
+
+func (g *groupTransport) AddPeer(id types.ID, urls []string) {
+	g.multi.addPeer(g.groupID, id, urls)
+}
+
+func (g *groupTransport) RemovePeer(id types.ID) {
+	g.multi.removePeer(g.groupID, id)
+}
+
+func (g *groupTransport) ActiveSince(id types.ID) time.Time {
+	return g.multi.activeSince(id)
+}
+
+type groupMessage struct {
+	groupID uint64
+	msg     raftpb.Message
+}
+
+// multiPeer sends messages of all groups to a peer in batches.
+// Heartbeats are sent by their own sender,
+// and the other messages by sendersPerPeer concurrent senders.
+type multiPeer struct {
+	transport  *multiTransport
+	id         types.ID
+	urls       []string
+	msgc       chan groupMessage
+	heartbeatc chan groupMessage
+
+	client         *http.Client
+	snapshotClient *http.Client
+
+	mu          sync.Mutex
+	activeSince time.Time // zero while the peer is unreachable
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newMultiPeer(t *multiTransport, id types.ID, urls []string) *multiPeer {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &multiPeer{
+		transport:      t,
+		id:             id,
+		urls:           urls,
+		msgc:           make(chan groupMessage, peerQueueSize),
+		heartbeatc:     make(chan groupMessage, peerQueueSize),
+		client:         t.client,
+		snapshotClient: t.snapshotClient,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	if t.peerTLS != nil {
+		// the certificate of the peer must match its member ID
+		config, err := t.peerTLS.clientConfig(uint64(id))
+		if err != nil {
+			t.logger.Error("failed to configure TLS to peer", peerField(id), errorField(err))
+			return p
+		}
+		p.client = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+			Timeout:   peerRequestTimeout,
+		}
+		p.snapshotClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+		}
+	}
+	return p
+}
+
+func (p *multiPeer) setActive(active bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !active {
+		p.activeSince = time.Time{}
+	} else if p.activeSince.IsZero() {
+		p.activeSince = time.Now()
+	}
+}
+
+func (p *multiPeer) stop() {
+	p.cancel()
+	if p.client != p.transport.client {
+		p.client.CloseIdleConnections()
+		p.snapshotClient.CloseIdleConnections()
+	}
+}
+
+// start starts the senders of the peer
+func (p *multiPeer) start() {
+	go p.run(p.heartbeatc)
+	for i := 0; i < sendersPerPeer; i++ {
+		go p.run(p.msgc)
+	}
+}
+
+// run posts the messages of msgc until the peer is stopped
+func (p *multiPeer) run(msgc <-chan groupMessage) {
+	urlIndex := 0
+	for {
+		select {
+		case gm := <-msgc:
+			batch := []groupMessage{gm}
+		drain:
+			for len(batch) < maxMessagesPerRequest {
+				select {
+				case gm := <-msgc:
+					batch = append(batch, gm)
+				default:
+					break drain
+				}
+			}
+
+			err := p.post(p.urls[urlIndex], batch)
+			if err != nil {
+				// try the next URL at the next request
+				urlIndex = (urlIndex + 1) % len(p.urls)
+			}
+			p.setActive(err == nil)
+			p.transport.RLock()
+			for i := range batch {
+				p.transport.report(batch[i].groupID, batch[i].msg, err == nil)
+			}
+			p.transport.RUnlock()
+
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *multiPeer) post(url string, batch []groupMessage) error {
+	buffer := new(bytes.Buffer)
+	for i := range batch {
+		if err := writeFrame(buffer, batch[i].groupID, batch[i].msg); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", url+multiRaftPath, buffer)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(p.ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(serverFromHeader, p.transport.id.String())
+	req.Header.Set(clusterIDHeader, p.transport.clusterID.String())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.Errorf("multiraft: unexpected status %s from peer %s", resp.Status, p.id)
+	}
+	return nil
+}
+
+func (p *multiPeer) postSnapshot(groupID uint64, m snap.Message) error {
+	header := new(bytes.Buffer)
+	if err := writeFrame(header, groupID, m.Message); err != nil {
+		return err
+	}
+	body := io.MultiReader(header, m.ReadCloser)
+
+	req, err := http.NewRequest("POST", p.urls[0]+multiRaftSnapshotPath, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(p.ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(serverFromHeader, p.transport.id.String())
+	req.Header.Set(clusterIDHeader, p.transport.clusterID.String())
+
+	resp, err := p.snapshotClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.Errorf("multiraft: unexpected status %s from peer %s", resp.Status, p.id)
+	}
+	return nil
+}
+
+func writeFrame(w io.Writer, groupID uint64, m raftpb.Message) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint64(header[:8], groupID)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) (uint64, raftpb.Message, error) {
+	var m raftpb.Message
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, m, err
+	}
+	groupID := binary.BigEndian.Uint64(header[:8])
+	size := binary.BigEndian.Uint32(header[8:])
+	if size > maxFrameSize {
+		return 0, m, errors.Errorf("multiraft: frame size %d exceeds the limit %d", size, maxFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, m, err
+	}
+	err := m.Unmarshal(data)
+	return groupID, m, err
+}
@@ -0,0 +1,120 @@
+package phalanx_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/getumen/doctrine/phalanx"
+	"github.com/getumen/doctrine/phalanx/phalanxpb"
+)
+
+type nopHandler struct{}
+
+func (nopHandler) Apply(string, *phalanxpb.Command, phalanx.Batch, phalanx.StableStore) (interface{}, error) {
+	return nil, nil
+}
+
+func TestHostRefusesGroupIDConflict(t *testing.T) {
+	defer phalanx.SetGroupID(func(string) uint64 { return 1 })()
+
+	tempDir, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	stableStore, err := phalanx.NewStableStore("leveldb", filepath.Join(tempDir, "stableStore"))
+	if err != nil {
+		t.Fatalf("fail to create stable store: %+v", err)
+	}
+	defer stableStore.Close()
+
+	host := phalanx.NewHost(1, []string{"member-1=http://127.0.0.1:10259"}, false, tempDir, "", stableStore, nopHandler{})
+	if err := host.Start(); err != nil {
+		t.Fatalf("fail to start host: %+v", err)
+	}
+	defer host.Stop()
+
+	if _, err := host.AddRegion("region-a"); err != nil {
+		t.Fatalf("fail to add region: %+v", err)
+	}
+	// region-b derives the group ID of region-a
+	if _, err := host.AddRegion("region-b"); !errors.Is(err, phalanx.ErrGroupIDConflict) {
+		t.Fatalf("expect group ID conflict, got %+v", err)
+	}
+	if _, err := host.Region("region-a"); err != nil {
+		t.Fatalf("expect region-a is kept, got %+v", err)
+	}
+
+	// the group ID is released by the removed region
+	if err := host.RemoveRegion("region-a"); err != nil {
+		t.Fatalf("fail to remove region: %+v", err)
+	}
+	if _, err := host.AddRegion("region-b"); err != nil {
+		t.Fatalf("fail to add region: %+v", err)
+	}
+}
+
+func TestMultiTransportSendsPastSlowRequest(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan raftpb.Message, 16)
+	// the peer holds the request of the first append of group 1
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for {
+			header := make([]byte, 12)
+			if _, err := io.ReadFull(r.Body, header); err != nil {
+				break
+			}
+			data := make([]byte, binary.BigEndian.Uint32(header[8:]))
+			if _, err := io.ReadFull(r.Body, data); err != nil {
+				break
+			}
+			var m raftpb.Message
+			if err := m.Unmarshal(data); err != nil {
+				break
+			}
+			if m.Type == raftpb.MsgApp && binary.BigEndian.Uint64(header[:8]) == 1 {
+				<-release
+			}
+			received <- m
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer peer.Close()
+	defer close(release)
+
+	transport := phalanx.NewMultiTestTransport(1)
+	defer transport.Stop()
+	for _, groupID := range []uint64{1, 2} {
+		if err := transport.AddGroup(groupID, 2, peer.URL); err != nil {
+			t.Fatalf("fail to add group: %+v", err)
+		}
+	}
+
+	transport.Send(1, raftpb.Message{Type: raftpb.MsgApp, From: 1, To: 2})
+	time.Sleep(100 * time.Millisecond)
+	transport.Send(1, raftpb.Message{Type: raftpb.MsgHeartbeat, From: 1, To: 2})
+	transport.Send(2, raftpb.Message{Type: raftpb.MsgApp, From: 1, To: 2})
+
+	// the heartbeat and the append of another group are not held by the slow request
+	types := make(map[raftpb.MessageType]bool)
+	for len(types) < 2 {
+		select {
+		case m := <-received:
+			types[m.Type] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expect the messages are sent during the slow request, got %v", types)
+		}
+	}
+	if !types[raftpb.MsgHeartbeat] || !types[raftpb.MsgApp] {
+		t.Fatalf("unexpected messages %v", types)
+	}
+}
@@ -0,0 +1,84 @@
+package phalanx
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// walLogStore is the default LogStore.
+// Entries are persisted in WAL and served from raft.MemoryStorage,
+// so the whole log since the last compaction is kept in memory.
+type walLogStore struct {
+	*raft.MemoryStorage
+	wal *wal.WAL
+
+	hardState raftpb.HardState // last hard state saved to WAL
+	metrics   *nodeMetrics
+}
+
+func (s *walLogStore) Save(
+	st raftpb.HardState,
+	ents []raftpb.Entry,
+	snap raftpb.Snapshot,
+) error {
+	// WAL syncs the file on the same condition
+	mustSync := (!raft.IsEmptyHardState(st) || len(ents) > 0) &&
+		raft.MustSync(st, s.hardState, len(ents))
+	start := time.Now()
+	if err := s.wal.Save(st, ents); err != nil {
+		return err
+	}
+	if mustSync {
+		s.metrics.observeWALSave(start)
+	}
+	if !raft.IsEmptyHardState(st) {
+		s.hardState = st
+	}
+	if !raft.IsEmptySnap(snap) {
+		// must save the snapshot index to the WAL before saving the
+		// snapshot to maintain the invariant that we only Open the
+		// wal at previously-saved snapshot indexes.
+		if err := s.saveSnap(snap); err != nil {
+			return err
+		}
+		if err := s.MemoryStorage.ApplySnapshot(snap); err != nil {
+			return err
+		}
+	}
+	return s.MemoryStorage.Append(ents)
+}
+
+func (s *walLogStore) CreateSnapshot(
+	i uint64,
+	cs *raftpb.ConfState,
+	data []byte,
+) (raftpb.Snapshot, error) {
+	snap, err := s.MemoryStorage.CreateSnapshot(i, cs, data)
+	if err != nil {
+		return snap, err
+	}
+	return snap, s.saveSnap(snap)
+}
+
+func (s *walLogStore) Compact(compactIndex uint64) error {
+	if err := s.MemoryStorage.Compact(compactIndex); err != nil {
+		return err
+	}
+	return s.wal.ReleaseLockTo(compactIndex)
+}
+
+func (s *walLogStore) Close() error {
+	return s.wal.Close()
+}
+
+func (s *walLogStore) saveSnap(snap raftpb.Snapshot) error {
+	walSnap := walpb.Snapshot{
+		Index: snap.Metadata.Index,
+		Term:  snap.Metadata.Term,
+	}
+	return s.wal.SaveSnapshot(walSnap)
+}